@@ -0,0 +1,149 @@
+package media
+
+import (
+	"crypto/hmac"
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/settings"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sigV4MaxSkew is how far the X-Amz-Date of a request may be from the server clock.
+	sigV4MaxSkew = 15 * time.Minute
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// sigV4Now is the clock requests are checked against.
+var sigV4Now = time.Now
+
+var (
+	ErrAccessDenied           = S3Error{Code: "AccessDenied", Message: "Access Denied."}
+	ErrAuthorizationMalformed = S3Error{Code: "AuthorizationHeaderMalformed", Message: "The authorization header is malformed."}
+	ErrContentSHA256Mismatch  = S3Error{Code: "XAmzContentSHA256Mismatch", Message: "The provided x-amz-content-sha256 header does not match what was computed."}
+	ErrInvalidAccessKeyID     = S3Error{Code: "InvalidAccessKeyId", Message: "The access key Id you provided does not exist in our records."}
+	ErrRequestExpired         = S3Error{Code: "AccessDenied", Message: "Request has expired."}
+	ErrRequestTimeTooSkewed   = S3Error{Code: "RequestTimeTooSkewed", Message: "The difference between the request time and the server's time is too large."}
+	ErrSignatureDoesNotMatch  = S3Error{Code: "SignatureDoesNotMatch", Message: "The request signature we calculated does not match the signature you provided."}
+)
+
+// LookupAccessKey finds an access key in MEDIA.ACCESS_KEYS, a JSON object of access key => {secret_key, identity},
+// and then in the media_access_key table.
+func LookupAccessKey(accessKey string) (*AccessKey, bool) {
+	var configured map[string]struct {
+		SecretKey string `json:"secret_key"`
+		Identity  string `json:"identity"`
+	}
+	if settings.Get("MEDIA.ACCESS_KEYS").ParseJSON(&configured) == nil {
+		if key, ok := configured[accessKey]; ok {
+			return &AccessKey{AccessKey: accessKey, SecretKey: key.SecretKey, Identity: key.Identity}, true
+		}
+	}
+	var key AccessKey
+	if db.Where("access_key = ? AND disabled = 0", accessKey).Take(&key).RowsAffected == 0 {
+		return nil, false
+	}
+	return &key, true
+}
+
+// authenticateMultipart returns the identity that signed a multipart request.
+// Requests are only verified when MEDIA.MULTIPART_SIGV4 is enabled, otherwise the identity is empty.
+func authenticateMultipart(request *evo.Request) (string, error) {
+	if !settings.Get("MEDIA.MULTIPART_SIGV4").Bool() {
+		return "", nil
+	}
+	return VerifySigV4(request)
+}
+
+// VerifySigV4 checks the AWS Signature Version 4 of a request, sent either in the Authorization header
+// or as a presigned query string, and returns the identity of the access key that signed it.
+// Requests must be signed for the s3 service in the region of MEDIA.MULTIPART_REGION, us-east-1 by default.
+func VerifySigV4(request *evo.Request) (string, error) {
+	var query = request.URL().Query
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	var expires time.Duration
+
+	if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+			return "", ErrAuthorizationMalformed
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds <= 0 || seconds > 7*24*3600 {
+			return "", ErrAuthorizationMalformed
+		}
+		expires = time.Duration(seconds) * time.Second
+		payloadHash = unsignedPayload
+	} else {
+		var header = request.Header("Authorization")
+		fields, ok := strings.CutPrefix(header, sigV4Algorithm+" ")
+		if !ok {
+			return "", ErrAccessDenied
+		}
+		for _, field := range strings.Split(fields, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		amzDate = request.Header("X-Amz-Date")
+		payloadHash = request.Header("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = sha256Hex(request.Context.Body())
+		} else if payloadHash != unsignedPayload && payloadHash != sha256Hex(request.Context.Body()) {
+			return "", ErrContentSHA256Mismatch
+		}
+	}
+
+	// Credential is <access key>/<date>/<region>/<service>/aws4_request
+	var scope = strings.Split(credential, "/")
+	if len(scope) != 5 || scope[4] != "aws4_request" || signature == "" || signedHeaders == "" {
+		return "", ErrAuthorizationMalformed
+	}
+	if scope[2] != settings.Get("MEDIA.MULTIPART_REGION", "us-east-1").String() || scope[3] != "s3" {
+		return "", ErrAuthorizationMalformed
+	}
+	date, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil || scope[1] != amzDate[:8] {
+		return "", ErrAuthorizationMalformed
+	}
+	if expires > 0 {
+		if sigV4Now().After(date.Add(expires)) {
+			return "", ErrRequestExpired
+		}
+	} else if d := sigV4Now().Sub(date); d > sigV4MaxSkew || d < -sigV4MaxSkew {
+		return "", ErrRequestTimeTooSkewed
+	}
+
+	var headers = strings.Split(signedHeaders, ";")
+	if !slices.Contains(headers, "host") {
+		return "", ErrAuthorizationMalformed
+	}
+	key, ok := LookupAccessKey(scope[0])
+	if !ok {
+		return "", ErrInvalidAccessKeyID
+	}
+
+	// the path is signed as sent by the client, i.e. already URI encoded
+	var uri, _, _ = strings.Cut(request.Context.OriginalURL(), "?")
+	var canonical = sigV4CanonicalRequest(request.Method(), uri, query, func(name string) string {
+		return request.Header(name)
+	}, headers, payloadHash)
+	var expected = sigV4Signature(key.SecretKey, amzDate, strings.Join(scope[1:], "/"), canonical)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", ErrSignatureDoesNotMatch
+	}
+	return key.Identity, nil
+}
@@ -2,11 +2,12 @@ package media
 
 import (
 	"errors"
+	"fmt"
 	"github.com/getevo/evo/v2"
 	"github.com/getevo/evo/v2/lib/db"
 	"github.com/getevo/evo/v2/lib/gpath"
-	"github.com/getevo/evo/v2/lib/log"
 	"github.com/getevo/evo/v2/lib/settings"
+	"time"
 )
 
 const (
@@ -16,24 +17,49 @@ const (
 	UPLOADING  = "uploading"
 )
 
+const (
+	// ModeAll serves the API and processes jobs in the same process.
+	ModeAll = "all"
+	// ModeAPI serves the API only; jobs are left to worker nodes and ffmpeg is not required.
+	ModeAPI = "api"
+	// ModeWorker processes jobs only and registers no routes.
+	ModeWorker = "worker"
+)
+
 var TemporaryDir = ""
 var LocalUploadDir = ""
 var mediaUploadedCallbacks []func(media *Media) error
 
-type App struct{}
+type App struct {
+	// Mode is one of ModeAll, ModeAPI or ModeWorker. MEDIA.MODE is used if empty.
+	Mode string
+}
+
+func (a App) mode() string {
+	if a.Mode != "" {
+		return a.Mode
+	}
+	return settings.Get("MEDIA.MODE", ModeAll).String()
+}
 
 func (a App) Register() error {
-	db.UseModel(Media{}, Collection{}, CollectionItems{}, MetaData{})
+	db.UseModel(Media{}, Collection{}, CollectionItems{}, MetaData{}, Blob{}, UploadSession{}, UploadPart{}, AccessKey{}, Job{})
 	/*	var err = db.SetupJoinTable(&Media{}, "Collections", &CollectionItems{})
 		if err != nil {
 			return err
 		}*/
-	// check ffmpeg installed
-	if !IsFFMpegInstalled() {
-		return errors.New("ffmpeg is not installed")
-	}
-	if !IsFFProbeInstalled() {
-		return errors.New("ffprobe is not installed")
+	switch a.mode() {
+	case ModeAll, ModeWorker:
+		// check ffmpeg installed
+		if !IsFFMpegInstalled() {
+			return errors.New("ffmpeg is not installed")
+		}
+		if !IsFFProbeInstalled() {
+			return errors.New("ffprobe is not installed")
+		}
+	case ModeAPI:
+	default:
+		return fmt.Errorf("unknown media mode %s", a.mode())
 	}
 
 	TemporaryDir = settings.Get("MEDIA.TEMPORARY_DIR").String()
@@ -46,47 +72,86 @@ func (a App) Register() error {
 		LocalUploadDir = "./uploads"
 	}
 
+	CacheDir = settings.Get("MEDIA.CACHE_DIR").String()
+	if CacheDir == "" {
+		CacheDir = "./cache"
+	}
+
 	_ = gpath.MakePath(TemporaryDir)
 	_ = gpath.MakePath(LocalUploadDir)
+	_ = gpath.MakePath(CacheDir)
+
+	var err error
+	Store, err = NewStorage(settings.Get("MEDIA.STORAGE", "local").String())
+	if err != nil {
+		return err
+	}
 
+	RegisterJobHandler(JobProcessMedia, processMediaJob)
 	OnUpload(func(media *Media) error {
 		if media.MediaID == 0 {
 			return nil
 		}
-		var metadata = ExtractMediaMetadata(media)
-		if len(metadata) > 0 {
-			db.Debug().Save(metadata)
-		}
-
-		if media.Type == "video" {
-			err := CreateVideoPreview(media)
-			if err != nil {
-				log.Error(err)
-			}
-			err = GenerateVideoThumbnail(media)
-			if err != nil {
-				log.Error(err)
-			}
-			db.Save(media)
+		profile, err := Profile(media.Profile)
+		if err != nil {
+			return err
 		}
-		return nil
+		return profile.Process(media)
 	})
 
 	return nil
 }
 
 func (a App) Router() error {
+	if a.mode() == ModeWorker {
+		return nil
+	}
 	var controller Controller
 	var admin = evo.Group("/admin/media")
 	admin.Post("/upload", controller.BasicUploadHandler)
+	admin.Post("/import", controller.ImportHandler)
+	admin.Post("/zip", controller.ZipUploadHandler)
 	admin.Post("/multipart/upload/*", controller.MultipartUploadHandler)
 	admin.Delete("/multipart/upload/*", controller.MultipartCleanUploadHandler)
 	admin.Put("/multipart/upload/*", controller.MultipartUploadChunkHandler)
+	admin.Get("/multipart/upload/*", controller.MultipartListHandler)
+	admin.Options("/tus/", controller.TusOptionsHandler)
+	admin.Options("/tus/:id", controller.TusOptionsHandler)
+	admin.Post("/tus/", controller.TusCreateHandler)
+	admin.Head("/tus/:id", controller.TusHeadHandler)
+	admin.Patch("/tus/:id", controller.TusPatchHandler)
+	admin.Delete("/tus/:id", controller.TusDeleteHandler)
+	admin.Delete("/:id/purge", controller.PurgeHandler)
+	admin.Post("/:id/cancel", controller.CancelHandler)
+	admin.Get("/:id/signed-url", controller.SignedURLHandler)
+	admin.Post("/:id/revoke", controller.RevokeSignaturesHandler)
+	admin.Get("/:id/events", controller.EventsHandler)
+	admin.Get("/metrics", controller.MetricsHandler)
+	evo.Get("/media/:id/transform", controller.TransformHandler)
+	evo.Get("/media/:id/hls/*", controller.HLSHandler)
+	evo.Get("/media/:id/dash/*", controller.DASHHandler)
+	evo.Get("/media/:id/:variant?", controller.DeliveryHandler)
+	evo.Head("/media/:id/:variant?", controller.DeliveryHandler)
 	evo.Static("/upload", "./media/static")
 	return nil
 }
 
 func (a App) WhenReady() error {
+	if settings.Get("MEDIA.HANDLE_SIGNALS", true).Bool() {
+		shutdownOnSignal()
+	}
+	if a.mode() != ModeAPI {
+		StartWorkers(settings.Get("MEDIA.WORKERS", 2).Int())
+	}
+	if a.mode() == ModeWorker {
+		return nil
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			SweepTusUploads()
+			SweepUploadSessions()
+		}
+	}()
 	return nil
 }
 
@@ -0,0 +1,351 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/generic"
+	"github.com/tidwall/gjson"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidDataURL    = errors.New("data URL is not base64 encoded")
+	ErrInvalidJSONUpload = errors.New("invalid JSON upload body")
+)
+
+// maxJSONField caps every field of a JSON upload except content, which is decoded to disk.
+const maxJSONField = 64 * 1024
+
+// DecodedFile is a base64 payload decoded into a temporary file.
+type DecodedFile struct {
+	File     string // path of the temporary file
+	Checksum string // SHA-256 of the decoded content
+	Size     int64
+	MIMEType string // type declared by the data URL, if any
+}
+
+// DecodeBase64 streams base64 content, optionally given as a data URL, into a temporary file without
+// holding the decoded payload in memory. Decoding stops as soon as the output exceeds maxSize; 0 disables the limit.
+func DecodeBase64(content string, maxSize int64) (*DecodedFile, error) {
+	return decodeBase64(strings.NewReader(content), maxSize)
+}
+
+func decodeBase64(content io.Reader, maxSize int64) (*DecodedFile, error) {
+	var decoded DecodedFile
+	var r = bufio.NewReaderSize(content, 512)
+	// a data URL header or "base64," marker has to start within the first bytes
+	head, err := r.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		// Peek hands the error over only once
+		return nil, err
+	}
+	if idx := bytes.IndexByte(head, ','); idx != -1 && bytes.HasPrefix(head, []byte("data:")) {
+		params := strings.Split(string(head[5:idx]), ";")
+		if params[len(params)-1] != "base64" {
+			return nil, ErrInvalidDataURL
+		}
+		decoded.MIMEType = strings.ToLower(params[0])
+		_, _ = r.Discard(idx + 1)
+	} else if idx := bytes.Index(head, []byte("base64,")); idx != -1 {
+		_, _ = r.Discard(idx + 7)
+	}
+
+	var reader = base64.NewDecoder(base64.StdEncoding, r)
+	if maxSize > 0 {
+		reader = io.LimitReader(reader, maxSize+1)
+	}
+	file, checksum, size, err := SaveTemp(reader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 content: %w", err)
+	}
+	if maxSize > 0 && size > maxSize {
+		_ = os.Remove(file)
+		return nil, PolicyViolation{Rule: "max_size", Message: fmt.Sprintf("file exceeds the maximum size of %d bytes", maxSize), Limit: maxSize}
+	}
+	decoded.File, decoded.Checksum, decoded.Size = file, checksum, size
+	return &decoded, nil
+}
+
+// JSONUpload is a JSON upload body whose content field was decoded while the body was read.
+type JSONUpload struct {
+	Fields  map[string]json.RawMessage // every field except content
+	Content *DecodedFile               // nil if the body has no content
+}
+
+// Value returns a field the way evo.Request.BodyValue does.
+func (u *JSONUpload) Value(key string) generic.Value {
+	return generic.Parse(gjson.ParseBytes(u.Fields[key]).String())
+}
+
+// Remove deletes the decoded content.
+func (u *JSONUpload) Remove() {
+	if u.Content != nil {
+		_ = os.Remove(u.Content.File)
+	}
+}
+
+// DecodeJSONUpload walks a JSON object and decodes its content field straight from body into a temporary
+// file, so the base64 payload is never held as a string. maxSize is called with the fields read so far
+// when content is reached; fields that follow content cannot lower or raise the limit applied while decoding.
+//
+// The walk only avoids copies of the body: unless request body streaming is enabled on the server,
+// fasthttp has already buffered the body, bounded by HTTP.BodyLimit, before the handler runs.
+func DecodeJSONUpload(body io.Reader, maxSize func(fields map[string]json.RawMessage) (int64, error)) (*JSONUpload, error) {
+	var upload = JSONUpload{Fields: map[string]json.RawMessage{}}
+	var err = upload.decode(bufio.NewReader(body), maxSize)
+	if err != nil {
+		upload.Remove()
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (u *JSONUpload) decode(r *bufio.Reader, maxSize func(fields map[string]json.RawMessage) (int64, error)) error {
+	if c, err := nextJSONByte(r); err != nil || c != '{' {
+		return ErrInvalidJSONUpload
+	}
+	c, err := nextJSONByte(r)
+	if err != nil {
+		return ErrInvalidJSONUpload
+	}
+	if c == '}' {
+		return nil
+	}
+	for {
+		var raw bytes.Buffer
+		if c != '"' || copyJSONValue(r, c, &raw) != nil {
+			return ErrInvalidJSONUpload
+		}
+		var key string
+		if json.Unmarshal(raw.Bytes(), &key) != nil {
+			return ErrInvalidJSONUpload
+		}
+		if c, err = nextJSONByte(r); err != nil || c != ':' {
+			return ErrInvalidJSONUpload
+		}
+		if c, err = nextJSONByte(r); err != nil {
+			return ErrInvalidJSONUpload
+		}
+
+		if key == "content" && c == '"' {
+			if u.Content != nil {
+				return ErrInvalidJSONUpload
+			}
+			limit, err := maxSize(u.Fields)
+			if err != nil {
+				return err
+			}
+			var content = jsonString{r: r}
+			decoded, err := decodeBase64(&content, limit)
+			if err != nil {
+				return err
+			}
+			if !content.closed {
+				_ = os.Remove(decoded.File)
+				return ErrInvalidJSONUpload
+			}
+			if content.read == 0 {
+				_ = os.Remove(decoded.File)
+			} else {
+				u.Content = decoded
+			}
+		} else {
+			raw.Reset()
+			if copyJSONValue(r, c, &raw) != nil || !json.Valid(raw.Bytes()) {
+				return ErrInvalidJSONUpload
+			}
+			u.Fields[key] = raw.Bytes()
+		}
+
+		if c, err = nextJSONByte(r); err != nil {
+			return ErrInvalidJSONUpload
+		}
+		if c == '}' {
+			return nil
+		}
+		if c != ',' {
+			return ErrInvalidJSONUpload
+		}
+		if c, err = nextJSONByte(r); err != nil {
+			return ErrInvalidJSONUpload
+		}
+	}
+}
+
+// nextJSONByte returns the next byte that is not JSON whitespace.
+func nextJSONByte(r *bufio.Reader) (byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil || (c != ' ' && c != '\t' && c != '\n' && c != '\r') {
+			return c, err
+		}
+	}
+}
+
+// copyJSONValue copies the raw JSON value starting with c to w, up to maxJSONField bytes.
+func copyJSONValue(r *bufio.Reader, c byte, w *bytes.Buffer) error {
+	w.WriteByte(c)
+	var depth int
+	switch c {
+	case '"':
+		return copyJSONString(r, w)
+	case '{', '[':
+		depth = 1
+	default:
+		for {
+			c, err := r.ReadByte()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if strings.IndexByte(",}] \t\n\r", c) != -1 {
+				return r.UnreadByte()
+			}
+			if w.WriteByte(c); w.Len() > maxJSONField {
+				return ErrInvalidJSONUpload
+			}
+		}
+	}
+	for depth > 0 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if w.WriteByte(c); w.Len() > maxJSONField {
+			return ErrInvalidJSONUpload
+		}
+		switch c {
+		case '"':
+			if err = copyJSONString(r, w); err != nil {
+				return err
+			}
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+		}
+	}
+	return nil
+}
+
+// copyJSONString copies the rest of a raw JSON string, whose opening quote was already written, to w.
+func copyJSONString(r *bufio.Reader, w *bytes.Buffer) error {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if w.WriteByte(c); w.Len() > maxJSONField {
+			return ErrInvalidJSONUpload
+		}
+		if c == '"' {
+			return nil
+		}
+		if c == '\\' {
+			if c, err = r.ReadByte(); err != nil {
+				return err
+			}
+			w.WriteByte(c)
+		}
+	}
+}
+
+// jsonString reads the unescaped bytes of a JSON string whose opening quote was consumed, up to its closing quote.
+type jsonString struct {
+	r       *bufio.Reader
+	pending []byte // rest of a multi-byte \u escape
+	read    int64
+	closed  bool
+}
+
+func (s *jsonString) Read(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		if len(s.pending) > 0 {
+			c := copy(p[n:], s.pending)
+			s.pending, n = s.pending[c:], n+c
+			continue
+		}
+		if s.closed {
+			break
+		}
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return n, ErrInvalidJSONUpload
+		}
+		switch c {
+		case '"':
+			s.closed = true
+			continue
+		case '\\':
+			if c, err = s.unescape(); err != nil {
+				return n, err
+			}
+		}
+		p[n] = c
+		n++
+		s.read++
+	}
+	if n == 0 && s.closed {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (s *jsonString) unescape() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return 0, ErrInvalidJSONUpload
+	}
+	switch c {
+	case '"', '\\', '/':
+		return c, nil
+	case 'b':
+		return '\b', nil
+	case 'f':
+		return '\f', nil
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case 'u':
+		var hex [4]byte
+		if _, err = io.ReadFull(s.r, hex[:]); err != nil {
+			return 0, ErrInvalidJSONUpload
+		}
+		code, err := strconv.ParseUint(string(hex[:]), 16, 16)
+		if err != nil {
+			return 0, ErrInvalidJSONUpload
+		}
+		if code < utf8.RuneSelf {
+			return byte(code), nil
+		}
+		// anything beyond ASCII is not base64; it is passed on so the decoder reports it
+		var buf = utf8.AppendRune(nil, rune(code))
+		s.pending = buf[1:]
+		return buf[0], nil
+	}
+	return 0, ErrInvalidJSONUpload
+}
+
+// requestBody reads the body from the connection when the server streams request bodies, and from the
+// buffered body otherwise.
+func requestBody(request *evo.Request) io.Reader {
+	if stream := request.Context.Context().RequestBodyStream(); stream != nil {
+		return stream
+	}
+	return bytes.NewReader(request.Context.Body())
+}
@@ -0,0 +1,147 @@
+package media
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/db"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// escapedBase64 encodes content the way some JSON encoders do, with \/ and \u escapes.
+func escapedBase64(content []byte) string {
+	var s = base64.StdEncoding.EncodeToString(content)
+	return strings.NewReplacer("/", `\/`, "+", `\u002b`).Replace(s)
+}
+
+func TestDecodeJSONUpload(t *testing.T) {
+	setupTest(t)
+	var content = bytes.Repeat(testPNG(t), 50)
+	var body = `{"title": "a \"quoted\" title", "nested": {"a": [1, "}]"]}, "size": 12,` +
+		` "content": "data:image\/PNG;base64,` + escapedBase64(content) + `", "base64": true}`
+
+	var seen []string
+	upload, err := DecodeJSONUpload(strings.NewReader(body), func(fields map[string]json.RawMessage) (int64, error) {
+		for key := range fields {
+			seen = append(seen, key)
+		}
+		return int64(len(content)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upload.Remove()
+	if len(seen) != 3 || slices.Contains(seen, "base64") {
+		t.Fatalf("the limit should only see the fields before content, got %v", seen)
+	}
+	if upload.Value("title").String() != `a "quoted" title` || upload.Value("size").Int() != 12 || !upload.Value("base64").Bool() {
+		t.Fatalf("unexpected fields %v", upload.Fields)
+	}
+	if _, ok := upload.Fields["content"]; ok {
+		t.Fatalf("content should not be kept as a field")
+	}
+	if upload.Content == nil || upload.Content.MIMEType != "image/png" || upload.Content.Size != int64(len(content)) {
+		t.Fatalf("unexpected content %+v", upload.Content)
+	}
+	decoded, err := os.ReadFile(upload.Content.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, content) || upload.Content.Checksum != sha256Hex(content) {
+		t.Fatalf("decoded content differs")
+	}
+	upload.Remove()
+	assertNoTempFiles(t)
+}
+
+func TestDecodeJSONUploadErrors(t *testing.T) {
+	setupTest(t)
+	var noLimit = func(map[string]json.RawMessage) (int64, error) { return 0, nil }
+	for _, body := range []string{
+		``,
+		`[]`,
+		`{"content": "aGVsbG8`,
+		`{"content": "aGVsbG8=" "title": "x"}`,
+		`{"content": "aGVsbG8=", "content": "aGVsbG8="}`,
+		`{"title": "x", "content": "aGVs\q"}`,
+		`{"title": tru, "content": "aGVsbG8="}`,
+		`{"title": "` + strings.Repeat("x", maxJSONField) + `"}`,
+	} {
+		if _, err := DecodeJSONUpload(strings.NewReader(body), noLimit); !errors.Is(err, ErrInvalidJSONUpload) {
+			t.Errorf("%.40s: expected ErrInvalidJSONUpload, got %v", body, err)
+		}
+	}
+	if _, err := DecodeJSONUpload(strings.NewReader(`{"content": "data:text/plain,hello"}`), noLimit); !errors.Is(err, ErrInvalidDataURL) {
+		t.Errorf("expected ErrInvalidDataURL, got %v", err)
+	}
+
+	// decoding stops at the limit instead of writing the whole payload
+	var body = io.MultiReader(strings.NewReader(`{"content": "`), base64Stream(1<<20), strings.NewReader(`"}`))
+	var violation PolicyViolation
+	if _, err := DecodeJSONUpload(body, func(map[string]json.RawMessage) (int64, error) { return 1024, nil }); !errors.As(err, &violation) || violation.Rule != "max_size" {
+		t.Errorf("expected a max_size violation, got %v", err)
+	}
+	assertNoTempFiles(t)
+}
+
+// base64Stream returns n bytes of base64 without building them in memory.
+func base64Stream(n int64) io.Reader {
+	return io.LimitReader(repeatReader('A'), n)
+}
+
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestBasicUploadHandlerJSON(t *testing.T) {
+	setupTest(t)
+	var content = testPNG(t)
+	var collection = Collection{Title: "small", UploadPolicy: &UploadPolicy{MaxSize: 16}}
+	if err := db.Create(&collection).Error; err != nil {
+		t.Fatal(err)
+	}
+	var upload = func(body string) *http.Response {
+		var req = httptest.NewRequest(http.MethodPost, "/admin/media/upload", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return testRequest(t, req)
+	}
+
+	resp := upload(`{"filename": "Dot.png", "base64": true, "content": "` + escapedBase64(content) + `", "title": "dot"}`)
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status %d: %s", resp.StatusCode, b)
+	}
+	var result struct {
+		Data Media `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if media := result.Data; media.Title != "dot" || media.Filename != "dot.png" || media.Mimetype != "image/png" || media.FileSize != int64(len(content)) {
+		t.Fatalf("unexpected media %+v", media)
+	}
+
+	// the collection policy is enforced whether collection_id comes before or after content
+	for _, body := range []string{
+		fmt.Sprintf(`{"collection_id": %d, "filename": "a.png", "base64": true, "content": "%s"}`, collection.CollectionID, escapedBase64(content)),
+		fmt.Sprintf(`{"filename": "a.png", "base64": true, "content": "%s", "collection_id": %d}`, escapedBase64(content), collection.CollectionID),
+	} {
+		if resp = upload(body); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("status %d, expected a policy violation", resp.StatusCode)
+		}
+	}
+	assertNoTempFiles(t)
+}
@@ -0,0 +1,205 @@
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/log"
+	"gorm.io/gorm"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// SaveTemp streams reader into a new file under TemporaryDir and hashes it on the way.
+// It returns the file name, its SHA-256 checksum and its size.
+func SaveTemp(reader io.Reader) (string, string, int64, error) {
+	f, err := os.CreateTemp(TemporaryDir, "upload-*")
+	if err != nil {
+		return "", "", 0, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer f.Close()
+
+	var hash = sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), reader)
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", "", 0, fmt.Errorf("failed to write temp file: %w", err)
+	}
+	return f.Name(), hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// blobPath returns the content addressed location of a blob. Derivatives such as
+// previews and thumbnails are stored next to it.
+func blobPath(checksum, filename string) string {
+	return path.Join(checksum[0:2], checksum[2:4], checksum, "source"+strings.ToLower(path.Ext(filename)))
+}
+
+// StoreBlob moves a local file with the given checksum into the storage and points media at it.
+// If a blob with the same content already exists it is shared and file is discarded.
+func StoreBlob(media *Media, file, checksum string) error {
+	media.Checksum = checksum
+	if p, ok := acquireBlob(checksum); ok {
+		media.Path = p
+		_ = os.Remove(file)
+		return nil
+	}
+
+	var blob = Blob{
+		Checksum: checksum,
+		Path:     blobPath(checksum, media.Filename),
+		FileSize: media.FileSize,
+		RefCount: 1,
+	}
+	if err := StoreFile(blob.Path, file); err != nil {
+		return err
+	}
+	if err := db.Create(&blob).Error; err != nil {
+		// an identical file was committed concurrently, share its blob
+		if p, ok := acquireBlob(checksum); ok {
+			// the file stored above is only the winner's if it has the same extension
+			if p != blob.Path {
+				if err = Store.Delete(blob.Path); err != nil {
+					log.Error(err)
+				}
+			}
+			media.Path = p
+			return nil
+		}
+		return err
+	}
+	media.Path = blob.Path
+	return nil
+}
+
+// StoreDetached moves a local file into the storage for media that is not saved. The file is kept apart from the
+// reference counted blobs, so like media uploaded before content addressing, media owns it.
+func StoreDetached(media *Media, file, checksum string) error {
+	media.Checksum = ""
+	media.Path = path.Join("detached", checksum[0:2], checksum[2:4],
+		fmt.Sprintf("%s-%d%s", checksum, time.Now().UnixNano(), strings.ToLower(path.Ext(media.Filename))))
+	return StoreFile(media.Path, file)
+}
+
+// derivativePath returns where the derivative name made by step is stored for media. The directory is keyed by a
+// hash of step, so media sharing a blob but processed with different parameters do not overwrite each other's
+// derivatives, while media processed alike share them.
+func derivativePath(media *Media, step any, name string) string {
+	params, _ := json.Marshal(step)
+	var sum = sha256.Sum256(append([]byte(fmt.Sprintf("%T:", step)), params...))
+	return path.Join(derivativeRoot(media), hex.EncodeToString(sum[:6]), name)
+}
+
+// derivativeRoot is the directory the derivatives of media are stored below: the blob directory of content
+// addressed media, and one named after the file for media owning their file.
+func derivativeRoot(media *Media) string {
+	if media.Checksum == "" {
+		return strings.TrimSuffix(media.Path, path.Ext(media.Path))
+	}
+	return path.Dir(media.Path)
+}
+
+// derivativeExists reports whether the derivative at p was already made, e.g. for another media sharing the blob.
+func derivativeExists(p string) bool {
+	_, err := Store.Stat(p)
+	return err == nil
+}
+
+// acquireBlob adds a reference to an existing blob and returns its path.
+func acquireBlob(checksum string) (string, bool) {
+	var blob Blob
+	var err = db.Transaction(func(tx *gorm.DB) error {
+		if tx.Exec("UPDATE media_blob SET ref_count = ref_count + 1 WHERE checksum_sha256 = ?", checksum).RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Where("checksum_sha256 = ?", checksum).Take(&blob).Error
+	})
+	return blob.Path, err == nil
+}
+
+// releaseBlob drops the reference media holds on its file. The blob and the derivatives of every profile
+// are deleted from the storage once no other media references them.
+func releaseBlob(media *Media) error {
+	if media.Checksum == "" {
+		// media uploaded before content addressing owns its files
+		for _, p := range []string{media.Path, media.Preview, media.Thumbnail} {
+			if p == "" {
+				continue
+			}
+			if err := Store.Delete(p); err != nil {
+				return err
+			}
+		}
+		for _, manifest := range []string{media.HLS, media.DASH} {
+			if manifest == "" {
+				continue
+			}
+			if err := deletePrefix(path.Dir(manifest)); err != nil {
+				return err
+			}
+		}
+		return deletePrefix(derivativeRoot(media))
+	}
+
+	// the decrement locks the blob until its files are deleted, so a concurrent acquireBlob neither picks up a blob
+	// that is being deleted nor stores a new one at its path before the old files are gone
+	var deleteErr error
+	var err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("UPDATE media_blob SET ref_count = ref_count - 1 WHERE checksum_sha256 = ?", media.Checksum).Error; err != nil {
+			return err
+		}
+		var blob Blob
+		if tx.Where("checksum_sha256 = ? AND ref_count <= 0", media.Checksum).Take(&blob).RowsAffected == 0 {
+			return nil
+		}
+		if err := tx.Delete(&blob).Error; err != nil {
+			return err
+		}
+		// no media references the blob anymore, so it is dropped even if some of its files could not be deleted
+		deleteErr = deletePrefix(path.Dir(blob.Path))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return deleteErr
+}
+
+// deletePrefix deletes every object stored below the directory prefix.
+func deletePrefix(prefix string) error {
+	objects, err := Store.List(prefix + "/")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := Store.Delete(object.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeMedia permanently deletes media with its metadata and collection memberships,
+// and releases its blob. Processing still running for it is cancelled.
+func PurgeMedia(media *Media) error {
+	if err := CancelJobs(media.MediaID); err != nil {
+		return err
+	}
+	if err := db.Where("media_id = ?", media.MediaID).Delete(&MetaData{}).Error; err != nil {
+		return err
+	}
+	if err := db.Where("media_id = ?", media.MediaID).Delete(&CollectionItems{}).Error; err != nil {
+		return err
+	}
+	if err := db.Unscoped().Delete(media).Error; err != nil {
+		return err
+	}
+	if err := purgeTransformCache(media); err != nil {
+		return err
+	}
+	return releaseBlob(media)
+}
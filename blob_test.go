@@ -0,0 +1,194 @@
+package media
+
+import (
+	"github.com/getevo/evo/v2/lib/db"
+	"io"
+	"path"
+	"strings"
+	"testing"
+)
+
+// blobRefs returns the reference count of a blob, or -1 if it does not exist.
+func blobRefs(t *testing.T, checksum string) int64 {
+	t.Helper()
+	var blob Blob
+	if db.Where("checksum_sha256 = ?", checksum).Take(&blob).RowsAffected == 0 {
+		return -1
+	}
+	return blob.RefCount
+}
+
+// storeContent stores content as a new media named filename.
+func storeContent(t *testing.T, filename, content string) *Media {
+	t.Helper()
+	file, checksum, size, err := SaveTemp(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var media = Media{Filename: filename, Title: filename, Type: "document", FileSize: size, Status: READY}
+	if err = StoreBlob(&media, file, checksum); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create(&media).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &media
+}
+
+func assertStored(t *testing.T, p string, stored bool) {
+	t.Helper()
+	if _, err := Store.Stat(p); (err == nil) != stored {
+		t.Fatalf("%s stored: %v, expected %v", p, err == nil, stored)
+	}
+}
+
+func TestBlobRefCount(t *testing.T) {
+	setupTest(t)
+	var a, b = storeContent(t, "a.txt", "shared"), storeContent(t, "b.TXT", "shared")
+	if a.Path != b.Path || a.Checksum != b.Checksum {
+		t.Fatalf("identical content is stored twice: %s and %s", a.Path, b.Path)
+	}
+	if refs := blobRefs(t, a.Checksum); refs != 2 {
+		t.Fatalf("%d references, expected 2", refs)
+	}
+	var other = storeContent(t, "c.txt", "other")
+	if other.Path == a.Path || blobRefs(t, other.Checksum) != 1 {
+		t.Fatalf("different content shares a blob")
+	}
+
+	var derivative = derivativePath(a, ThumbnailStep{Height: 100}, "thumbnail.jpg")
+	if err := Store.Put(derivative, strings.NewReader("thumbnail")); err != nil {
+		t.Fatal(err)
+	}
+	if err := releaseBlob(a); err != nil {
+		t.Fatal(err)
+	}
+	if refs := blobRefs(t, a.Checksum); refs != 1 {
+		t.Fatalf("%d references after a release, expected 1", refs)
+	}
+	assertStored(t, b.Path, true)
+	assertStored(t, derivative, true)
+
+	if err := releaseBlob(b); err != nil {
+		t.Fatal(err)
+	}
+	if refs := blobRefs(t, a.Checksum); refs != -1 {
+		t.Fatalf("the blob was kept with %d references", refs)
+	}
+	assertStored(t, b.Path, false)
+	assertStored(t, derivative, false)
+	assertStored(t, other.Path, true)
+
+	// releasing again does not go below zero or touch other blobs
+	if err := releaseBlob(b); err != nil {
+		t.Fatal(err)
+	}
+	if blobRefs(t, other.Checksum) != 1 {
+		t.Fatalf("another blob was released")
+	}
+
+	// once deleted, the same content is stored afresh
+	var again = storeContent(t, "d.txt", "shared")
+	if blobRefs(t, again.Checksum) != 1 {
+		t.Fatalf("the deleted blob was revived")
+	}
+	assertStored(t, again.Path, true)
+}
+
+// racingStorage commits a blob with the same content under another extension right before the first file is put,
+// as if another upload won the race for the checksum.
+type racingStorage struct {
+	Storage
+	winner *Blob
+}
+
+func (s *racingStorage) Put(p string, reader io.Reader) error {
+	if s.winner != nil {
+		var winner = s.winner
+		s.winner = nil
+		if err := s.Storage.Put(winner.Path, strings.NewReader("racing")); err != nil {
+			return err
+		}
+		if err := db.Create(winner).Error; err != nil {
+			return err
+		}
+	}
+	return s.Storage.Put(p, reader)
+}
+
+func TestStoreBlobLosingTheRace(t *testing.T) {
+	setupTest(t)
+	file, checksum, size, err := SaveTemp(strings.NewReader("racing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var winner = Blob{Checksum: checksum, Path: blobPath(checksum, "clip.mov"), FileSize: size, RefCount: 1}
+	Store = &racingStorage{Storage: Store, winner: &winner}
+
+	var media = Media{Filename: "clip.mp4", FileSize: size}
+	if err = StoreBlob(&media, file, checksum); err != nil {
+		t.Fatal(err)
+	}
+	if media.Path != winner.Path {
+		t.Fatalf("media points at %s instead of the winning blob %s", media.Path, winner.Path)
+	}
+	if refs := blobRefs(t, checksum); refs != 2 {
+		t.Fatalf("%d references, expected 2", refs)
+	}
+	assertStored(t, blobPath(checksum, "clip.mp4"), false)
+	objects, err := Store.List(path.Dir(winner.Path) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Path != winner.Path {
+		t.Fatalf("stored %v, expected only the winning blob", objects)
+	}
+}
+
+func TestPurgeMedia(t *testing.T) {
+	setupTest(t)
+	var a, b = storeContent(t, "a.txt", "shared"), storeContent(t, "b.txt", "shared")
+	var collection = Collection{Title: "c"}
+	if err := db.Create(&collection).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, media := range []*Media{a, b} {
+		if err := AddToCollection(media, collection.CollectionID); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Create(&MetaData{MediaID: media.MediaID, Key: "k", Value: "v"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count = func(model any, mediaID int64) int64 {
+		var n int64
+		db.Model(model).Where("media_id = ?", mediaID).Count(&n)
+		return n
+	}
+	if err := PurgeMedia(a); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(&Media{}, a.MediaID); n != 0 {
+		t.Fatalf("the media row was kept")
+	}
+	if count(&MetaData{}, a.MediaID) != 0 || count(&CollectionItems{}, a.MediaID) != 0 {
+		t.Fatalf("the metadata or collection membership was kept")
+	}
+	// the other media keeps everything, including the shared file
+	if count(&Media{}, b.MediaID) != 1 || count(&MetaData{}, b.MediaID) != 1 || count(&CollectionItems{}, b.MediaID) != 1 {
+		t.Fatalf("the other media lost its rows")
+	}
+	assertStored(t, b.Path, true)
+	if refs := blobRefs(t, b.Checksum); refs != 1 {
+		t.Fatalf("%d references, expected 1", refs)
+	}
+
+	if err := PurgeMedia(b); err != nil {
+		t.Fatal(err)
+	}
+	assertStored(t, b.Path, false)
+	if blobRefs(t, b.Checksum) != -1 {
+		t.Fatalf("the blob outlived its last media")
+	}
+}
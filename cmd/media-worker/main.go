@@ -0,0 +1,33 @@
+// Command media-worker processes the media job queue without serving the media API, so ffmpeg heavy work
+// can run on machines separate from the API nodes. It reads the same settings as the API; MEDIA.WORKERS
+// sets the number of jobs run at once.
+//
+// The worker does not open HTTP.Port unless MEDIA.WORKER_HTTP is true, in which case the evo server is
+// started as usual, e.g. for health checks of other apps registered on it; the media API is never served.
+package main
+
+import (
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/settings"
+	"github.com/getevo/media"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	evo.Setup()
+	evo.Register(media.App{Mode: media.ModeWorker})
+	if settings.Get("MEDIA.WORKER_HTTP").Bool() {
+		evo.Run()
+		return
+	}
+	// registers the apps and starts the workers without the web server; signals are handled here, so the
+	// running jobs are handed back to the queue before the process exits
+	settings.Set("MEDIA.HANDLE_SIGNALS", false)
+	evo.Application.Run()
+	var signals = make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	media.Shutdown()
+}
@@ -1,19 +1,24 @@
 package media
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/getevo/evo/v2"
 	"github.com/getevo/evo/v2/lib/db"
-	"github.com/getevo/evo/v2/lib/gpath"
 	"github.com/getevo/evo/v2/lib/log"
 	"github.com/getevo/evo/v2/lib/outcome"
 	"io"
-	"mime/multipart"
+	"net/url"
 	"os"
-	"path"
-	"path/filepath"
 	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -24,49 +29,113 @@ type UploadInput struct {
 	FileName    string `json:"filename"`
 	IsBase64    bool   `json:"base64"`
 	Content     string `json:"content"`
+	MIMEType    string `json:"mimetype"` // hint for base64 content whose type cannot be detected
 }
 
 func (c Controller) BasicUploadHandler(request *evo.Request) any {
-	var file *multipart.FileHeader
 	var input UploadInput
-	var err = request.BodyParser(&input)
+	var value = request.BodyValue
+	var content *DecodedFile
+	if strings.HasPrefix(request.ContentType(), evo.MIMEApplicationJSON) {
+		// BodyParser and BodyValue would copy the body, and input.Content would hold the payload once more
+		upload, err := DecodeJSONUpload(requestBody(request), func(fields map[string]json.RawMessage) (int64, error) {
+			policy, err := UploadPolicyFor(request, (&JSONUpload{Fields: fields}).Value("collection_id").Int64())
+			return policy.SizeLimit(""), err
+		})
+		if err != nil {
+			return policyError(err)
+		}
+		defer upload.Remove()
+		fields, _ := json.Marshal(upload.Fields)
+		if err = json.Unmarshal(fields, &input); err != nil {
+			return err
+		}
+		value, content = upload.Value, upload.Content
+	} else if err := request.BodyParser(&input); err != nil {
+		return err
+	}
+
+	var collectionID = value("collection_id").Int64()
+	policy, err := UploadPolicyFor(request, collectionID)
+	if err != nil {
+		return err
+	}
+	profile, err := ProfileFor(value("profile").String(), collectionID)
 	if err != nil {
 		return err
 	}
+
 	var filename = input.FileName
+	var tmp, checksum, mimeHint string
+	var size int64
 	if input.IsBase64 {
-		var content = input.Content
-		if content == "" {
+		if content == nil && input.Content != "" {
+			// form bodies are parsed whole anyway
+			if content, err = DecodeBase64(input.Content, policy.SizeLimit("")); err != nil {
+				return policyError(err)
+			}
+			defer os.Remove(content.File)
+		}
+		if content == nil {
 			return errors.New("invalid base64 content")
 		}
 		if filename == "" {
 			return errors.New("filename is required")
 		}
-		file, err = CreateMultipartFileHeader(content, filename)
+		// collection_id may have followed content, so the limit applied while decoding is checked again
+		if err = policy.CheckSize("", content.Size); err != nil {
+			return policyError(err)
+		}
+		tmp, checksum, size = content.File, content.Checksum, content.Size
+		mimeHint = content.MIMEType
+		if input.MIMEType != "" {
+			mimeHint = input.MIMEType
+		}
 	} else {
-		file, err = request.FormFile("file")
+		file, err := request.FormFile("file")
+		if err != nil {
+			return err
+		}
 		filename = file.Filename
+		if err = policy.CheckSize("", file.Size); err != nil {
+			return policyError(err)
+		}
+		reader, err := file.Open()
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		tmp, checksum, size, err = SaveTemp(reader)
+		reader.Close()
+		if err != nil {
+			log.Error(err)
+			return err
+		}
 	}
-
-	if err != nil {
-		return err
-	}
+	defer os.Remove(tmp)
 	if filename != "" {
 		filename = NormalizeFileName(filename)
 	}
 
-	fileType, err := DetectFileType(file)
+	fileType, err := DetectFileType(tmp)
 	if err != nil {
 		return err
 	}
+	// content sniffing wins; a declared media type is only used for content it cannot identify
+	if fileType.MIMEType == "application/octet-stream" && mediaTypeOf(mimeHint) != "document" {
+		fileType.MIMEType = mimeHint
+		fileType.Type = mediaTypeOf(mimeHint)
+	}
 
 	var media = Media{
-		Title:       request.BodyValue("title").String(),
+		Title:       value("title").String(),
 		Filename:    filename,
-		Description: request.BodyValue("description").String(),
-		FileSize:    file.Size,
+		Description: value("description").String(),
+		FileSize:    size,
 		Type:        fileType.Type,
 		Mimetype:    fileType.MIMEType,
+		Profile:     profile,
+		Private:     value("private").Bool(),
 	}
 
 	if media.Title == "" {
@@ -77,162 +146,170 @@ func (c Controller) BasicUploadHandler(request *evo.Request) any {
 		return errors.New("media type is missing")
 	}
 
-	media.Status = READY
-	media.Path = fmt.Sprint(time.Now().Unix())
-	var destination = path.Join(LocalUploadDir, media.Path)
-	err = gpath.MakePath(destination)
-
-	if err != nil {
+	media.Status = PROCESSING
+	if err = ProbeMedia(&media, tmp); err != nil {
 		log.Error(err)
 		return err
 	}
-	if err = request.SaveFile(file, path.Join(destination, media.Filename)); err != nil {
-		log.Error(err)
-		return err
+	if err = policy.Check(&media); err != nil {
+		return policyError(err)
 	}
 
-	switch fileType.Type {
-	case "video":
-		var info, err = GetVideoInfo(path.Join(destination, media.Filename))
-		if err != nil {
+	if value("skip_save").Bool() {
+		// without a row nothing could ever release a blob reference, and there is nothing for a worker to pick up
+		if err = StoreDetached(&media, tmp, checksum); err != nil {
 			log.Error(err)
 			return err
 		}
-		media.Duration = int64(info.Duration)
-		media.ScreenSize = fmt.Sprintf("%dx%d", info.Width, info.Height)
-		media.AspectRatio = info.AspectRatio
-	case "image":
-		var info, err = GetImageInfo(path.Join(destination, media.Filename))
-		if err != nil {
-			log.Error(err)
-			return err
-		}
-		media.ScreenSize = fmt.Sprintf("%dx%d", info.Width, info.Height)
-		media.AspectRatio = info.AspectRatio
-	case "audio":
-		var duration, err = GetAudioDuration(path.Join(destination, media.Filename))
-		if err != nil {
-			log.Error(err)
-			return err
+		media.Status = READY
+		for _, callback := range mediaUploadedCallbacks {
+			err = callback(&media)
+			if err != nil {
+				return err
+			}
 		}
-		media.Duration = int64(duration)
+		return media
 	}
 
-	media.Path += "/" + media.Filename
-	media.FileSize = file.Size
-
-	if !request.BodyValue("skip_save").Bool() {
-		if err = db.Save(&media).Error; err != nil {
-			return err
-		}
+	if err = StoreBlob(&media, tmp, checksum); err != nil {
+		log.Error(err)
+		return err
 	}
-	for _, callback := range mediaUploadedCallbacks {
-		err = callback(&media)
-		if err != nil {
+	if err = db.Save(&media).Error; err != nil {
+		return err
+	}
+	if collectionID > 0 {
+		if err = AddToCollection(&media, collectionID); err != nil {
 			return err
 		}
 	}
+	if err = enqueueProcessMedia(&media, policy); err != nil {
+		return err
+	}
 
 	return media
 }
 
 func (c Controller) MultipartUploadHandler(request *evo.Request) any {
-
-	var key = request.Param("*").String()
-	key = NormalizeFileName(key)
 	var uploadID = request.Query("uploadId").String()
+	owner, err := authenticateMultipart(request)
+	if err != nil {
+		return s3ErrorResponse(403, err)
+	}
+	key, err := multipartKey(request)
+	if err != nil {
+		return s3ErrorResponse(400, err)
+	}
 
 	// Upload completed
 	if uploadID != "" {
+		var session = loadUploadSession(uploadID, key, owner)
+		if session == nil {
+			return s3ErrorResponse(404, ErrNoSuchUpload)
+		}
 		var data CompleteMultipartUpload
-		err := request.BodyParser(&data)
+		err = request.BodyParser(&data)
 		if err != nil {
 			return err
 		}
-
-		// upload to S3
-		var media Media
-		if db.Where("external_id =?", uploadID).Find(&media).RowsAffected == 0 {
-			return errors.New("invalid upload ID")
-		}
-
-		err, file := c.AssembleUpload(key, uploadID, data)
+		policy, err := UploadPolicyFor(request, session.CollectionID)
 		if err != nil {
-			return err
+			return s3ErrorResponse(400, err)
+		}
+		if err = policy.CheckParts(len(data.Parts)); err != nil {
+			return policyError(err)
 		}
 
-		fileType, err := DetectFileType(file)
+		err, upload := c.AssembleUpload(session, data)
 		if err != nil {
-			return err
+			return s3ErrorResponse(400, err)
 		}
-		media.Mimetype = fileType.MIMEType
-		media.Type = fileType.Type
-		media.Status = PROCESSING
-		media.Path = filepath.Join(uploadID, key)
-		media.FileSize = fileType.FileSize
-		switch fileType.Type {
-		case "video":
-			var info, err = GetVideoInfo(file)
-			if err != nil {
-				log.Error(err)
-				return err
+		defer os.Remove(upload.File)
+
+		// the session and its parts are kept until the upload is ingested, so a rejected completion can be retried
+		if session.Extract {
+			var collection = Collection{
+				CollectionID: session.CollectionID,
+				Title:        session.Title,
 			}
-			media.Duration = int64(info.Duration)
-			media.ScreenSize = fmt.Sprintf("%dx%d", info.Width, info.Height)
-			media.AspectRatio = info.AspectRatio
-		case "image":
-			var info, err = GetImageInfo(file)
-			if err != nil {
-				log.Error(err)
-				return err
+			if collection.Title == "" {
+				collection.Title = strings.TrimSuffix(session.Key, ".zip")
 			}
-			media.ScreenSize = fmt.Sprintf("%dx%d", info.Width, info.Height)
-			media.AspectRatio = info.AspectRatio
-		case "audio":
-			var duration, err = GetAudioDuration(file)
+			result, err := ImportZip(upload.File, &collection, policy, session.Profile, session.Private, DefaultZipLimits())
 			if err != nil {
+				return s3ErrorResponse(400, S3Error{Code: "InvalidArgument", Message: err.Error()})
+			}
+			if err = session.Delete(); err != nil {
 				log.Error(err)
-				return err
 			}
-			media.Duration = int64(duration)
+			return result
 		}
 
-		err = MoveFile(file, filepath.Join(LocalUploadDir, media.Path))
-		if err != nil {
-			return err
+		var media = Media{
+			Filename:    session.Key,
+			Title:       session.Title,
+			Description: session.Description,
+			UploadedBy:  session.Owner,
+			Profile:     session.Profile,
+			Private:     session.Private,
 		}
-		media.Status = READY
-		db.Save(&media)
-		for _, callback := range mediaUploadedCallbacks {
-			err = callback(&media)
-			if err != nil {
+		if err = IngestFile(&media, upload.File, upload.Checksum, policy); err != nil {
+			log.Error(err)
+			return policyError(err)
+		}
+		if err = session.Delete(); err != nil {
+			log.Error(err)
+		}
+		if session.CollectionID > 0 {
+			if err = AddToCollection(&media, session.CollectionID); err != nil {
 				return err
 			}
 		}
+		var result = CompleteMultipartUploadResult{
+			Location: request.Path(),
+			Bucket:   "upload",
+			Key:      key,
+			ETag:     `"` + upload.ETag + `"`,
+		}
 		return outcome.Response{
 			StatusCode: 200,
+			Data:       result.String(),
+			Headers: map[string]string{
+				"Content-Type": "text/xml",
+				"ETag":         result.ETag,
+				"X-Media-ID":   strconv.FormatInt(media.MediaID, 10),
+			},
 		}
 	}
 
-	uploadID = fmt.Sprint(time.Now().UnixNano())
-	var media = Media{
-		Filename:    key,
+	var session = UploadSession{
+		Key:         key,
+		Owner:       owner,
 		Title:       request.Header("X-File-Title"),
 		Description: request.Header("X-File-Description"),
-		Type:        request.Header("X-File-Type"),
-		Path:        uploadID + "/" + key,
-		Status:      UPLOADING,
-		ExternalID:  uploadID,
 	}
-	if err := db.Save(&media).Error; err != nil {
+	session.ExpectedSize, _ = strconv.ParseInt(request.Header("X-File-FileSize"), 10, 64)
+	session.CollectionID, _ = strconv.ParseInt(request.Header("X-File-Collection"), 10, 64)
+	session.Extract = strings.EqualFold(request.Header("X-File-Extract"), "zip")
+	session.Private, _ = strconv.ParseBool(request.Header("X-File-Private"))
+	policy, err := UploadPolicyFor(request, session.CollectionID)
+	if err != nil {
+		return s3ErrorResponse(400, err)
+	}
+	if session.Profile, err = ProfileFor(request.Header("X-File-Profile"), session.CollectionID); err != nil {
+		return s3ErrorResponse(400, S3Error{Code: "InvalidArgument", Message: err.Error()})
+	}
+	if err = policy.CheckSize("", session.ExpectedSize); err != nil {
+		return policyError(err)
+	}
+	if err = session.Create(); err != nil {
 		return err
 	}
 	var upload = InitiateMultipartUploadResult{
 		Bucket:   "upload",
 		Key:      key,
-		UploadID: uploadID,
+		UploadID: session.UploadID,
 	}
-	_ = gpath.MakePath(filepath.Join(TemporaryDir, upload.Key, uploadID))
 
 	return outcome.Response{
 		StatusCode: 200,
@@ -244,66 +321,405 @@ func (c Controller) MultipartUploadHandler(request *evo.Request) any {
 
 }
 
+// MultipartCleanUploadHandler aborts the upload given by uploadId, or every upload of the key if none is given.
 func (c Controller) MultipartCleanUploadHandler(request *evo.Request) any {
-	var key = request.Param("*").String()
-	key = NormalizeFileName(key)
-	_ = gpath.Remove(filepath.Join(TemporaryDir, key))
+	owner, err := authenticateMultipart(request)
+	if err != nil {
+		return s3ErrorResponse(403, err)
+	}
+	key, err := multipartKey(request)
+	if err != nil {
+		return s3ErrorResponse(400, err)
+	}
+
+	var sessions []UploadSession
+	if uploadID := request.Query("uploadId").String(); uploadID != "" {
+		var session = loadUploadSession(uploadID, key, owner)
+		if session == nil {
+			return s3ErrorResponse(404, ErrNoSuchUpload)
+		}
+		sessions = append(sessions, *session)
+	} else if err = db.Where("object_key = ? AND owner = ?", key, owner).Find(&sessions).Error; err != nil {
+		return err
+	}
+	for i := range sessions {
+		if err := sessions[i].Delete(); err != nil {
+			return err
+		}
+	}
+	return outcome.Response{
+		StatusCode: 204,
+	}
+}
+
+func (c Controller) PurgeHandler(request *evo.Request) any {
+	var media Media
+	if db.Unscoped().Where("media_id = ?", request.Param("id").Int64()).Take(&media).RowsAffected == 0 {
+		return errors.New("media not found")
+	}
+	if err := PurgeMedia(&media); err != nil {
+		return err
+	}
+	return outcome.Response{
+		StatusCode: 204,
+	}
+}
+
+// CancelHandler stops processing the media and marks it failed. Tools already running for it are killed, right
+// away on this node and at the next heartbeat of the job, up to MEDIA.JOB_LEASE/3 later, on other workers.
+func (c Controller) CancelHandler(request *evo.Request) any {
+	var media Media
+	if db.Where("media_id = ? AND deleted = 0", request.Param("id").Int64()).Take(&media).RowsAffected == 0 {
+		return errors.New("media not found")
+	}
+	if media.Status != PROCESSING {
+		return errors.New("media is not being processed")
+	}
+	if err := CancelJobs(media.MediaID); err != nil {
+		return err
+	}
+	if err := db.Model(&Media{}).Where("media_id = ?", media.MediaID).Updates(map[string]any{"status": FAILED, "error": ErrJobCanceled.Error()}).Error; err != nil {
+		return err
+	}
 	return outcome.Response{
 		StatusCode: 204,
 	}
 }
 
-var counter = 0
+func (c Controller) SignedURLHandler(request *evo.Request) any {
+	var media Media
+	if db.Where("media_id = ?", request.Param("id").Int64()).Take(&media).RowsAffected == 0 {
+		return errors.New("media not found")
+	}
+	var ttl = time.Hour
+	if request.Query("ttl").String() != "" {
+		var err error
+		if ttl, err = request.Query("ttl").Duration(); err != nil {
+			return err
+		}
+	}
+
+	var url string
+	var err error
+	if request.Query("ip").String() != "" {
+		url, err = media.SignedURLForIP(request.Query("variant").String(), ttl, request.Query("ip").String())
+	} else {
+		url, err = media.SignedURL(request.Query("variant").String(), ttl)
+	}
+	if err != nil {
+		return err
+	}
+	return url
+}
+
+func (c Controller) RevokeSignaturesHandler(request *evo.Request) any {
+	var media Media
+	if db.Where("media_id = ?", request.Param("id").Int64()).Take(&media).RowsAffected == 0 {
+		return errors.New("media not found")
+	}
+	if err := media.RevokeSignatures(); err != nil {
+		return err
+	}
+	return outcome.Response{
+		StatusCode: 204,
+	}
+}
+
+var (
+	ErrBadDigest         = S3Error{Code: "BadDigest", Message: "The Content-MD5 you specified did not match what was received."}
+	ErrEntityTooLarge    = S3Error{Code: "EntityTooLarge", Message: "Your proposed upload exceeds the expected size."}
+	ErrIncompleteBody    = S3Error{Code: "IncompleteBody", Message: "The assembled object is smaller than the expected size."}
+	ErrInvalidDigest     = S3Error{Code: "InvalidDigest", Message: "The Content-MD5 you specified is not valid."}
+	ErrInvalidPart       = S3Error{Code: "InvalidPart", Message: "One or more of the specified parts could not be found or the ETag did not match."}
+	ErrInvalidKey        = S3Error{Code: "InvalidArgument", Message: "The specified key is not valid."}
+	ErrInvalidPartNumber = S3Error{Code: "InvalidArgument", Message: "Part number must be an integer between 1 and 10000, inclusive."}
+	ErrInvalidPartOrder  = S3Error{Code: "InvalidPartOrder", Message: "The list of parts was not in ascending order."}
+	ErrMalformedXML      = S3Error{Code: "MalformedXML", Message: "The list of parts is empty."}
+	ErrNoSuchUpload      = S3Error{Code: "NoSuchUpload", Message: "The specified upload does not exist."}
+)
+
+// AssembledUpload is the result of assembling the parts of a multipart upload.
+type AssembledUpload struct {
+	File     string // path of the assembled file
+	Checksum string // SHA-256 of the file
+	ETag     string // S3 composite ETag: MD5 of the part MD5s followed by the number of parts
+}
 
 func (c Controller) MultipartUploadChunkHandler(request *evo.Request) any {
-	var key = request.Param("*").String()
-	key = NormalizeFileName(key)
 	var uploadID = request.Query("uploadId").String()
-	var partNumber = request.Query("partNumber").Int()
+	owner, err := authenticateMultipart(request)
+	if err != nil {
+		return s3ErrorResponse(403, err)
+	}
+	key, err := multipartKey(request)
+	if err != nil {
+		return s3ErrorResponse(400, err)
+	}
+	partNumber, err := strconv.Atoi(request.Query("partNumber").String())
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		return s3ErrorResponse(400, ErrInvalidPartNumber)
+	}
 
-	var p = filepath.Join(TemporaryDir, key, uploadID, fmt.Sprintf("%d", partNumber))
-	err := gpath.Write(p, request.Context.Body())
+	var session = loadUploadSession(uploadID, key, owner)
+	if session == nil {
+		return s3ErrorResponse(404, ErrNoSuchUpload)
+	}
+	policy, err := UploadPolicyFor(request, session.CollectionID)
 	if err != nil {
-		return err
+		return s3ErrorResponse(400, err)
+	}
+	if err = policy.CheckParts(partNumber); err != nil {
+		return policyError(err)
+	}
+
+	var body = request.Context.Body()
+	var sum = md5.Sum(body)
+	if header := request.Header("Content-MD5"); header != "" {
+		expected, err := base64.StdEncoding.DecodeString(header)
+		if err != nil || len(expected) != md5.Size {
+			return s3ErrorResponse(400, ErrInvalidDigest)
+		}
+		if !bytes.Equal(expected, sum[:]) {
+			return s3ErrorResponse(400, ErrBadDigest)
+		}
+	}
+	var received = session.receivedSize(partNumber) + int64(len(body))
+	if session.ExpectedSize > 0 && received > session.ExpectedSize {
+		return s3ErrorResponse(400, ErrEntityTooLarge)
+	}
+	if err = policy.CheckSize("", received); err != nil {
+		return policyError(err)
+	}
+
+	part, err := session.SavePart(partNumber, body, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return s3ErrorResponse(400, err)
 	}
-	counter++
 	return outcome.Response{
 		StatusCode: 200,
 		Data:       "",
 		Headers: map[string]string{
-			"Etag": fmt.Sprintf("%d%d", time.Now().UnixNano(), counter),
+			"ETag": `"` + part.ETag + `"`,
 		},
 	}
 }
 
-func (c Controller) AssembleUpload(key string, uploadID string, data CompleteMultipartUpload) (error, string) {
-	var p = filepath.Join(TemporaryDir, key, uploadID)
-	_ = gpath.MakePath(filepath.Join(TemporaryDir, "assembled"))
-	var filePath = filepath.Join(TemporaryDir, "assembled", key)
-	out, err := os.Create(filePath)
+// AssembleUpload checks the parts listed in data against the received ones and concatenates them into a single file.
+// Parts must be listed in ascending order with the ETags returned when they were uploaded; unlisted parts are discarded.
+func (c Controller) AssembleUpload(session *UploadSession, data CompleteMultipartUpload) (error, *AssembledUpload) {
+	if len(data.Parts) == 0 {
+		return ErrMalformedXML, nil
+	}
+	received, err := session.ReceivedParts()
 	if err != nil {
-		return err, filePath
+		return err, nil
+	}
+	var stored = map[int]UploadPart{}
+	for _, part := range received {
+		stored[part.PartNumber] = part
 	}
-	defer out.Close()
 
-	for i := 1; i <= len(data.Parts); i++ {
-		partPath := p + "/" + fmt.Sprintf("%d", i)
-		in, err := os.Open(partPath)
+	var composite = md5.New()
+	var size int64
+	for i, part := range data.Parts {
+		if i > 0 && part.PartNumber <= data.Parts[i-1].PartNumber {
+			return ErrInvalidPartOrder, nil
+		}
+		s, ok := stored[part.PartNumber]
+		if !ok || strings.Trim(part.ETag, `"`) != s.ETag {
+			return ErrInvalidPart, nil
+		}
+		sum, err := hex.DecodeString(s.ETag)
 		if err != nil {
-			return err, filePath
+			return ErrInvalidPart, nil
 		}
-		defer in.Close()
+		composite.Write(sum)
+		size += s.Size
+	}
+	if session.ExpectedSize > 0 && size < session.ExpectedSize {
+		return ErrIncompleteBody, nil
+	}
 
-		_, err = io.Copy(out, in)
+	// the key is client supplied and never becomes part of a path
+	out, err := os.CreateTemp(TemporaryDir, "assembled-*")
+	if err != nil {
+		return err, nil
+	}
+	defer out.Close()
+	var filePath = out.Name()
+	var hash = sha256.New()
+	var writer = io.MultiWriter(out, hash)
+
+	for _, part := range data.Parts {
+		in, err := os.Open(session.partPath(part.PartNumber))
 		if err != nil {
-			return err, filePath
+			_ = os.Remove(filePath)
+			return err, nil
+		}
+		_, err = io.Copy(writer, in)
+		in.Close()
+		if err != nil {
+			_ = os.Remove(filePath)
+			return err, nil
 		}
 	}
 
-	go func() {
-		time.Sleep(1 * time.Second)
-		_ = gpath.Remove(filepath.Dir(p))
-	}()
+	return nil, &AssembledUpload{
+		File:     filePath,
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+		ETag:     fmt.Sprintf("%s-%d", hex.EncodeToString(composite.Sum(nil)), len(data.Parts)),
+	}
+}
 
-	return nil, filePath
+// MultipartListHandler answers ListMultipartUploads (?uploads) and ListParts (?uploadId=) so clients can resume uploads.
+func (c Controller) MultipartListHandler(request *evo.Request) any {
+	owner, err := authenticateMultipart(request)
+	if err != nil {
+		return s3ErrorResponse(403, err)
+	}
+	var query = request.URL().Query
+	if query.Has("uploads") {
+		return c.listMultipartUploads(request, owner)
+	}
+	if request.Query("uploadId").String() != "" {
+		return c.listParts(request, owner)
+	}
+	return s3ErrorResponse(400, S3Error{Code: "InvalidRequest", Message: "Either uploads or uploadId is required."})
+}
+
+func (c Controller) listMultipartUploads(request *evo.Request, owner string) any {
+	var result = ListMultipartUploadsResult{
+		Bucket:         "upload",
+		Prefix:         request.Query("prefix").String(),
+		KeyMarker:      request.Query("key-marker").String(),
+		UploadIDMarker: request.Query("upload-id-marker").String(),
+		MaxUploads:     listLimit(request.Query("max-uploads").Int()),
+	}
+
+	var query = db.Where("owner = ? AND expires_at > ?", owner, time.Now())
+	if result.Prefix != "" {
+		// the escape character is explicit as SQLite has none by default, and not a backslash which MySQL reads as one
+		query = query.Where("object_key LIKE ? ESCAPE '!'", strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(result.Prefix)+"%")
+	}
+	if result.KeyMarker != "" {
+		query = query.Where("object_key > ? OR (object_key = ? AND upload_id > ?)", result.KeyMarker, result.KeyMarker, result.UploadIDMarker)
+	}
+	var sessions []UploadSession
+	if err := query.Order("object_key, upload_id").Limit(result.MaxUploads + 1).Find(&sessions).Error; err != nil {
+		return err
+	}
+	if len(sessions) > result.MaxUploads {
+		sessions = sessions[:result.MaxUploads]
+		result.IsTruncated = true
+	}
+	for _, session := range sessions {
+		result.Uploads = append(result.Uploads, MultipartUpload{
+			Key:       session.Key,
+			UploadID:  session.UploadID,
+			Initiated: session.CreatedAt.CreatedAt.UTC(),
+		})
+	}
+	if result.IsTruncated {
+		result.NextKeyMarker = sessions[len(sessions)-1].Key
+		result.NextUploadIDMarker = sessions[len(sessions)-1].UploadID
+	}
+
+	return outcome.Response{
+		StatusCode: 200,
+		Data:       result.String(),
+		Headers: map[string]string{
+			"Content-Type": "text/xml",
+		},
+	}
+}
+
+func (c Controller) listParts(request *evo.Request, owner string) any {
+	key, err := multipartKey(request)
+	if err != nil {
+		return s3ErrorResponse(400, err)
+	}
+	var result = ListPartsResult{
+		Bucket:           "upload",
+		Key:              key,
+		UploadID:         request.Query("uploadId").String(),
+		PartNumberMarker: request.Query("part-number-marker").Int(),
+		MaxParts:         listLimit(request.Query("max-parts").Int()),
+	}
+	var session = loadUploadSession(result.UploadID, key, owner)
+	if session == nil {
+		return s3ErrorResponse(404, ErrNoSuchUpload)
+	}
+
+	var parts []UploadPart
+	err = db.Where("upload_id = ? AND part_number > ?", session.UploadID, result.PartNumberMarker).
+		Order("part_number").Limit(result.MaxParts + 1).Find(&parts).Error
+	if err != nil {
+		return err
+	}
+	if len(parts) > result.MaxParts {
+		parts = parts[:result.MaxParts]
+		result.IsTruncated = true
+	}
+	for _, part := range parts {
+		result.Parts = append(result.Parts, UploadedPart{
+			PartNumber:   part.PartNumber,
+			LastModified: part.UpdatedAt.UpdatedAt.UTC(),
+			ETag:         `"` + part.ETag + `"`,
+			Size:         part.Size,
+		})
+	}
+	if result.IsTruncated {
+		result.NextPartNumberMarker = parts[len(parts)-1].PartNumber
+	}
+
+	return outcome.Response{
+		StatusCode: 200,
+		Data:       result.String(),
+		Headers: map[string]string{
+			"Content-Type": "text/xml",
+		},
+	}
+}
+
+// multipartKey returns the normalized object key of a multipart request. Keys with . or .. segments are
+// rejected even though the key never becomes part of a path.
+func multipartKey(request *evo.Request) (string, error) {
+	raw, err := url.PathUnescape(request.Param("*").String())
+	if err != nil {
+		return "", ErrInvalidKey
+	}
+	for _, segment := range strings.FieldsFunc(raw, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == "." || segment == ".." {
+			return "", ErrInvalidKey
+		}
+	}
+	var key = NormalizeFileName(raw)
+	if key == "" || key == "." || key == ".." {
+		return "", ErrInvalidKey
+	}
+	return key, nil
+}
+
+// listLimit clamps a max-parts or max-uploads parameter to S3's default and maximum of 1000.
+func listLimit(n int) int {
+	if n <= 0 || n > 1000 {
+		return 1000
+	}
+	return n
+}
+
+// s3ErrorResponse writes err as an S3 XML error document. Errors other than S3Error are reported as InternalError.
+func s3ErrorResponse(status int, err error) outcome.Response {
+	var s3err S3Error
+	if !errors.As(err, &s3err) {
+		status = 500
+		s3err = S3Error{Code: "InternalError", Message: err.Error()}
+	}
+	return outcome.Response{
+		StatusCode: status,
+		Data:       s3err.String(),
+		Headers: map[string]string{
+			"Content-Type": "text/xml",
+		},
+	}
 }
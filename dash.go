@@ -0,0 +1,53 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PackageDASH transcodes the video into the ladder and packages the renditions as
+// MPEG-DASH with fMP4 segments. The manifest path is recorded in media.DASH.
+func PackageDASH(media *Media, ladder []Rendition) error {
+	return PackageStreams(media, StreamingProfile{Ladder: ladder, DASH: true})
+}
+
+// writeDASH packages the encoded renditions into a single MPD manifest in dir.
+// Video renditions share one adaptation set, audio is taken from the first rendition only.
+func writeDASH(ctx context.Context, dir string, renditions []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create dash dir: %w", err)
+	}
+	if err := ffmpegDASH(ctx, renditions, dir); err != nil {
+		return fmt.Errorf("failed to package dash: %w", err)
+	}
+	return nil
+}
+
+func ffmpegDASH(ctx context.Context, renditions []string, dir string) error {
+	var args = []string{"-y"}
+	for _, r := range renditions {
+		args = append(args, "-i", r)
+	}
+	for i := range renditions {
+		args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+	}
+	var adaptationSets = "id=0,streams=v"
+	if hasAudioStream(ctx, renditions[0]) {
+		args = append(args, "-map", "0:a:0")
+		adaptationSets += " id=1,streams=a"
+	}
+	args = append(args,
+		"-c", "copy",
+		"-f", "dash",
+		"-seg_duration", "6",
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		"-adaptation_sets", adaptationSets,
+		filepath.Join(dir, "manifest.mpd"),
+	)
+	return runTool(ctx, OpTranscode, "ffmpeg", args, nil)
+}
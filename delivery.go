@@ -0,0 +1,363 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VariantPath returns the storage path of a variant of the media.
+// An empty variant or "original" refers to the uploaded file itself.
+func (m *Media) VariantPath(variant string) (string, error) {
+	var p string
+	switch variant {
+	case "", "original":
+		p = m.Path
+	case "preview":
+		p = m.Preview
+	case "thumbnail":
+		p = m.Thumbnail
+	case "hls":
+		p = m.HLS
+	case "dash":
+		p = m.DASH
+	default:
+		return "", fmt.Errorf("unknown variant: %s", variant)
+	}
+	if p == "" {
+		return "", ErrObjectNotFound
+	}
+	return p, nil
+}
+
+// DeliveryHandler streams a media file or one of its variants to the client.
+// It honours byte ranges and conditional requests so browsers can seek in videos and cache files.
+func (c Controller) DeliveryHandler(request *evo.Request) any {
+	var media Media
+	if db.Where("media_id = ? AND deleted = 0", request.Param("id").Int64()).Take(&media).RowsAffected == 0 {
+		return httpStatus(http.StatusNotFound)
+	}
+	if media.Status != READY {
+		return httpStatus(http.StatusNotFound)
+	}
+
+	var variant = request.Param("variant").String()
+	if media.Private || request.Query("signature").String() != "" {
+		err := media.VerifySignature(
+			variant,
+			request.Query("expires").Int64(),
+			request.Query("signature").String(),
+			request.Query("bind_ip").Bool(),
+			request.IP(),
+		)
+		if err != nil {
+			return httpStatus(http.StatusForbidden)
+		}
+		request.Context.Set("Cache-Control", "private")
+	}
+
+	p, err := media.VariantPath(variant)
+	if err != nil {
+		return httpStatus(http.StatusNotFound)
+	}
+	if _, ok := streamContentTypes[path.Ext(p)]; ok {
+		// manifests reference their segments relatively, so they must be requested below the stream route
+		var location = request.Path() + "/" + path.Base(p)
+		if query := request.QueryString(); query != "" {
+			location += "?" + query
+		}
+		return outcome.Redirect(location, http.StatusFound)
+	}
+	return serveObject(request, Store, p, mediaContentType(&media, variant, p), mediaETag(&media, variant))
+}
+
+// streamContentTypes are the content types of adaptive streaming manifests and segments.
+var streamContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".mpd":  "application/dash+xml",
+	".m4s":  "video/iso.segment",
+}
+
+// DASHHandler serves the manifest and segments of the DASH variant.
+func (c Controller) DASHHandler(request *evo.Request) any {
+	return serveStream(request, "dash")
+}
+
+// HLSHandler serves the playlists and segments of the HLS variant.
+func (c Controller) HLSHandler(request *evo.Request) any {
+	return serveStream(request, "hls")
+}
+
+// serveStream serves a file of an adaptive streaming variant. The files live next to the variant's manifest.
+// Manifests requested through a signed URL are rewritten so every file they reference carries the signature too.
+func serveStream(request *evo.Request, variant string) any {
+	var media Media
+	if db.Where("media_id = ? AND deleted = 0", request.Param("id").Int64()).Take(&media).RowsAffected == 0 {
+		return httpStatus(http.StatusNotFound)
+	}
+	if media.Status != READY {
+		return httpStatus(http.StatusNotFound)
+	}
+	manifest, err := media.VariantPath(variant)
+	if err != nil {
+		return httpStatus(http.StatusNotFound)
+	}
+
+	var file = strings.TrimPrefix(path.Clean("/"+request.Param("*").String()), "/")
+	if file == "" {
+		file = path.Base(manifest)
+	}
+	var p = path.Join(path.Dir(manifest), file)
+	contentType, ok := streamContentTypes[path.Ext(p)]
+	if !ok {
+		return httpStatus(http.StatusNotFound)
+	}
+
+	if media.Private || request.Query("signature").String() != "" {
+		var query = url.Values{}
+		for _, key := range []string{"expires", "signature", "bind_ip"} {
+			if v := request.Query(key).String(); v != "" {
+				query.Set(key, v)
+			}
+		}
+		err := media.VerifySignature(variant, request.Query("expires").Int64(), query.Get("signature"), query.Has("bind_ip"), request.IP())
+		if err != nil {
+			return httpStatus(http.StatusForbidden)
+		}
+		request.Context.Set("Cache-Control", "private")
+
+		if path.Ext(p) == ".m3u8" || path.Ext(p) == ".mpd" {
+			reader, err := Store.Get(p)
+			if errors.Is(err, ErrObjectNotFound) {
+				return httpStatus(http.StatusNotFound)
+			}
+			if err != nil {
+				log.Error(err)
+				return httpStatus(http.StatusInternalServerError)
+			}
+			defer reader.Close()
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				log.Error(err)
+				return httpStatus(http.StatusInternalServerError)
+			}
+			return outcome.Response{
+				StatusCode:  http.StatusOK,
+				ContentType: contentType,
+				Data:        signManifest(path.Ext(p), data, query.Encode()),
+			}
+		}
+	}
+	return serveObject(request, Store, p, contentType, "")
+}
+
+var (
+	playlistURIAttribute = regexp.MustCompile(`URI="([^"]+)"`)
+	mpdURLAttribute      = regexp.MustCompile(`(initialization|media|sourceURL)="([^"]+)"`)
+)
+
+// signManifest appends query to every URI referenced by an HLS playlist or DASH manifest.
+func signManifest(ext string, data []byte, query string) []byte {
+	if ext == ".mpd" {
+		return mpdURLAttribute.ReplaceAll(data, []byte(`${1}="${2}?`+strings.ReplaceAll(query, "&", "&amp;")+`"`))
+	}
+
+	var lines = strings.Split(string(data), "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			lines[i] = playlistURIAttribute.ReplaceAllString(line, `URI="${1}?`+query+`"`)
+		default:
+			lines[i] = line + "?" + query
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// serveObject writes the object at p of store to the response, answering conditional and range requests.
+// etag may be empty, in which case one is derived from the object's size and modification time.
+func serveObject(request *evo.Request, store Storage, p string, contentType string, etag string) any {
+	info, err := store.Stat(p)
+	if errors.Is(err, ErrObjectNotFound) {
+		return httpStatus(http.StatusNotFound)
+	}
+	if err != nil {
+		log.Error(err)
+		return httpStatus(http.StatusInternalServerError)
+	}
+
+	if etag == "" {
+		etag = info.ETag
+	}
+	if etag == "" {
+		etag = fmt.Sprintf("%x-%x", info.Size, info.ModTime.Unix())
+	}
+	etag = `"` + etag + `"`
+	var modified = info.ModTime.UTC().Truncate(time.Second)
+
+	var ctx = request.Context
+	ctx.Set("Accept-Ranges", "bytes")
+	ctx.Set("ETag", etag)
+	if !modified.IsZero() {
+		ctx.Set("Last-Modified", modified.Format(http.TimeFormat))
+	}
+
+	if notModified(request, etag, modified) {
+		return httpStatus(http.StatusNotModified)
+	}
+
+	var offset, length = int64(0), info.Size
+	var status = http.StatusOK
+	if header := request.Header("Range"); header != "" && rangeApplies(request, etag, modified) {
+		start, end, ok := parseRange(header, info.Size)
+		if !ok {
+			ctx.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			return httpStatus(http.StatusRequestedRangeNotSatisfiable)
+		}
+		offset, length = start, end-start+1
+		status = http.StatusPartialContent
+		ctx.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, info.Size))
+	}
+
+	ctx.Status(status)
+	ctx.Set("Content-Type", contentType)
+	if request.Method() == http.MethodHead {
+		ctx.Response().Header.SetContentLength(int(length))
+		ctx.Response().SkipBody = true
+		return nil
+	}
+
+	reader, err := store.OpenRange(p, offset, length)
+	if err != nil {
+		log.Error(err)
+		return httpStatus(http.StatusInternalServerError)
+	}
+	// fasthttp closes the reader once the body has been sent
+	ctx.Context().SetBodyStream(reader, int(length))
+	return nil
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since.
+func notModified(request *evo.Request, etag string, modified time.Time) bool {
+	if header := request.Header("If-None-Match"); header != "" {
+		return etagMatches(header, etag)
+	}
+	if header := request.Header("If-Modified-Since"); header != "" && !modified.IsZero() {
+		since, err := http.ParseTime(header)
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+// rangeApplies evaluates If-Range; a range is only served if the client still has the current representation.
+func rangeApplies(request *evo.Request, etag string, modified time.Time) bool {
+	var header = request.Header("If-Range")
+	if header == "" {
+		return true
+	}
+	if strings.HasPrefix(header, `"`) {
+		return header == etag
+	}
+	since, err := http.ParseTime(header)
+	return err == nil && !modified.IsZero() && modified.Equal(since)
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange parses a single byte range of a Range header and returns the inclusive bounds.
+// Multiple ranges are not supported and make the whole object be served.
+func parseRange(header string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false
+	}
+	var spec = strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return 0, size - 1, size > 0
+	}
+	from, to, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	var start, end int64
+	var err error
+	if from == "" {
+		// suffix range: the last n bytes
+		n, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size-1
+	} else {
+		start, err = strconv.ParseInt(from, 10, 64)
+		if err != nil || start < 0 {
+			return 0, 0, false
+		}
+		end = size - 1
+		if to != "" {
+			end, err = strconv.ParseInt(to, 10, 64)
+			if err != nil || end < start {
+				return 0, 0, false
+			}
+			if end > size-1 {
+				end = size - 1
+			}
+		}
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// httpStatus returns a plain text response carrying only the status code.
+func httpStatus(code int) outcome.Response {
+	return outcome.Response{
+		StatusCode:  code,
+		ContentType: "text/plain; charset=utf-8",
+		Data:        http.StatusText(code),
+	}
+}
+
+func mediaContentType(media *Media, variant, p string) string {
+	if (variant == "" || variant == "original") && media.Mimetype != "" {
+		return media.Mimetype
+	}
+	if contentType := mime.TypeByExtension(path.Ext(p)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+func mediaETag(media *Media, variant string) string {
+	if (variant == "" || variant == "original") && media.Checksum != "" {
+		return media.Checksum
+	}
+	return ""
+}
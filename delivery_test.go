@@ -0,0 +1,114 @@
+package media
+
+import (
+	"github.com/getevo/evo/v2/lib/db"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDeliveryConditionalRanges(t *testing.T) {
+	setupTest(t)
+	var media = storeContent(t, "digits.txt", "0123456789")
+	info, err := Store.Stat(media.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var etag = `"` + media.Checksum + `"`
+	var modified = info.ModTime.UTC().Truncate(time.Second)
+	var date = func(d time.Duration) string {
+		return modified.Add(d).Format(http.TimeFormat)
+	}
+
+	var tests = []struct {
+		name         string
+		method       string
+		headers      map[string]string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"whole object", "", nil, http.StatusOK, "0123456789", ""},
+		{"range", "", map[string]string{"Range": "bytes=2-5"}, http.StatusPartialContent, "2345", "bytes 2-5/10"},
+		{"open range", "", map[string]string{"Range": "bytes=7-"}, http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"range past the end", "", map[string]string{"Range": "bytes=8-100"}, http.StatusPartialContent, "89", "bytes 8-9/10"},
+		{"single byte", "", map[string]string{"Range": "bytes=0-0"}, http.StatusPartialContent, "0", "bytes 0-0/10"},
+		{"suffix range", "", map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"suffix beyond the size", "", map[string]string{"Range": "bytes=-50"}, http.StatusPartialContent, "0123456789", "bytes 0-9/10"},
+		{"multiple ranges", "", map[string]string{"Range": "bytes=0-1,4-5"}, http.StatusPartialContent, "0123456789", "bytes 0-9/10"},
+		{"start past the end", "", map[string]string{"Range": "bytes=10-"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"reversed range", "", map[string]string{"Range": "bytes=5-2"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"empty suffix", "", map[string]string{"Range": "bytes=-0"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"other unit", "", map[string]string{"Range": "items=0-1"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"head of a range", http.MethodHead, map[string]string{"Range": "bytes=2-5"}, http.StatusPartialContent, "", "bytes 2-5/10"},
+
+		{"If-None-Match", "", map[string]string{"If-None-Match": etag}, http.StatusNotModified, "", ""},
+		{"If-None-Match weak", "", map[string]string{"If-None-Match": "W/" + etag}, http.StatusNotModified, "", ""},
+		{"If-None-Match list", "", map[string]string{"If-None-Match": `"other", ` + etag}, http.StatusNotModified, "", ""},
+		{"If-None-Match any", "", map[string]string{"If-None-Match": "*"}, http.StatusNotModified, "", ""},
+		{"If-None-Match other", "", map[string]string{"If-None-Match": `"other"`}, http.StatusOK, "0123456789", ""},
+		{"If-None-Match wins over If-Modified-Since", "", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": date(time.Hour)}, http.StatusOK, "0123456789", ""},
+		{"If-None-Match before Range", "", map[string]string{"If-None-Match": etag, "Range": "bytes=2-5"}, http.StatusNotModified, "", ""},
+		{"If-Modified-Since the modification", "", map[string]string{"If-Modified-Since": date(0)}, http.StatusNotModified, "", ""},
+		{"If-Modified-Since later", "", map[string]string{"If-Modified-Since": date(time.Hour)}, http.StatusNotModified, "", ""},
+		{"If-Modified-Since earlier", "", map[string]string{"If-Modified-Since": date(-time.Second)}, http.StatusOK, "0123456789", ""},
+		{"If-Modified-Since invalid", "", map[string]string{"If-Modified-Since": "yesterday"}, http.StatusOK, "0123456789", ""},
+
+		{"If-Range current ETag", "", map[string]string{"Range": "bytes=2-5", "If-Range": etag}, http.StatusPartialContent, "2345", "bytes 2-5/10"},
+		{"If-Range other ETag", "", map[string]string{"Range": "bytes=2-5", "If-Range": `"other"`}, http.StatusOK, "0123456789", ""},
+		{"If-Range weak ETag", "", map[string]string{"Range": "bytes=2-5", "If-Range": "W/" + etag}, http.StatusOK, "0123456789", ""},
+		{"If-Range modification date", "", map[string]string{"Range": "bytes=2-5", "If-Range": date(0)}, http.StatusPartialContent, "2345", "bytes 2-5/10"},
+		{"If-Range other date", "", map[string]string{"Range": "bytes=2-5", "If-Range": date(-time.Hour)}, http.StatusOK, "0123456789", ""},
+		{"If-Range without Range", "", map[string]string{"If-Range": `"other"`}, http.StatusOK, "0123456789", ""},
+		{"unsatisfiable range ignored by If-Range", "", map[string]string{"Range": "bytes=50-", "If-Range": `"other"`}, http.StatusOK, "0123456789", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var method = test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			var req = httptest.NewRequest(method, "/media/"+strconv.FormatInt(media.MediaID, 10), nil)
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			resp := testRequest(t, req)
+			if resp.StatusCode != test.status {
+				t.Fatalf("status %d, expected %d", resp.StatusCode, test.status)
+			}
+			if got := resp.Header.Get("Content-Range"); got != test.contentRange {
+				t.Fatalf("Content-Range %q, expected %q", got, test.contentRange)
+			}
+			if test.status == http.StatusRequestedRangeNotSatisfiable {
+				return
+			}
+			if resp.Header.Get("ETag") != etag || resp.Header.Get("Last-Modified") != date(0) || resp.Header.Get("Accept-Ranges") != "bytes" {
+				t.Fatalf("ETag %q, Last-Modified %q, Accept-Ranges %q", resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), resp.Header.Get("Accept-Ranges"))
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != test.body {
+				t.Fatalf("body %q, expected %q", body, test.body)
+			}
+			if method == http.MethodHead && resp.Header.Get("Content-Length") != "4" {
+				t.Fatalf("Content-Length %q of the range", resp.Header.Get("Content-Length"))
+			}
+		})
+	}
+}
+
+func TestDeliveryUnavailable(t *testing.T) {
+	setupTest(t)
+	var processing = storeContent(t, "processing.txt", "processing")
+	processing.Status = PROCESSING
+	if err := db.Save(processing).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/media/999", "/media/" + strconv.FormatInt(processing.MediaID, 10)} {
+		if resp := testRequest(t, httptest.NewRequest(http.MethodGet, target, nil)); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: status %d", target, resp.StatusCode)
+		}
+	}
+}
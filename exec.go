@@ -0,0 +1,206 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/settings"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations group tool invocations by their expected cost. Each has its own timeout,
+// read from MEDIA.<OPERATION>_TIMEOUT.
+const (
+	OpProbe     = "probe"
+	OpThumbnail = "thumbnail"
+	OpPreview   = "preview"
+	OpTranscode = "transcode"
+)
+
+var defaultTimeouts = map[string]time.Duration{
+	OpProbe:     30 * time.Second,
+	OpThumbnail: 2 * time.Minute,
+	OpPreview:   10 * time.Minute,
+	OpTranscode: 2 * time.Hour,
+}
+
+// stderrLimit is how much of the end of a tool's standard error is kept for error messages.
+const stderrLimit = 16 << 10
+
+var ErrShutdown = errors.New("media processing is shutting down")
+
+var (
+	baseContext, cancelBase = context.WithCancelCause(context.Background())
+	// toolsRunning counts the tool processes that have not been waited for yet
+	toolsRunning sync.WaitGroup
+)
+
+// Shutdown kills every running ffmpeg and ffprobe process, stops starting new ones and waits until the
+// killed processes have exited and the interrupted jobs are back in the queue. The app calls it on SIGINT
+// and SIGTERM unless MEDIA.HANDLE_SIGNALS is false, in which case the host has to.
+func Shutdown() {
+	cancelBase(ErrShutdown)
+	toolsRunning.Wait()
+	jobsRunning.Wait()
+}
+
+var (
+	mediaContexts   = map[int64]context.Context{}
+	mediaContextsMu sync.Mutex
+)
+
+// withMediaContext makes the tools run while processing media stop when ctx is done. The returned
+// function must be called once processing is over.
+func withMediaContext(ctx context.Context, media *Media) func() {
+	mediaContextsMu.Lock()
+	mediaContexts[media.MediaID] = ctx
+	mediaContextsMu.Unlock()
+	return func() {
+		mediaContextsMu.Lock()
+		delete(mediaContexts, media.MediaID)
+		mediaContextsMu.Unlock()
+	}
+}
+
+// mediaContext returns the context of the job processing media, or the process wide context if there is none.
+func mediaContext(media *Media) context.Context {
+	mediaContextsMu.Lock()
+	defer mediaContextsMu.Unlock()
+	if ctx, ok := mediaContexts[media.MediaID]; ok {
+		return ctx
+	}
+	return baseContext
+}
+
+// operationTimeout reads the timeout of op from MEDIA.<OP>_TIMEOUT.
+func operationTimeout(op string) time.Duration {
+	var timeout, err = settings.Get("MEDIA."+strings.ToUpper(op)+"_TIMEOUT", defaultTimeouts[op].String()).Duration()
+	if err != nil || timeout <= 0 {
+		return defaultTimeouts[op]
+	}
+	return timeout
+}
+
+// runTool runs the media tool name for op through Tools once the limiter has slots for it, stopping it once
+// ctx is done, the timeout of op has passed or the process shuts down.
+func runTool(ctx context.Context, op, name string, args []string, stdout io.Writer) error {
+	if err := context.Cause(baseContext); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the process wide context is not necessarily a parent of ctx
+	stop := context.AfterFunc(baseContext, cancel)
+	defer stop()
+
+	// time spent waiting for a slot does not count against the timeout
+	release, err := limiter().acquire(ctx, op)
+	if err != nil {
+		if cause := context.Cause(baseContext); cause != nil {
+			return cause
+		}
+		return fmt.Errorf("%s %s canceled while queued: %w", name, op, err)
+	}
+	defer release()
+	var timeout = operationTimeout(op)
+	ctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+	defer cancelTimeout()
+
+	toolsRunning.Add(1)
+	defer toolsRunning.Done()
+	err = Tools.Run(ctx, Command{Op: op, Name: name, Args: args, Stdout: stdout})
+	switch {
+	case err == nil:
+		return nil
+	case context.Cause(baseContext) != nil:
+		return context.Cause(baseContext)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%s %s timed out after %s", name, op, timeout)
+	case ctx.Err() != nil:
+		return fmt.Errorf("%s %s canceled: %w", name, op, ctx.Err())
+	}
+	return err
+}
+
+// threadArgs caps the threads ffmpeg uses for filtering and encoding to MEDIA.FFMPEG_THREADS.
+// The last argument of every ffmpeg invocation in this package is its output.
+func threadArgs(args []string) []string {
+	var threads = settings.Get("MEDIA.FFMPEG_THREADS").Int()
+	if threads <= 0 || len(args) == 0 {
+		return args
+	}
+	var n = strconv.Itoa(threads)
+	var result = append([]string{"-filter_threads", n}, args[:len(args)-1]...)
+	return append(result, "-threads", n, args[len(args)-1])
+}
+
+// priorityArgs returns the nice and ionice commands prefixed to tools when MEDIA.NICE or MEDIA.IONICE_CLASS
+// are set. Both exec the tool in their own process, so killing the process group still reaches it.
+func priorityArgs() []string {
+	var args []string
+	if n := settings.Get("MEDIA.NICE").Int(); n != 0 && niceAvailable() {
+		args = append(args, "nice", "-n", strconv.Itoa(n))
+	}
+	if class := ioniceClass(settings.Get("MEDIA.IONICE_CLASS").String()); class != "" && ioniceAvailable() {
+		args = append(args, "ionice", "-c", class)
+	}
+	return args
+}
+
+// ioniceClass accepts the ionice scheduling classes by name or number.
+func ioniceClass(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "realtime":
+		return "1"
+	case "2", "best-effort":
+		return "2"
+	case "3", "idle":
+		return "3"
+	}
+	return ""
+}
+
+var (
+	niceAvailable = sync.OnceValue(func() bool {
+		_, err := exec.LookPath("nice")
+		return err == nil
+	})
+	ioniceAvailable = sync.OnceValue(func() bool {
+		_, err := exec.LookPath("ionice")
+		return err == nil
+	})
+)
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	limit     int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	var n = len(p)
+	if len(p) >= b.limit {
+		b.buf.Reset()
+		p = p[len(p)-b.limit:]
+		b.truncated = true
+	} else if over := b.buf.Len() + len(p) - b.limit; over > 0 {
+		b.buf.Next(over)
+		b.truncated = true
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+func (b *tailBuffer) String() string {
+	if b.truncated {
+		return "..." + b.buf.String()
+	}
+	return b.buf.String()
+}
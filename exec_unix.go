@@ -0,0 +1,32 @@
+//go:build !windows
+
+package media
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// configureProcess starts the tool in its own process group so cancelling it also kills the processes it started.
+func configureProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// shutdownOnSignal kills the running tools on SIGINT or SIGTERM, which no longer reach them through the
+// terminal's process group, and then lets the signal terminate the process as it would have. Hosts with a
+// graceful shutdown of their own set MEDIA.HANDLE_SIGNALS to false and call Shutdown from it instead.
+func shutdownOnSignal() {
+	var signals = make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		var sig = <-signals
+		Shutdown()
+		signal.Reset(sig)
+		_ = syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+	}()
+}
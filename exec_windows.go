@@ -0,0 +1,13 @@
+//go:build windows
+
+package media
+
+import (
+	"os/exec"
+)
+
+// configureProcess leaves the tool to the default cancellation, which kills the tool process itself.
+func configureProcess(cmd *exec.Cmd) {}
+
+// shutdownOnSignal does nothing on Windows, where tools are not detached from the console.
+func shutdownOnSignal() {}
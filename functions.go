@@ -2,6 +2,7 @@ package media
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"github.com/gabriel-vasile/mimetype"
@@ -17,52 +18,33 @@ import (
 	"mime/multipart"
 	"net/textproto"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"unicode"
 )
 
-// IsFFMpegInstalled checks if ffmpeg is installed and available in PATH
+// IsFFMpegInstalled checks if ffmpeg is installed at MEDIA.FFMPEG_PATH or available in PATH
 func IsFFMpegInstalled() bool {
-	var cmd *exec.Cmd
-
-	if runtime.GOOS == "windows" {
-		cmd = exec.Command("where", "ffmpeg")
-	} else {
-		cmd = exec.Command("which", "ffmpeg")
-	}
-
-	err := cmd.Run()
-	return err == nil
+	return Tools.Available("ffmpeg")
 }
 
-// IsFFProbeInstalled checks if ffmpeg is installed and available in PATH
+// IsFFProbeInstalled checks if ffprobe is installed at MEDIA.FFPROBE_PATH or available in PATH
 func IsFFProbeInstalled() bool {
-	var cmd *exec.Cmd
-
-	if runtime.GOOS == "windows" {
-		cmd = exec.Command("where", "ffprobe")
-	} else {
-		cmd = exec.Command("which", "ffprobe")
-	}
-
-	err := cmd.Run()
-	return err == nil
+	return Tools.Available("ffprobe")
 }
 
 // GetVideoDuration returns the duration of the video in seconds using ffprobe
 func GetVideoDuration(inputPath string) (float64, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", inputPath)
-	output, err := cmd.Output()
+	var output bytes.Buffer
+	err := runTool(baseContext, OpProbe, "ffprobe", []string{"-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", inputPath}, &output)
 	if err != nil {
 		return 0, fmt.Errorf("failed to get video duration: %w", err)
 	}
-	durationStr := strings.TrimSpace(string(output))
+	durationStr := strings.TrimSpace(output.String())
 	duration, err := strconv.ParseFloat(durationStr, 64)
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse video duration: %w", err)
@@ -71,6 +53,8 @@ func GetVideoDuration(inputPath string) (float64, error) {
 }
 
 // CreateMultipartFileHeader creates a multipart.FileHeader from a base64 image string and a file name
+//
+// Deprecated: the payload is held in memory several times, use DecodeBase64 instead.
 func CreateMultipartFileHeader(base64Data string, fileName string) (*multipart.FileHeader, error) {
 	// Remove base64 header if present
 	if idx := strings.Index(base64Data, "base64,"); idx != -1 {
@@ -147,6 +131,19 @@ func NormalizeFileName(input string) string {
 	return result
 }
 
+// mediaTypeOf maps a MIME type to one of image, video, audio or document.
+func mediaTypeOf(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "image"
+	case strings.HasPrefix(mimeType, "video/"):
+		return "video"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "audio"
+	}
+	return "document"
+}
+
 // DetectFileType detects file category and MIME type from either *multipart.FileHeader or *os.File
 func DetectFileType(input interface{}) (FileInfo, error) {
 	var (
@@ -209,37 +206,32 @@ func DetectFileType(input interface{}) (FileInfo, error) {
 	}
 
 	mimeType := mimetype.Detect(buffer[:n]).String()
-	fileType := "document"
-	switch {
-	case strings.HasPrefix(mimeType, "image/"):
-		fileType = "image"
-	case strings.HasPrefix(mimeType, "video/"):
-		fileType = "video"
-	case strings.HasPrefix(mimeType, "audio/"):
-		fileType = "audio"
-	}
 
 	return FileInfo{
-		Type:     fileType,
+		Type:     mediaTypeOf(mimeType),
 		MIMEType: mimeType,
 		FileSize: size,
 	}, nil
 }
 
 func GetVideoInfo(inputPath string) (*VideoInfo, error) {
-	cmd := exec.Command("ffprobe",
+	return videoInfo(baseContext, inputPath)
+}
+
+func videoInfo(ctx context.Context, inputPath string) (*VideoInfo, error) {
+	var stdout bytes.Buffer
+	err := runTool(ctx, OpProbe, "ffprobe", []string{
 		"-v", "error",
 		"-select_streams", "v:0",
 		"-show_entries", "stream=width,height,display_aspect_ratio",
 		"-show_entries", "format=duration",
 		"-of", "json",
 		inputPath,
-	)
-
-	output, err := cmd.Output()
+	}, &stdout)
 	if err != nil {
 		return nil, fmt.Errorf("failed to run ffprobe: %w", err)
 	}
+	var output = stdout.Bytes()
 
 	var probeOutput struct {
 		Streams []struct {
@@ -314,22 +306,41 @@ func closestAspectRatio(aspect float64) string {
 	return closestName
 }
 
+// HasAudioStream reports whether the file contains at least one audio stream
+func HasAudioStream(filePath string) bool {
+	return hasAudioStream(baseContext, filePath)
+}
+
+func hasAudioStream(ctx context.Context, filePath string) bool {
+	var output bytes.Buffer
+	err := runTool(ctx, OpProbe, "ffprobe", []string{
+		"-v", "error",
+		"-select_streams", "a",
+		"-show_entries", "stream=index",
+		"-of", "csv=p=0",
+		filePath,
+	}, &output)
+	return err == nil && strings.TrimSpace(output.String()) != ""
+}
+
 // GetAudioDuration returns the duration of the audio file in seconds
 func GetAudioDuration(filePath string) (float64, error) {
-	cmd := exec.Command(
-		"ffprobe",
+	return audioDuration(baseContext, filePath)
+}
+
+func audioDuration(ctx context.Context, filePath string) (float64, error) {
+	var output bytes.Buffer
+	err := runTool(ctx, OpProbe, "ffprobe", []string{
 		"-v", "error",
 		"-show_entries", "format=duration",
 		"-of", "default=noprint_wrappers=1:nokey=1",
 		filePath,
-	)
-
-	output, err := cmd.Output()
+	}, &output)
 	if err != nil {
 		return 0, fmt.Errorf("failed to run ffprobe: %w", err)
 	}
 
-	durationStr := strings.TrimSpace(string(output))
+	durationStr := strings.TrimSpace(output.String())
 	duration, err := strconv.ParseFloat(durationStr, 64)
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse duration: %w", err)
@@ -338,6 +349,46 @@ func GetAudioDuration(filePath string) (float64, error) {
 	return duration, nil
 }
 
+// ffmpegAvailable and ffprobeAvailable report whether the tools can be run here. API nodes may run
+// without them, in which case videos and audio are probed by the worker processing them.
+var (
+	ffmpegAvailable  = sync.OnceValue(IsFFMpegInstalled)
+	ffprobeAvailable = sync.OnceValue(IsFFProbeInstalled)
+)
+
+// ProbeMedia fills in the duration and dimensions of media from a local copy of its file. ffprobe stops when the job
+// processing media is cancelled; media no job is processing, like uploads that are not saved yet, are only
+// probed until MEDIA.PROBE_TIMEOUT or Shutdown, whether or not the client is still there.
+func ProbeMedia(media *Media, file string) error {
+	if (media.Type == "video" || media.Type == "audio") && !ffprobeAvailable() {
+		return nil
+	}
+	switch media.Type {
+	case "video":
+		var info, err = videoInfo(mediaContext(media), file)
+		if err != nil {
+			return err
+		}
+		media.Duration = int64(info.Duration)
+		media.ScreenSize = fmt.Sprintf("%dx%d", info.Width, info.Height)
+		media.AspectRatio = info.AspectRatio
+	case "image":
+		var info, err = GetImageInfo(file)
+		if err != nil {
+			return err
+		}
+		media.ScreenSize = fmt.Sprintf("%dx%d", info.Width, info.Height)
+		media.AspectRatio = info.AspectRatio
+	case "audio":
+		var duration, err = audioDuration(mediaContext(media), file)
+		if err != nil {
+			return err
+		}
+		media.Duration = int64(duration)
+	}
+	return nil
+}
+
 func OnUpload(fn func(media *Media) error) {
 	mediaUploadedCallbacks = append(mediaUploadedCallbacks, fn)
 }
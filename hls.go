@@ -0,0 +1,54 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PackageHLS transcodes the video into the ladder, segments every rendition into HLS
+// and stores a master playlist, whose path is recorded in media.HLS.
+func PackageHLS(media *Media, ladder []Rendition) error {
+	return PackageStreams(media, StreamingProfile{Ladder: ladder, HLS: true})
+}
+
+// writeHLS segments the encoded renditions into dir and writes the master playlist next to them.
+func writeHLS(ctx context.Context, dir string, renditions []string, ladder []Rendition, width, height int) error {
+	var master strings.Builder
+	master.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for i, r := range ladder {
+		var name = fmt.Sprintf("%dp", r.Height)
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			return fmt.Errorf("failed to create rendition dir: %w", err)
+		}
+		if err := ffmpegHLS(ctx, renditions[i], filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to package %s: %w", name, err)
+		}
+
+		master.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", bitrate(r.VideoBitrate)+bitrate(r.AudioBitrate)))
+		if width > 0 && height > 0 {
+			var w = r.Height * width / height
+			master.WriteString(fmt.Sprintf(",RESOLUTION=%dx%d", w-w%2, r.Height))
+		}
+		master.WriteString("\n" + name + "/index.m3u8\n")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "master.m3u8"), []byte(master.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write master playlist: %w", err)
+	}
+	return nil
+}
+
+func ffmpegHLS(ctx context.Context, input, dir string) error {
+	return runTool(ctx, OpTranscode, "ffmpeg", []string{
+		"-y",
+		"-i", input,
+		"-c", "copy",
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "segment_%05d.ts"),
+		filepath.Join(dir, "index.m3u8"),
+	}, nil)
+}
@@ -0,0 +1,221 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrImportTooLarge    = errors.New("remote file exceeds the maximum import size")
+	ErrImportForbidden   = errors.New("remote address is not allowed")
+	ErrImportScheme      = errors.New("only http and https URLs can be imported")
+	ErrImportRedirects   = errors.New("too many redirects")
+	ErrImportBadResponse = errors.New("remote server returned an error")
+)
+
+// ImportOptions limits what ImportURL may fetch.
+type ImportOptions struct {
+	MaxSize      int64         // maximum size of the remote file, 0 for no limit
+	Timeout      time.Duration // deadline of the whole transfer
+	MaxRedirects int
+	AllowPrivate bool // allow loopback, private and link-local addresses
+	Policy       UploadPolicy
+}
+
+// DefaultImportOptions reads the import limits from MEDIA.IMPORT_MAX_SIZE, MEDIA.IMPORT_TIMEOUT,
+// MEDIA.IMPORT_MAX_REDIRECTS and MEDIA.IMPORT_ALLOW_PRIVATE.
+func DefaultImportOptions() ImportOptions {
+	var options = ImportOptions{
+		MaxSize:      int64(settings.Get("MEDIA.IMPORT_MAX_SIZE", "1gb").SizeInBytes()),
+		MaxRedirects: settings.Get("MEDIA.IMPORT_MAX_REDIRECTS", 5).Int(),
+		AllowPrivate: settings.Get("MEDIA.IMPORT_ALLOW_PRIVATE").Bool(),
+		Policy:       DefaultUploadPolicy(),
+	}
+	var err error
+	if options.Timeout, err = settings.Get("MEDIA.IMPORT_TIMEOUT", "5m").Duration(); err != nil || options.Timeout <= 0 {
+		options.Timeout = 5 * time.Minute
+	}
+	return options
+}
+
+// ImportURL downloads a remote file and ingests it into media like an upload.
+// Addresses are checked after DNS resolution, so redirects and rebinding cannot reach internal services.
+func ImportURL(media *Media, rawURL string, options ImportOptions) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrImportScheme
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), options.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := importClient(options).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", u.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", ErrImportBadResponse, resp.Status)
+	}
+	if options.MaxSize > 0 && resp.ContentLength > options.MaxSize {
+		return ErrImportTooLarge
+	}
+	if err = options.Policy.CheckSize("", resp.ContentLength); err != nil {
+		return err
+	}
+
+	// responses without a Content-Length are cut off at the smaller of both limits while they stream in
+	var limit = options.MaxSize
+	if policyLimit := options.Policy.SizeLimit(""); policyLimit > 0 && (limit <= 0 || policyLimit < limit) {
+		limit = policyLimit
+	}
+	var body io.Reader = resp.Body
+	if limit > 0 {
+		body = io.LimitReader(resp.Body, limit+1)
+	}
+	file, checksum, size, err := SaveTemp(body)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file)
+	if options.MaxSize > 0 && size > options.MaxSize {
+		return ErrImportTooLarge
+	}
+	if err = options.Policy.CheckSize("", size); err != nil {
+		return err
+	}
+
+	if media.Filename == "" {
+		media.Filename = importFileName(resp)
+	}
+	media.Filename = NormalizeFileName(media.Filename)
+	if media.Filename == "" {
+		media.Filename = checksum
+	}
+	return IngestFile(media, file, checksum, options.Policy)
+}
+
+// importClient returns an HTTP client enforcing the redirect cap and the address restrictions of options.
+func importClient(options ImportOptions) *http.Client {
+	var dialer = &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if options.AllowPrivate {
+				return nil
+			}
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !publicAddress(addrPort.Addr()) {
+				return ErrImportForbidden
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			// a proxy would dial on our behalf and bypass the address check
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   30 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > options.MaxRedirects {
+				return ErrImportRedirects
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return ErrImportScheme
+			}
+			return nil
+		},
+	}
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which net/netip does not treat as private.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddress reports whether addr is a globally routable unicast address.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() &&
+		!addr.IsPrivate() &&
+		!addr.IsLoopback() &&
+		!addr.IsLinkLocalUnicast() &&
+		!sharedAddressSpace.Contains(addr)
+}
+
+// importFileName takes the file name from Content-Disposition or else from the URL path.
+func importFileName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+	var name = path.Base(resp.Request.URL.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return name
+}
+
+type ImportInput struct {
+	URL          string `json:"url"`
+	Title        string `json:"title"`
+	Description  string `json:"description"`
+	FileName     string `json:"filename"`
+	Private      bool   `json:"private"`
+	CollectionID int64  `json:"collection_id"`
+	Profile      string `json:"profile"`
+}
+
+// ImportHandler fetches the file at the given URL and ingests it as a new media.
+func (c Controller) ImportHandler(request *evo.Request) any {
+	var input ImportInput
+	if err := request.BodyParser(&input); err != nil {
+		return err
+	}
+	if input.URL == "" {
+		return errors.New("url is required")
+	}
+	var media = Media{
+		Title:       input.Title,
+		Description: input.Description,
+		Filename:    input.FileName,
+		Private:     input.Private,
+	}
+	var options = DefaultImportOptions()
+	var err error
+	if options.Policy, err = UploadPolicyFor(request, input.CollectionID); err != nil {
+		return err
+	}
+	if media.Profile, err = ProfileFor(input.Profile, input.CollectionID); err != nil {
+		return err
+	}
+	if err = ImportURL(&media, input.URL, options); err != nil {
+		log.Error(err)
+		return policyError(err)
+	}
+	if input.CollectionID > 0 {
+		if err = AddToCollection(&media, input.CollectionID); err != nil {
+			return err
+		}
+	}
+	return media
+}
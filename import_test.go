@@ -0,0 +1,229 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/db"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testImportOptions() ImportOptions {
+	return ImportOptions{
+		MaxSize:      1 << 20,
+		Timeout:      10 * time.Second,
+		MaxRedirects: 2,
+		AllowPrivate: true,
+	}
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 2))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// assertNoTempFiles fails if an import left a download behind in TemporaryDir.
+func assertNoTempFiles(t *testing.T) {
+	t.Helper()
+	entries, err := os.ReadDir(TemporaryDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("left behind %s", entry.Name())
+	}
+}
+
+func TestImportURL(t *testing.T) {
+	setupTest(t)
+	var content = testPNG(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="Holiday Photo.png"`)
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	var media = Media{Title: "imported"}
+	if err := ImportURL(&media, server.URL+"/download?id=1", testImportOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if media.MediaID == 0 || media.Type != "image" || media.Mimetype != "image/png" || media.ScreenSize != "4x2" {
+		t.Fatalf("unexpected media %+v", media)
+	}
+	if media.Filename != "holiday_photo.png" || media.FileSize != int64(len(content)) || media.Checksum != sha256Hex(content) {
+		t.Fatalf("unexpected file %s of %d bytes, checksum %s", media.Filename, media.FileSize, media.Checksum)
+	}
+	reader, err := Store.Get(media.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored bytes.Buffer
+	stored.ReadFrom(reader)
+	reader.Close()
+	if !bytes.Equal(stored.Bytes(), content) {
+		t.Fatalf("stored file differs")
+	}
+	var jobs int64
+	db.Model(&Job{}).Where("media_id = ?", media.MediaID).Count(&jobs)
+	if jobs != 1 {
+		t.Fatalf("expected a processing job, found %d", jobs)
+	}
+	assertNoTempFiles(t)
+}
+
+func TestImportURLRedirects(t *testing.T) {
+	setupTest(t)
+	var content = testPNG(t)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /hop/n redirects n more times before the file is served
+		if n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/")); n > 0 {
+			http.Redirect(w, r, fmt.Sprintf("%s/hop/%d", server.URL, n-1), http.StatusFound)
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	var media Media
+	if err := ImportURL(&media, server.URL+"/hop/2", testImportOptions()); err != nil {
+		t.Fatalf("redirects within the cap: %v", err)
+	}
+	if media.Filename != "0" {
+		t.Fatalf("file name should come from the final URL, got %s", media.Filename)
+	}
+	media = Media{}
+	if err := ImportURL(&media, server.URL+"/hop/3", testImportOptions()); !errors.Is(err, ErrImportRedirects) {
+		t.Fatalf("expected ErrImportRedirects, got %v", err)
+	}
+	assertNoTempFiles(t)
+}
+
+func TestImportURLSizeLimits(t *testing.T) {
+	setupTest(t)
+	// /length declares its size, /chunked streams without a Content-Length until the client stops reading
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var chunk = bytes.Repeat([]byte("x"), 4096)
+		if r.URL.Path == "/length" {
+			w.Header().Set("Content-Length", strconv.Itoa(64*len(chunk)))
+			for i := 0; i < 64; i++ {
+				w.Write(chunk)
+			}
+			return
+		}
+		for r.Context().Err() == nil {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	var options = testImportOptions()
+	options.MaxSize = 64 * 1024
+	for _, p := range []string{"/length", "/chunked"} {
+		if err := ImportURL(&Media{}, server.URL+p, options); !errors.Is(err, ErrImportTooLarge) {
+			t.Errorf("%s over MaxSize: expected ErrImportTooLarge, got %v", p, err)
+		}
+	}
+
+	// the policy limit is smaller than MaxSize, so it is the one the download stops at
+	options.MaxSize = 1 << 30
+	options.Policy = UploadPolicy{MaxSize: 16 * 1024}
+	for _, p := range []string{"/length", "/chunked"} {
+		var violation PolicyViolation
+		if err := ImportURL(&Media{}, server.URL+p, options); !errors.As(err, &violation) || violation.Rule != "max_size" {
+			t.Errorf("%s over the policy size: expected a max_size violation, got %v", p, err)
+		}
+	}
+	assertNoTempFiles(t)
+}
+
+func TestImportURLTimeout(t *testing.T) {
+	setupTest(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	var options = testImportOptions()
+	options.Timeout = 200 * time.Millisecond
+	var start = time.Now()
+	if err := ImportURL(&Media{}, server.URL, options); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("timeout took %s", elapsed)
+	}
+	assertNoTempFiles(t)
+}
+
+func TestImportURLRejectsPrivateAddresses(t *testing.T) {
+	setupTest(t)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+
+	var options = testImportOptions()
+	options.AllowPrivate = false
+	var port = server.URL[strings.LastIndex(server.URL, ":")+1:]
+	for _, target := range []string{server.URL, "http://localhost:" + port, "http://[::1]:" + port} {
+		if err := ImportURL(&Media{}, target, options); !errors.Is(err, ErrImportForbidden) {
+			t.Errorf("%s: expected ErrImportForbidden, got %v", target, err)
+		}
+	}
+
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("the server was reached %d times", n)
+	}
+
+	if err := ImportURL(&Media{}, "file:///etc/passwd", options); !errors.Is(err, ErrImportScheme) {
+		t.Errorf("file URL: expected ErrImportScheme, got %v", err)
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	for address, public := range map[string]bool{
+		"8.8.8.8":          true,
+		"2001:4860::8888":  true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"::ffff:127.0.0.1": false,
+	} {
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if publicAddress(addr) != public {
+			t.Errorf("publicAddress(%s) = %v", address, !public)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/db"
+	"io"
+	"os"
+)
+
+// IngestFile detects, probes and stores a completed upload, saves media as PROCESSING and queues the
+// OnUpload callbacks, which mark it READY once they are done.
+// checksum is the SHA-256 of file and is computed when empty. Files breaking the policy are rejected before they are stored,
+// except for duration limits on nodes without ffprobe, which the worker checks once it probed the file.
+func IngestFile(media *Media, file, checksum string, policy UploadPolicy) error {
+	fileType, err := DetectFileType(file)
+	if err != nil {
+		return err
+	}
+	media.Mimetype = fileType.MIMEType
+	media.Type = fileType.Type
+	media.Status = PROCESSING
+	media.FileSize = fileType.FileSize
+	if media.Title == "" {
+		media.Title = media.Filename
+	}
+	if err = ProbeMedia(media, file); err != nil {
+		return err
+	}
+	if err = policy.Check(media); err != nil {
+		return err
+	}
+
+	if checksum == "" {
+		if checksum, err = HashFile(file); err != nil {
+			return err
+		}
+	}
+	if err = StoreBlob(media, file, checksum); err != nil {
+		return err
+	}
+	if err = db.Save(media).Error; err != nil {
+		return err
+	}
+	return enqueueProcessMedia(media, policy)
+}
+
+// HashFile returns the hex encoded SHA-256 checksum of a local file.
+func HashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	var hash = sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
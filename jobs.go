@@ -0,0 +1,442 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+
+	// JobProcessMedia runs the OnUpload callbacks of a stored media and marks it READY. Its payload is the
+	// UploadPolicy the upload was accepted under.
+	JobProcessMedia = "process_media"
+)
+
+// JobQueue stores jobs until a worker claims them. DBQueue is used unless another queue is assigned to Queue.
+// A claimed job is leased to WorkerID; the worker extends the lease while the job runs, so jobs of a worker
+// that crashed are recovered once their lease expires.
+type JobQueue interface {
+	// Enqueue stores a new job.
+	Enqueue(job *Job) error
+	// Dequeue claims the next due job for WorkerID, returning nil if there is none.
+	Dequeue() (*Job, error)
+	// Heartbeat extends the lease of a claimed job, returning ErrJobLeaseLost if the worker no longer holds it.
+	Heartbeat(job *Job) error
+	// Complete marks a claimed job as done.
+	Complete(job *Job) error
+	// Retry puts a failed job back into the queue to run again at job.RunAt.
+	Retry(job *Job) error
+	// Fail marks a job as failed for good.
+	Fail(job *Job) error
+	// Recover puts running jobs whose lease expired back into the queue.
+	Recover() error
+	// Cancel fails the queued and running jobs of a media. Workers running them notice at their next heartbeat.
+	Cancel(mediaID int64) error
+}
+
+var Queue JobQueue = DBQueue{}
+
+var (
+	ErrJobLeaseLost = errors.New("job lease lost")
+	ErrJobCanceled  = errors.New("job canceled")
+)
+
+// errJobAbandoned fails jobs recovered from crashed workers after their last attempt.
+var errJobAbandoned = errors.New("worker lease expired")
+
+// WorkerID identifies this process as the holder of job leases. It defaults to the host name and process ID.
+var WorkerID = defaultWorkerID()
+
+func defaultWorkerID() string {
+	var host, _ = os.Hostname()
+	if host == "" {
+		host = "worker"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+var (
+	jobHandlers   = map[string]func(ctx context.Context, job *Job) error{}
+	jobHandlersMu sync.RWMutex
+)
+
+// RegisterJobHandler sets the function that runs the jobs of a kind. ctx is cancelled when the job is
+// cancelled, its lease is lost or the process shuts down.
+func RegisterJobHandler(kind string, handler func(ctx context.Context, job *Job) error) {
+	jobHandlersMu.Lock()
+	defer jobHandlersMu.Unlock()
+	jobHandlers[kind] = handler
+}
+
+// EnqueueJob queues a job of the kind for the media.
+func EnqueueJob(kind string, mediaID int64, payload string) error {
+	return Queue.Enqueue(&Job{
+		Kind:        kind,
+		MediaID:     mediaID,
+		Payload:     payload,
+		Status:      JobQueued,
+		MaxAttempts: settings.Get("MEDIA.JOB_MAX_ATTEMPTS", 5).Int(),
+		RunAt:       time.Now(),
+	})
+}
+
+// jobLease reads MEDIA.JOB_LEASE, how long a claimed job stays with its worker without a heartbeat.
+func jobLease() time.Duration {
+	lease, err := settings.Get("MEDIA.JOB_LEASE", "2m").Duration()
+	if err != nil || lease <= 0 {
+		lease = 2 * time.Minute
+	}
+	return lease
+}
+
+// DBQueue keeps jobs in the media_job table. Jobs are claimed with conditional updates, so any number of
+// worker nodes can share the table.
+type DBQueue struct{}
+
+func (DBQueue) Enqueue(job *Job) error {
+	return db.Create(job).Error
+}
+
+func (DBQueue) Dequeue() (*Job, error) {
+	var candidates []Job
+	err := db.Where("status = ? AND run_at <= ?", JobQueued, time.Now()).Order("run_at, job_id").Limit(10).Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		var job = &candidates[i]
+		var lease = time.Now().Add(jobLease())
+		// another worker may have claimed the job since it was read
+		var claimed = db.Model(&Job{}).Where("job_id = ? AND status = ?", job.JobID, JobQueued).
+			Updates(map[string]any{"status": JobRunning, "attempts": job.Attempts + 1, "worker_id": WorkerID, "lease_until": lease}).RowsAffected
+		if claimed == 1 {
+			job.Status = JobRunning
+			job.Attempts++
+			job.WorkerID = WorkerID
+			job.LeaseUntil = &lease
+			return job, nil
+		}
+	}
+	return nil, nil
+}
+
+func (DBQueue) Heartbeat(job *Job) error {
+	var lease = time.Now().Add(jobLease())
+	var result = db.Model(&Job{}).Where("job_id = ? AND status = ? AND worker_id = ?", job.JobID, JobRunning, job.WorkerID).
+		Update("lease_until", lease)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrJobLeaseLost
+	}
+	job.LeaseUntil = &lease
+	return nil
+}
+
+func (q DBQueue) Complete(job *Job) error {
+	job.Status = JobDone
+	return q.release(job, map[string]any{"status": JobDone, "error": ""})
+}
+
+func (q DBQueue) Retry(job *Job) error {
+	job.Status = JobQueued
+	return q.release(job, map[string]any{"status": JobQueued, "run_at": job.RunAt, "error": job.Error})
+}
+
+func (q DBQueue) Fail(job *Job) error {
+	job.Status = JobFailed
+	return q.release(job, map[string]any{"status": JobFailed, "error": job.Error})
+}
+
+// release applies the outcome of a job, unless its lease expired and another worker has claimed it since.
+func (DBQueue) release(job *Job, updates map[string]any) error {
+	updates["worker_id"] = ""
+	updates["lease_until"] = nil
+	var result = db.Model(&Job{}).Where("job_id = ? AND status = ? AND worker_id = ?", job.JobID, JobRunning, job.WorkerID).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrJobLeaseLost
+	}
+	return nil
+}
+
+func (DBQueue) Recover() error {
+	var now = time.Now()
+	return db.Model(&Job{}).Where("status = ? AND lease_until < ?", JobRunning, now).Updates(map[string]any{
+		"status":      JobQueued,
+		"run_at":      now,
+		"worker_id":   "",
+		"lease_until": nil,
+		"error":       errJobAbandoned.Error(),
+	}).Error
+}
+
+func (DBQueue) Cancel(mediaID int64) error {
+	return db.Model(&Job{}).Where("media_id = ? AND status IN ?", mediaID, []string{JobQueued, JobRunning}).Updates(map[string]any{
+		"status":      JobFailed,
+		"worker_id":   "",
+		"lease_until": nil,
+		"error":       ErrJobCanceled.Error(),
+	}).Error
+}
+
+var (
+	runningJobs   = map[*Job]context.CancelCauseFunc{}
+	runningJobsMu sync.Mutex
+	// jobsRunning counts the jobs whose outcome has not been recorded yet
+	jobsRunning sync.WaitGroup
+)
+
+// CancelJobs stops processing media: its queued jobs are dropped and the tools of running ones are killed,
+// right away for jobs running on this node and at their next heartbeat, up to MEDIA.JOB_LEASE/3 later, on other workers.
+func CancelJobs(mediaID int64) error {
+	if err := Queue.Cancel(mediaID); err != nil {
+		return err
+	}
+	runningJobsMu.Lock()
+	defer runningJobsMu.Unlock()
+	for job, cancel := range runningJobs {
+		if job.MediaID == mediaID {
+			cancel(ErrJobCanceled)
+		}
+	}
+	return nil
+}
+
+// trackJob lets CancelJobs cancel job while it runs on this node. The returned function must be called once it is over.
+func trackJob(job *Job, cancel context.CancelCauseFunc) func() {
+	runningJobsMu.Lock()
+	runningJobs[job] = cancel
+	runningJobsMu.Unlock()
+	return func() {
+		runningJobsMu.Lock()
+		delete(runningJobs, job)
+		runningJobsMu.Unlock()
+	}
+}
+
+// jobBackoff returns how long to wait before the next attempt: MEDIA.JOB_BACKOFF doubled for every
+// previous attempt, up to an hour.
+func jobBackoff(attempts int) time.Duration {
+	base, err := settings.Get("MEDIA.JOB_BACKOFF", "30s").Duration()
+	if err != nil || base <= 0 {
+		base = 30 * time.Second
+	}
+	var backoff = base
+	for i := 1; i < attempts && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+	return min(backoff, time.Hour)
+}
+
+// StartWorkers starts n goroutines running queued jobs, and a sweeper recovering the jobs of crashed workers.
+// MEDIA.WORKERS sets n for the app.
+func StartWorkers(n int) {
+	if n <= 0 {
+		return
+	}
+	var poll, err = settings.Get("MEDIA.JOB_POLL_INTERVAL", "1s").Duration()
+	if err != nil || poll <= 0 {
+		poll = time.Second
+	}
+	for i := 0; i < n; i++ {
+		go func() {
+			for baseContext.Err() == nil {
+				job, err := Queue.Dequeue()
+				if err != nil {
+					log.Error(err)
+				}
+				if job == nil {
+					time.Sleep(poll)
+					continue
+				}
+				runJob(job)
+			}
+		}()
+	}
+	go func() {
+		for range time.Tick(jobLease()) {
+			if err := Queue.Recover(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// heartbeat extends the lease of job until ctx is done, and cancels the job once it lost its lease,
+// which is also how cancelled jobs are stopped.
+func heartbeat(ctx context.Context, cancel context.CancelCauseFunc, job *Job) {
+	var ticker = time.NewTicker(jobLease() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := Queue.Heartbeat(job)
+			if errors.Is(err, ErrJobLeaseLost) {
+				cancel(err)
+				return
+			}
+			if err != nil {
+				log.Error(fmt.Errorf("job %d heartbeat: %w", job.JobID, err))
+			}
+		}
+	}
+}
+
+// runJob runs a claimed job and records its outcome on the job and its media.
+func runJob(job *Job) {
+	jobsRunning.Add(1)
+	defer jobsRunning.Done()
+	var err error
+	if job.Attempts > job.MaxAttempts {
+		// recovered from a worker that crashed during the last attempt
+		err = errJobAbandoned
+	} else {
+		ctx, cancel := context.WithCancelCause(baseContext)
+		var untrack = trackJob(job, cancel)
+		go heartbeat(ctx, cancel, job)
+		err = callJobHandler(ctx, job)
+		untrack()
+		cancel(nil)
+		if errors.Is(context.Cause(ctx), ErrJobCanceled) {
+			// CancelJobs already failed the job and its media
+			return
+		}
+	}
+	if err == nil {
+		if err = Queue.Complete(job); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	if errors.Is(err, ErrShutdown) {
+		// interrupted rather than failed, so it is handed to the next worker right away
+		job.RunAt = time.Now()
+		if err = Queue.Retry(job); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	log.Error(fmt.Errorf("job %d (%s) attempt %d failed: %w", job.JobID, job.Kind, job.Attempts, err))
+	job.Error = truncate(err.Error(), 512)
+	var updates = map[string]any{"error": truncate(err.Error(), 255)}
+	var violation PolicyViolation
+	// a policy violation does not go away on retry
+	if job.Attempts < job.MaxAttempts && !errors.As(err, &violation) {
+		job.RunAt = time.Now().Add(jobBackoff(job.Attempts))
+		err = Queue.Retry(job)
+	} else {
+		updates["status"] = FAILED
+		err = Queue.Fail(job)
+	}
+	if err != nil {
+		// the lease was lost to another worker or the queue is unreachable, the media is left to the next attempt
+		log.Error(err)
+		return
+	}
+	if job.MediaID > 0 {
+		if err = db.Model(&Media{}).Where("media_id = ?", job.MediaID).Updates(updates).Error; err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func callJobHandler(ctx context.Context, job *Job) (err error) {
+	jobHandlersMu.RLock()
+	handler, ok := jobHandlers[job.Kind]
+	jobHandlersMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no handler for job kind %s", job.Kind)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// processMediaJob runs the OnUpload callbacks of the job's media and marks it READY.
+func processMediaJob(ctx context.Context, job *Job) error {
+	var media Media
+	if db.Where("media_id = ? AND deleted = 0", job.MediaID).Take(&media).RowsAffected == 0 {
+		// deleted before it was processed, nothing left to do
+		return nil
+	}
+	defer withMediaContext(ctx, &media)()
+	if (media.Type == "video" || media.Type == "audio") && media.Duration == 0 {
+		// uploaded through an API node without ffprobe, so the duration limits were not checked yet
+		if err := probeStoredMedia(&media); err != nil {
+			return err
+		}
+		if job.Payload != "" {
+			var policy UploadPolicy
+			if err := json.Unmarshal([]byte(job.Payload), &policy); err != nil {
+				return err
+			}
+			if err := policy.Check(&media); err != nil {
+				return err
+			}
+		}
+	}
+	defer clearProgress(&media)
+	for _, callback := range mediaUploadedCallbacks {
+		if err := callback(&media); err != nil {
+			return err
+		}
+	}
+	// a media cancelled meanwhile stays failed
+	return db.Model(&Media{}).Where("media_id = ? AND status = ?", media.MediaID, PROCESSING).Updates(map[string]any{"status": READY, "progress": 100, "error": ""}).Error
+}
+
+// enqueueProcessMedia queues the JobProcessMedia job of a stored media accepted under policy.
+func enqueueProcessMedia(media *Media, policy UploadPolicy) error {
+	payload, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	return EnqueueJob(JobProcessMedia, media.MediaID, string(payload))
+}
+
+// probeStoredMedia probes the stored file of media and saves what was found.
+func probeStoredMedia(media *Media) error {
+	file, cleanup, err := FetchFile(media.Path)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if err = ProbeMedia(media, file); err != nil {
+		return err
+	}
+	return db.Model(&Media{}).Where("media_id = ?", media.MediaID).Updates(map[string]any{
+		"duration":     media.Duration,
+		"screen_size":  media.ScreenSize,
+		"aspect_ratio": media.AspectRatio,
+	}).Error
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,96 @@
+package media
+
+import (
+	"context"
+	"github.com/getevo/evo/v2/lib/db"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessMediaJobRechecksPolicy(t *testing.T) {
+	RegisterJobHandler(JobProcessMedia, processMediaJob)
+	for _, test := range []struct {
+		name     string
+		limit    int64
+		status   string
+		jobState string
+	}{
+		{"within the limit", 300, READY, JobDone},
+		{"over the limit", 60, FAILED, JobFailed},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			// stored by an API node that could not probe it
+			file, checksum, _, err := SaveTemp(strings.NewReader("not really a video"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var media = Media{Title: "clip", Filename: "clip.mp4", Type: "video", Mimetype: "video/mp4", Status: PROCESSING}
+			if err = StoreBlob(&media, file, checksum); err != nil {
+				t.Fatal(err)
+			}
+			if err = db.Save(&media).Error; err != nil {
+				t.Fatal(err)
+			}
+			if err = enqueueProcessMedia(&media, UploadPolicy{MaxVideoDuration: test.limit}); err != nil {
+				t.Fatal(err)
+			}
+
+			fakeTools(t, answer(`{"streams":[{"width":640,"height":360}],"format":{"duration":"120.5"}}`))
+			job, err := Queue.Dequeue()
+			if err != nil || job == nil {
+				t.Fatalf("no job to run: %v", err)
+			}
+			runJob(job)
+
+			db.Take(&media, media.MediaID)
+			if media.Status != test.status || media.Duration != 120 {
+				t.Fatalf("media is %s with a duration of %d, error %q", media.Status, media.Duration, media.Error)
+			}
+			if test.status == FAILED && !strings.Contains(media.Error, "maximum duration") {
+				t.Fatalf("unexpected error %q", media.Error)
+			}
+			// a violation is not retried
+			db.Take(job, job.JobID)
+			if job.Status != test.jobState {
+				t.Fatalf("job is %s, expected %s", job.Status, test.jobState)
+			}
+		})
+	}
+}
+
+func TestCancelJobsStopsLocalJobsRightAway(t *testing.T) {
+	setupTest(t)
+	var started = make(chan struct{})
+	RegisterJobHandler("test_block", func(ctx context.Context, job *Job) error {
+		close(started)
+		<-ctx.Done()
+		return context.Cause(ctx)
+	})
+	if err := EnqueueJob("test_block", 7, ""); err != nil {
+		t.Fatal(err)
+	}
+	job, err := Queue.Dequeue()
+	if err != nil || job == nil {
+		t.Fatalf("no job to run: %v", err)
+	}
+	var done = make(chan struct{})
+	go func() {
+		runJob(job)
+		close(done)
+	}()
+	<-started
+	if err = CancelJobs(7); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job was not stopped before its next heartbeat")
+	}
+	db.Take(job, job.JobID)
+	if job.Status != JobFailed || job.Error != ErrJobCanceled.Error() {
+		t.Fatalf("job is %s with error %q", job.Status, job.Error)
+	}
+}
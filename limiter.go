@@ -0,0 +1,123 @@
+package media
+
+import (
+	"context"
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/settings"
+	"golang.org/x/sync/semaphore"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSlots is how many slots of the limiter a tool of each operation takes unless MEDIA.<OP>_SLOTS is set.
+var defaultSlots = map[string]int64{
+	OpProbe:     1,
+	OpThumbnail: 1,
+	OpPreview:   2,
+	OpTranscode: 4,
+}
+
+// ToolStats are the metrics of the tools of one operation.
+type ToolStats struct {
+	Slots       int64   `json:"slots"`   // taken by each tool
+	Waiting     int     `json:"waiting"` // tools queued for slots
+	Running     int     `json:"running"`
+	Completed   int64   `json:"completed"`
+	WaitSeconds float64 `json:"wait_seconds"` // spent queued by all tools so far
+}
+
+// LimiterStats are the metrics of the limiter shared by all tool invocations.
+type LimiterStats struct {
+	Capacity   int64                `json:"capacity"`
+	InUse      int64                `json:"in_use"`
+	Operations map[string]ToolStats `json:"operations"`
+}
+
+// toolLimiter is a weighted semaphore bounding the tools running at once, so that concurrent uploads queue
+// for CPU instead of all encoding at the same time.
+type toolLimiter struct {
+	sem      *semaphore.Weighted
+	capacity int64
+	mu       sync.Mutex
+	inUse    int64
+	stats    map[string]*ToolStats
+}
+
+// limiter is created on first use from MEDIA.TOOL_SLOTS, which defaults to the number of CPUs.
+var limiter = sync.OnceValue(func() *toolLimiter {
+	var capacity = settings.Get("MEDIA.TOOL_SLOTS", runtime.NumCPU()).Int64()
+	if capacity <= 0 {
+		capacity = int64(runtime.NumCPU())
+	}
+	return newToolLimiter(capacity)
+})
+
+// newToolLimiter returns a limiter of capacity slots where each operation takes its MEDIA.<OP>_SLOTS.
+func newToolLimiter(capacity int64) *toolLimiter {
+	var l = &toolLimiter{
+		sem:      semaphore.NewWeighted(capacity),
+		capacity: capacity,
+		stats:    map[string]*ToolStats{},
+	}
+	for op, slots := range defaultSlots {
+		slots = settings.Get("MEDIA."+strings.ToUpper(op)+"_SLOTS", slots).Int64()
+		// a tool asking for more than the whole capacity would never run
+		l.stats[op] = &ToolStats{Slots: min(max(slots, 1), capacity)}
+	}
+	return l
+}
+
+// acquire waits until a tool of op may run and returns the function releasing its slots.
+func (l *toolLimiter) acquire(ctx context.Context, op string) (func(), error) {
+	l.mu.Lock()
+	var stats, ok = l.stats[op]
+	if !ok {
+		stats = &ToolStats{Slots: 1}
+		l.stats[op] = stats
+	}
+	stats.Waiting++
+	l.mu.Unlock()
+
+	var start = time.Now()
+	var err = l.sem.Acquire(ctx, stats.Slots)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats.Waiting--
+	stats.WaitSeconds += time.Since(start).Seconds()
+	if err != nil {
+		return nil, err
+	}
+	stats.Running++
+	l.inUse += stats.Slots
+	return func() {
+		l.mu.Lock()
+		stats.Running--
+		stats.Completed++
+		l.inUse -= stats.Slots
+		l.mu.Unlock()
+		l.sem.Release(stats.Slots)
+	}, nil
+}
+
+// ToolMetrics returns the current state of the limiter.
+func ToolMetrics() LimiterStats {
+	return limiter().metrics()
+}
+
+func (l *toolLimiter) metrics() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var result = LimiterStats{Capacity: l.capacity, InUse: l.inUse, Operations: map[string]ToolStats{}}
+	for op, stats := range l.stats {
+		result.Operations[op] = *stats
+	}
+	return result
+}
+
+// MetricsHandler returns the ToolMetrics of this node.
+func (c Controller) MetricsHandler(request *evo.Request) any {
+	return ToolMetrics()
+}
@@ -0,0 +1,218 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/getevo/evo/v2/lib/settings"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitFor polls the metrics of l until done accepts them.
+func waitFor(t *testing.T, l *toolLimiter, done func(stats LimiterStats) bool) LimiterStats {
+	t.Helper()
+	var deadline = time.Now().Add(5 * time.Second)
+	for {
+		var stats = l.metrics()
+		if done(stats) {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("limiter stuck at %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// acquireAsync acquires slots for op in the background and sends the release function once it runs.
+func acquireAsync(ctx context.Context, l *toolLimiter, op string) (chan func(), chan error) {
+	var acquired, failed = make(chan func(), 1), make(chan error, 1)
+	go func() {
+		release, err := l.acquire(ctx, op)
+		if err != nil {
+			failed <- err
+			return
+		}
+		acquired <- release
+	}()
+	return acquired, failed
+}
+
+func TestToolLimiterSlots(t *testing.T) {
+	t.Cleanup(func() {
+		settings.Set("MEDIA.TRANSCODE_SLOTS", defaultSlots[OpTranscode])
+		settings.Set("MEDIA.PREVIEW_SLOTS", defaultSlots[OpPreview])
+	})
+	var l = newToolLimiter(4)
+	for op, slots := range map[string]int64{OpProbe: 1, OpThumbnail: 1, OpPreview: 2, OpTranscode: 4} {
+		if got := l.metrics().Operations[op].Slots; got != slots {
+			t.Fatalf("%s takes %d slots, expected %d", op, got, slots)
+		}
+	}
+
+	// the settings override the defaults, within 1 and the capacity
+	settings.Set("MEDIA.TRANSCODE_SLOTS", "16")
+	settings.Set("MEDIA.PREVIEW_SLOTS", "-1")
+	l = newToolLimiter(3)
+	var stats = l.metrics()
+	if stats.Capacity != 3 || stats.Operations[OpTranscode].Slots != 3 || stats.Operations[OpPreview].Slots != 1 {
+		t.Fatalf("unexpected slots %+v", stats)
+	}
+
+	// an operation without a setting takes a single slot
+	release, err := l.acquire(context.Background(), "custom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats = l.metrics(); stats.InUse != 1 || stats.Operations["custom"].Slots != 1 || stats.Operations["custom"].Running != 1 {
+		t.Fatalf("unexpected metrics %+v", stats)
+	}
+	release()
+}
+
+func TestToolLimiterQueue(t *testing.T) {
+	var l = newToolLimiter(4)
+	var first, err = l.acquire(context.Background(), OpPreview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := l.acquire(context.Background(), OpPreview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := l.metrics(); stats.InUse != 4 || stats.Operations[OpPreview].Running != 2 {
+		t.Fatalf("unexpected metrics %+v", stats)
+	}
+
+	// a probe needs a single slot, but none is left
+	acquired, failed := acquireAsync(context.Background(), l, OpProbe)
+	waitFor(t, l, func(stats LimiterStats) bool { return stats.Operations[OpProbe].Waiting == 1 })
+	select {
+	case <-acquired:
+		t.Fatalf("the probe ran beyond the capacity")
+	case err = <-failed:
+		t.Fatal(err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	first()
+	var probe func()
+	select {
+	case probe = <-acquired:
+	case err = <-failed:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the probe was not started once slots were released")
+	}
+	var stats = l.metrics()
+	if stats.InUse != 3 || stats.Operations[OpProbe].Waiting != 0 || stats.Operations[OpProbe].Running != 1 {
+		t.Fatalf("unexpected metrics %+v", stats)
+	}
+	if stats.Operations[OpProbe].WaitSeconds <= 0 {
+		t.Fatalf("the time spent queued was not counted")
+	}
+	if stats.Operations[OpPreview].Running != 1 || stats.Operations[OpPreview].Completed != 1 {
+		t.Fatalf("unexpected preview metrics %+v", stats.Operations[OpPreview])
+	}
+
+	// a transcode takes the whole capacity and waits for every other tool
+	acquired, failed = acquireAsync(context.Background(), l, OpTranscode)
+	waitFor(t, l, func(stats LimiterStats) bool { return stats.Operations[OpTranscode].Waiting == 1 })
+	second()
+	probe()
+	select {
+	case release := <-acquired:
+		release()
+	case err = <-failed:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the transcode was not started once every slot was released")
+	}
+	if stats = l.metrics(); stats.InUse != 0 || stats.Operations[OpTranscode].Completed != 1 {
+		t.Fatalf("unexpected metrics %+v", stats)
+	}
+}
+
+func TestToolLimiterCancel(t *testing.T) {
+	var l = newToolLimiter(2)
+	release, err := l.acquire(context.Background(), OpPreview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	acquired, failed := acquireAsync(ctx, l, OpThumbnail)
+	waitFor(t, l, func(stats LimiterStats) bool { return stats.Operations[OpThumbnail].Waiting == 1 })
+	cancel()
+	select {
+	case <-acquired:
+		t.Fatalf("a canceled tool acquired slots")
+	case err = <-failed:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the canceled tool is still queued")
+	}
+	var stats = l.metrics()
+	if stats.Operations[OpThumbnail].Waiting != 0 || stats.Operations[OpThumbnail].Running != 0 || stats.Operations[OpThumbnail].Completed != 0 {
+		t.Fatalf("unexpected thumbnail metrics %+v", stats.Operations[OpThumbnail])
+	}
+
+	// the canceled tool holds no slot
+	release()
+	if !l.sem.TryAcquire(2) {
+		t.Fatalf("slots leaked")
+	}
+	l.sem.Release(2)
+	if stats = l.metrics(); stats.InUse != 0 {
+		t.Fatalf("%d slots in use", stats.InUse)
+	}
+}
+
+func TestToolMetrics(t *testing.T) {
+	var started = make(chan struct{})
+	fakeTools(t, func(ctx context.Context, cmd Command) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	var before = ToolMetrics().Operations[OpThumbnail]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var done = make(chan error, 1)
+	go func() {
+		done <- runTool(ctx, OpThumbnail, "ffmpeg", nil, nil)
+	}()
+	<-started
+	var stats = ToolMetrics()
+	if stats.Operations[OpThumbnail].Running != before.Running+1 || stats.InUse < stats.Operations[OpThumbnail].Slots {
+		t.Fatalf("unexpected metrics while running %+v", stats)
+	}
+
+	// canceling the running tool releases its slots
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	stats = ToolMetrics()
+	if stats.Operations[OpThumbnail].Running != before.Running || stats.Operations[OpThumbnail].Completed != before.Completed+1 {
+		t.Fatalf("unexpected metrics after canceling %+v", stats.Operations[OpThumbnail])
+	}
+	if stats.InUse != 0 {
+		t.Fatalf("%d slots in use after canceling", stats.InUse)
+	}
+
+	resp := testRequest(t, httptest.NewRequest(http.MethodGet, "/admin/media/metrics", nil))
+	var result struct {
+		Data LimiterStats `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Data.Capacity != stats.Capacity || result.Data.Operations[OpThumbnail].Completed != stats.Operations[OpThumbnail].Completed {
+		t.Fatalf("the handler answered %+v", result.Data)
+	}
+}
@@ -0,0 +1,93 @@
+package media
+
+import (
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/settings"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain registers the routes of App on the evo server without starting it; tests send requests
+// to it through testRequest.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "media-test-*")
+	if err != nil {
+		panic(err)
+	}
+	settings.ConfigPath = filepath.Join(dir, "config.yml")
+	if err = os.WriteFile(settings.ConfigPath, []byte("HTTP:\n  Host: 127.0.0.1\n  Port: \"0\"\nCACHE:\n  MEMORY_JANITOR_INTERVAL: 1m\n"), 0644); err != nil {
+		panic(err)
+	}
+	evo.Setup()
+	settings.Set("MEDIA.MODE", ModeAPI)
+	if err := (App{}).Router(); err != nil {
+		panic(err)
+	}
+	var code = m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// setupTest points the package at a fresh SQLite database, local storage and directories below t.TempDir().
+func setupTest(t *testing.T) {
+	t.Helper()
+	var dir = t.TempDir()
+	conn, err := gorm.Open(sqlite.Open(filepath.Join(dir, "media.db")), &gorm.Config{Logger: logger.Discard, DisableForeignKeyConstraintWhenMigrating: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var models = []any{&Media{}, &Collection{}, &CollectionItems{}, &MetaData{}, &Blob{}, &UploadSession{}, &UploadPart{}, &AccessKey{}, &Job{}}
+	for _, model := range models {
+		// the models are written for MySQL; the parsed schema is cached, so AutoMigrate sees the SQLite types
+		var stmt = &gorm.Statement{DB: conn}
+		if err = stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if strings.HasPrefix(string(field.DataType), "enum(") {
+				field.DataType = schema.String
+			}
+			field.DefaultValue = strings.TrimSuffix(field.DefaultValue, "()")
+		}
+	}
+	if err = conn.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+	db.Register(conn)
+	t.Cleanup(func() {
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	TemporaryDir = filepath.Join(dir, "tmp")
+	LocalUploadDir = filepath.Join(dir, "uploads")
+	CacheDir = filepath.Join(dir, "cache")
+	for _, p := range []string{TemporaryDir, LocalUploadDir, CacheDir} {
+		if err = os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Store = NewLocalStorage(LocalUploadDir)
+}
+
+// testRequest sends req to the routes registered by App.Router.
+func testRequest(t *testing.T, req *http.Request) *http.Response {
+	t.Helper()
+	resp, err := evo.GetFiber().Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		resp.Body.Close()
+	})
+	return resp
+}
@@ -8,8 +8,7 @@ import (
 	"github.com/getevo/evo/v2/lib/json"
 	"github.com/rwcarlsen/goexif/exif"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"path"
 	"strconv"
 	"strings"
 )
@@ -17,12 +16,7 @@ import (
 func ExtractImageExif(media *Media) ([]MetaData, error) {
 	var metadata []MetaData
 
-	absPath, err := getPath(filepath.Join(LocalUploadDir, media.Path))
-	if err != nil {
-		return nil, fmt.Errorf("absolute path error: %w", err)
-	}
-
-	f, err := os.Open(absPath)
+	f, err := Store.Get(media.Path)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open image: %w", err)
 	}
@@ -127,11 +121,13 @@ func ExtractImageExif(media *Media) ([]MetaData, error) {
 }
 func ExtractAudioMetadata(media *Media) ([]MetaData, error) {
 	var metadata []MetaData
-	absPath, err := getPath(filepath.Join(LocalUploadDir, media.Path))
+	absPath, cleanup, err := FetchFile(media.Path)
 	if err != nil {
-		return nil, fmt.Errorf("absolute path error: %w", err)
+		return nil, fmt.Errorf("failed to fetch audio file: %w", err)
 	}
+	defer cleanup()
 
+	// tag needs to seek, so it reads from a local copy
 	f, err := os.Open(absPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open audio file: %w", err)
@@ -166,17 +162,19 @@ func ExtractAudioMetadata(media *Media) ([]MetaData, error) {
 	// Save embedded picture (cover art)
 	picture := m.Picture()
 	if picture != nil && len(picture.Data) > 0 {
-		dir := filepath.Dir(absPath)
-		baseName := strings.TrimSuffix(filepath.Base(media.Path), filepath.Ext(media.Path))
+		baseName := strings.TrimSuffix(path.Base(media.Path), path.Ext(media.Path))
 		thumbName := fmt.Sprintf("%s_thumb.%s", baseName, picture.Ext)
-		thumbPath := filepath.Join(dir, thumbName)
+		thumbPath := path.Join(path.Dir(media.Path), thumbName)
 
-		if err := os.WriteFile(thumbPath, picture.Data, 0644); err != nil {
+		if err := Store.Put(thumbPath, bytes.NewReader(picture.Data)); err != nil {
 			return metadata, fmt.Errorf("failed to save thumbnail: %w", err)
 		}
 
-		media.Thumbnail = filepath.Join(filepath.Dir(media.Path), thumbName)
-		db.Save(media)
+		media.Thumbnail = thumbPath
+		// only the thumbnail: saving the whole row would overwrite a status set by a concurrent cancel
+		if err := db.Model(&Media{}).Where("media_id = ?", media.MediaID).Update("thumbnail", media.Thumbnail).Error; err != nil {
+			return metadata, fmt.Errorf("failed to save thumbnail: %w", err)
+		}
 	}
 
 	return metadata, nil
@@ -185,29 +183,26 @@ func ExtractAudioMetadata(media *Media) ([]MetaData, error) {
 func ExtractVideoMetadata(media *Media) ([]MetaData, error) {
 	var metadata []MetaData
 
-	absPath, err := getPath(filepath.Join(LocalUploadDir, media.Path))
+	absPath, cleanup, err := FetchFile(media.Path)
 	if err != nil {
-		return nil, fmt.Errorf("absolute path error: %w", err)
+		return nil, fmt.Errorf("file does not exist: %w", err)
 	}
+	defer cleanup()
 
 	if _, err := os.Stat(absPath); err != nil {
 		return nil, fmt.Errorf("file does not exist: %w", err)
 	}
 
-	cmd := exec.Command("ffprobe",
+	var out bytes.Buffer
+	err = runTool(mediaContext(media), OpProbe, "ffprobe", []string{
 		"-v", "quiet",
 		"-print_format", "json",
 		"-show_format",
 		"-show_streams",
 		absPath,
-	)
-
-	var out, stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("ffprobe error: %v, stderr: %s", err, stderr.String())
+	}, &out)
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe error: %w", err)
 	}
 
 	var result struct {
@@ -3,29 +3,37 @@ package media
 import (
 	"github.com/getevo/evo/v2/lib/db/types"
 	"github.com/getevo/restify"
+	"time"
 )
 
 type Media struct {
-	MediaID        int64        `gorm:"column:media_id;primaryKey;autoIncrement" json:"media_id"`
-	ExternalID     string       `gorm:"column:external_id;size:64;index" json:"external_id"`
-	ExternalStatus string       `gorm:"column:state;size:64" json:"state"`
-	Title          string       `gorm:"column:title;size:255" json:"title"`
-	Filename       string       `gorm:"column:filename;size:255" json:"filename"`
-	Path           string       `gorm:"column:path;size:255" json:"path"`
-	Description    string       `gorm:"column:description;size:512" json:"description"`
-	Thumbnail      string       `gorm:"column:thumbnail;size:255" json:"thumbnail"`
-	Preview        string       `gorm:"column:preview;size:255" json:"preview"`
-	Type           string       `gorm:"column:type;type:enum('image','audio','video','document')" json:"type"`
-	Mimetype       string       `gorm:"column:mimetype;size:32" json:"mimetype"`
-	Duration       int64        `gorm:"column:duration" json:"duration"`
-	ScreenSize     string       `gorm:"column:screen_size;size:16" json:"screen_size"`
-	AspectRatio    string       `gorm:"column:aspect_ratio;size:16" json:"aspect_ratio"`
-	FileSize       int64        `gorm:"column:file_size" json:"file_size"`
-	Status         string       `gorm:"column:status;type:enum('uploading','processing','ready','failed');index" json:"status"`
-	Progress       float64      `gorm:"column:progress" json:"progress"`
-	Error          string       `gorm:"column:error;size:255" json:"error"`
-	MetaData       []MetaData   `gorm:"foreignKey:MediaID;references:MediaID" json:"metadata"`
-	Collections    []Collection `gorm:"many2many:media_collection_items;joinForeignKey:MediaID;joinReferences:CollectionID" json:"collections"`
+	MediaID          int64        `gorm:"column:media_id;primaryKey;autoIncrement" json:"media_id"`
+	ExternalID       string       `gorm:"column:external_id;size:64;index" json:"external_id"`
+	ExternalStatus   string       `gorm:"column:state;size:64" json:"state"`
+	Title            string       `gorm:"column:title;size:255" json:"title"`
+	Filename         string       `gorm:"column:filename;size:255" json:"filename"`
+	Path             string       `gorm:"column:path;size:255" json:"path"`
+	Description      string       `gorm:"column:description;size:512" json:"description"`
+	Thumbnail        string       `gorm:"column:thumbnail;size:255" json:"thumbnail"`
+	Preview          string       `gorm:"column:preview;size:255" json:"preview"`
+	HLS              string       `gorm:"column:hls;size:255" json:"hls"`
+	DASH             string       `gorm:"column:dash;size:255" json:"dash"`
+	Type             string       `gorm:"column:type;type:enum('image','audio','video','document')" json:"type"`
+	Mimetype         string       `gorm:"column:mimetype;size:32" json:"mimetype"`
+	Duration         int64        `gorm:"column:duration" json:"duration"`
+	ScreenSize       string       `gorm:"column:screen_size;size:16" json:"screen_size"`
+	AspectRatio      string       `gorm:"column:aspect_ratio;size:16" json:"aspect_ratio"`
+	FileSize         int64        `gorm:"column:file_size" json:"file_size"`
+	Checksum         string       `gorm:"column:checksum_sha256;size:64;index" json:"checksum_sha256"`
+	Private          bool         `gorm:"column:private" json:"private"`
+	UploadedBy       string       `gorm:"column:uploaded_by;size:128;index" json:"uploaded_by"`
+	Profile          string       `gorm:"column:profile;size:64" json:"profile"` // processing profile, empty for the default
+	SignatureVersion int          `gorm:"column:signature_version" json:"-"`
+	Status           string       `gorm:"column:status;type:enum('uploading','processing','ready','failed');index" json:"status"`
+	Progress         float64      `gorm:"column:progress" json:"progress"`
+	Error            string       `gorm:"column:error;size:255" json:"error"`
+	MetaData         []MetaData   `gorm:"foreignKey:MediaID;references:MediaID" json:"metadata"`
+	Collections      []Collection `gorm:"many2many:media_collection_items;joinForeignKey:MediaID;joinReferences:CollectionID" json:"collections"`
 	types.CreatedAt
 	types.UpdatedAt
 	types.SoftDelete
@@ -40,6 +48,10 @@ type Collection struct {
 	CollectionID int64  `gorm:"column:collection_id;primaryKey;autoIncrement" json:"collection_id"`
 	Title        string `gorm:"column:title;size:255" json:"title"`
 	Description  string `gorm:"column:description;size:512" json:"description"`
+	// UploadPolicy overrides the default policy for uploads into the collection
+	UploadPolicy *UploadPolicy `gorm:"column:upload_policy;type:text;serializer:json" json:"upload_policy"`
+	// ProcessingProfile is the profile of media uploaded into the collection that do not ask for one
+	ProcessingProfile string `gorm:"column:processing_profile;size:64" json:"processing_profile"`
 	types.CreatedAt
 	types.UpdatedAt
 	types.SoftDelete
@@ -73,3 +85,89 @@ type MetaData struct {
 func (MetaData) TableName() string {
 	return "media_metadata"
 }
+
+// Blob is a content addressed file shared by every Media with the same checksum.
+type Blob struct {
+	Checksum string `gorm:"column:checksum_sha256;size:64;primaryKey" json:"checksum_sha256"`
+	Path     string `gorm:"column:path;size:255" json:"path"`
+	FileSize int64  `gorm:"column:file_size" json:"file_size"`
+	RefCount int64  `gorm:"column:ref_count" json:"ref_count"`
+	types.CreatedAt
+	types.UpdatedAt
+}
+
+func (Blob) TableName() string {
+	return "media_blob"
+}
+
+// UploadSession is a multipart upload in progress. The Media is only created once the upload completes.
+type UploadSession struct {
+	UploadID     string       `gorm:"column:upload_id;size:64;primaryKey" json:"upload_id"`
+	Key          string       `gorm:"column:object_key;size:255;index" json:"key"`
+	Owner        string       `gorm:"column:owner;size:128;index" json:"owner"`
+	Title        string       `gorm:"column:title;size:255" json:"title"`
+	Description  string       `gorm:"column:description;size:512" json:"description"`
+	ExpectedSize int64        `gorm:"column:expected_size" json:"expected_size"`
+	CollectionID int64        `gorm:"column:collection_id" json:"collection_id"`
+	Extract      bool         `gorm:"column:extract" json:"extract"` // the upload is a ZIP archive to extract
+	Profile      string       `gorm:"column:profile;size:64" json:"profile"`
+	Private      bool         `gorm:"column:private" json:"private"`
+	ExpiresAt    time.Time    `gorm:"column:expires_at;index" json:"expires_at"`
+	Parts        []UploadPart `gorm:"foreignKey:UploadID;references:UploadID" json:"parts"`
+	types.CreatedAt
+	types.UpdatedAt
+}
+
+func (UploadSession) TableName() string {
+	return "media_upload_session"
+}
+
+// UploadPart is a part received for an UploadSession.
+type UploadPart struct {
+	UploadID   string `gorm:"column:upload_id;size:64;primaryKey" json:"upload_id"`
+	PartNumber int    `gorm:"column:part_number;primaryKey;autoIncrement:false" json:"part_number"`
+	ETag       string `gorm:"column:etag;size:32" json:"etag"`
+	Size       int64  `gorm:"column:size" json:"size"`
+	types.CreatedAt
+	types.UpdatedAt
+}
+
+func (UploadPart) TableName() string {
+	return "media_upload_part"
+}
+
+// AccessKey is a key pair accepted by the multipart endpoints when MEDIA.MULTIPART_SIGV4 is enabled.
+// Identity is recorded as the owner of the uploads signed with the key.
+type AccessKey struct {
+	AccessKey string `gorm:"column:access_key;size:128;primaryKey" json:"access_key"`
+	SecretKey string `gorm:"column:secret_key;size:128" json:"-"`
+	Identity  string `gorm:"column:identity;size:128" json:"identity"`
+	Disabled  bool   `gorm:"column:disabled" json:"disabled"`
+	types.CreatedAt
+	types.UpdatedAt
+}
+
+func (AccessKey) TableName() string {
+	return "media_access_key"
+}
+
+// Job is a unit of background work of the DB backed job queue.
+type Job struct {
+	JobID       int64      `gorm:"column:job_id;primaryKey;autoIncrement" json:"job_id"`
+	Kind        string     `gorm:"column:kind;size:64" json:"kind"`
+	MediaID     int64      `gorm:"column:media_id;index" json:"media_id"`
+	Payload     string     `gorm:"column:payload;type:text" json:"payload"`
+	Status      string     `gorm:"column:status;type:enum('queued','running','done','failed');index:job_due" json:"status"`
+	Attempts    int        `gorm:"column:attempts" json:"attempts"`
+	MaxAttempts int        `gorm:"column:max_attempts" json:"max_attempts"`
+	RunAt       time.Time  `gorm:"column:run_at;index:job_due" json:"run_at"`
+	Error       string     `gorm:"column:error;size:512" json:"error"`
+	WorkerID    string     `gorm:"column:worker_id;size:128" json:"worker_id"`
+	LeaseUntil  *time.Time `gorm:"column:lease_until;index" json:"lease_until"`
+	types.CreatedAt
+	types.UpdatedAt
+}
+
+func (Job) TableName() string {
+	return "media_job"
+}
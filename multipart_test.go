@@ -0,0 +1,534 @@
+package media
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/db"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const completeBody = "<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>00</ETag></Part></CompleteMultipartUpload>"
+
+// startMultipart initiates a multipart upload of key and returns its upload ID.
+func startMultipart(t *testing.T, key string) string {
+	t.Helper()
+	resp := testRequest(t, httptest.NewRequest(http.MethodPost, "/admin/media/multipart/upload/"+key, nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("initiate: status %d", resp.StatusCode)
+	}
+	var result InitiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if !uploadIDPattern.MatchString(result.UploadID) {
+		t.Fatalf("unexpected upload ID %q", result.UploadID)
+	}
+	return result.UploadID
+}
+
+// listFiles returns every file and directory below root except the test database.
+func listFiles(t *testing.T, root string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel, _ := filepath.Rel(root, p); !strings.HasPrefix(rel, "media.db") {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestMultipartHandlersRejectTraversal(t *testing.T) {
+	setupTest(t)
+	var root = filepath.Dir(TemporaryDir)
+	var uploadID = startMultipart(t, "video.mp4")
+	var session = filepath.Join("tmp", "multipart", uploadID)
+
+	// files a traversal could reach, next to and above the multipart directory
+	for _, p := range []string{filepath.Join(TemporaryDir, "x"), filepath.Join(TemporaryDir, "multipart", "x"), filepath.Join(root, "x")} {
+		if err := os.WriteFile(p, []byte("keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var part = func(query string) string {
+		return "/admin/media/multipart/upload/video.mp4?uploadId=" + uploadID + "&partNumber=" + query
+	}
+	var tests = []struct {
+		name, method, target string
+		status               int
+		code                 string
+	}{
+		{"complete ../../x", http.MethodPost, "/admin/media/multipart/upload/video.mp4?uploadId=../../x", 404, "NoSuchUpload"},
+		{"complete encoded ../", http.MethodPost, "/admin/media/multipart/upload/video.mp4?uploadId=%2e%2e%2f", 404, "NoSuchUpload"},
+		{"complete double encoded ../", http.MethodPost, "/admin/media/multipart/upload/video.mp4?uploadId=%252e%252e%252f", 404, "NoSuchUpload"},
+		{"complete id/../../x", http.MethodPost, "/admin/media/multipart/upload/video.mp4?uploadId=" + uploadID + "/../../x", 404, "NoSuchUpload"},
+		{"complete key ../../etc/passwd", http.MethodPost, "/admin/media/multipart/upload/..%2f..%2fetc%2fpasswd?uploadId=" + uploadID, 400, "InvalidArgument"},
+		{"initiate key ../../etc/passwd", http.MethodPost, "/admin/media/multipart/upload/..%2f..%2fetc%2fpasswd", 400, "InvalidArgument"},
+		{"initiate key ..", http.MethodPost, "/admin/media/multipart/upload/%2e%2e", 400, "InvalidArgument"},
+		{"initiate key ..\\..\\x", http.MethodPost, "/admin/media/multipart/upload/..%5c..%5cx", 400, "InvalidArgument"},
+
+		{"part ../../x", http.MethodPut, "/admin/media/multipart/upload/video.mp4?uploadId=../../x&partNumber=1", 404, "NoSuchUpload"},
+		{"part encoded ../", http.MethodPut, "/admin/media/multipart/upload/video.mp4?uploadId=%2e%2e%2f&partNumber=1", 404, "NoSuchUpload"},
+		{"part double encoded ../", http.MethodPut, "/admin/media/multipart/upload/video.mp4?uploadId=%252e%252e%252f&partNumber=1", 404, "NoSuchUpload"},
+		{"part key ../../etc/passwd", http.MethodPut, "/admin/media/multipart/upload/..%2f..%2fetc%2fpasswd?uploadId=" + uploadID + "&partNumber=1", 400, "InvalidArgument"},
+		{"part number 0", http.MethodPut, part("0"), 400, "InvalidArgument"},
+		{"part number -1", http.MethodPut, part("-1"), 400, "InvalidArgument"},
+		{"part number 10001", http.MethodPut, part("10001"), 400, "InvalidArgument"},
+		{"part number abc", http.MethodPut, part("abc"), 400, "InvalidArgument"},
+		{"part number ../1", http.MethodPut, part("..%2f1"), 400, "InvalidArgument"},
+		{"part number missing", http.MethodPut, "/admin/media/multipart/upload/video.mp4?uploadId=" + uploadID, 400, "InvalidArgument"},
+
+		{"abort ../../x", http.MethodDelete, "/admin/media/multipart/upload/video.mp4?uploadId=../../x", 404, "NoSuchUpload"},
+		{"abort encoded ../", http.MethodDelete, "/admin/media/multipart/upload/video.mp4?uploadId=%2e%2e%2f", 404, "NoSuchUpload"},
+		{"abort double encoded ../", http.MethodDelete, "/admin/media/multipart/upload/video.mp4?uploadId=%252e%252e%252f", 404, "NoSuchUpload"},
+		{"abort key ../../etc/passwd", http.MethodDelete, "/admin/media/multipart/upload/..%2f..%2fetc%2fpasswd", 400, "InvalidArgument"},
+		{"abort key ..", http.MethodDelete, "/admin/media/multipart/upload/%2e%2e", 400, "InvalidArgument"},
+
+		{"list parts ../../x", http.MethodGet, "/admin/media/multipart/upload/video.mp4?uploadId=../../x", 404, "NoSuchUpload"},
+		{"list parts encoded ../", http.MethodGet, "/admin/media/multipart/upload/video.mp4?uploadId=%2e%2e%2f", 404, "NoSuchUpload"},
+		{"list parts key ../../etc/passwd", http.MethodGet, "/admin/media/multipart/upload/..%2f..%2fetc%2fpasswd?uploadId=" + uploadID, 400, "InvalidArgument"},
+	}
+
+	var before = listFiles(t, root)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var req = httptest.NewRequest(test.method, test.target, strings.NewReader(completeBody))
+			req.Header.Set("Content-Type", "application/xml")
+			resp := testRequest(t, req)
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != test.status {
+				t.Fatalf("status %d, expected %d: %s", resp.StatusCode, test.status, body)
+			}
+			var s3err S3Error
+			if err := xml.Unmarshal(body, &s3err); err != nil || s3err.Code != test.code {
+				t.Fatalf("expected S3 error %s, got %s", test.code, body)
+			}
+			if after := listFiles(t, root); strings.Join(after, "\n") != strings.Join(before, "\n") {
+				t.Fatalf("files changed:\nbefore %v\nafter  %v", before, after)
+			}
+		})
+	}
+
+	// the session itself still works and only writes to its own directory
+	resp := testRequest(t, httptest.NewRequest(http.MethodPut, part("1"), strings.NewReader("data")))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("valid part: status %d", resp.StatusCode)
+	}
+	var expected = append(append([]string{}, before...), filepath.Join(session, "1"))
+	sort.Strings(expected)
+	if after := listFiles(t, root); strings.Join(after, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("files after a valid part:\n%v\nexpected\n%v", after, expected)
+	}
+
+	resp = testRequest(t, httptest.NewRequest(http.MethodDelete, "/admin/media/multipart/upload/video.mp4?uploadId="+uploadID, nil))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("abort: status %d", resp.StatusCode)
+	}
+	for _, p := range []string{filepath.Join(TemporaryDir, "x"), filepath.Join(TemporaryDir, "multipart", "x"), filepath.Join(root, "x")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("%s was removed", p)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, session)); !os.IsNotExist(err) {
+		t.Fatalf("session directory was not removed")
+	}
+}
+
+func TestUploadSessionDeleteStaysInItsDirectory(t *testing.T) {
+	setupTest(t)
+	var keep = filepath.Join(TemporaryDir, "keep")
+	if err := os.WriteFile(keep, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"", "..", "../..", "../keep"} {
+		var session = UploadSession{UploadID: id}
+		if err := session.Delete(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(keep); err != nil {
+			t.Fatalf("Delete of upload %q removed files outside its directory", id)
+		}
+	}
+}
+
+// uploadPart uploads data as part number of key and returns the ETag the server answered with.
+func uploadPart(t *testing.T, key, uploadID string, number int, data string) string {
+	t.Helper()
+	var target = fmt.Sprintf("/admin/media/multipart/upload/%s?uploadId=%s&partNumber=%d", key, uploadID, number)
+	resp := testRequest(t, httptest.NewRequest(http.MethodPut, target, strings.NewReader(data)))
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("part %d: status %d: %s", number, resp.StatusCode, body)
+	}
+	return resp.Header.Get("ETag")
+}
+
+// completeMultipart sends a CompleteMultipartUpload request listing parts, given as part numbers and ETags.
+func completeMultipart(t *testing.T, key, uploadID string, parts ...Part) *http.Response {
+	t.Helper()
+	body, err := xml.Marshal(CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req = httptest.NewRequest(http.MethodPost, "/admin/media/multipart/upload/"+key+"?uploadId="+uploadID, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/xml")
+	return testRequest(t, req)
+}
+
+func TestMultipartCompleteKeepsRejectedUploads(t *testing.T) {
+	setupTest(t)
+	var collection = Collection{Title: "small", UploadPolicy: &UploadPolicy{AllowedMIME: []string{"image/*"}}}
+	if err := db.Create(&collection).Error; err != nil {
+		t.Fatal(err)
+	}
+	var req = httptest.NewRequest(http.MethodPost, "/admin/media/multipart/upload/notes.txt", nil)
+	req.Header.Set("X-File-Collection", strconv.FormatInt(collection.CollectionID, 10))
+	resp := testRequest(t, req)
+	var initiated InitiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&initiated); err != nil {
+		t.Fatal(err)
+	}
+	var etag = uploadPart(t, "notes.txt", initiated.UploadID, 1, "plain text")
+
+	if resp = completeMultipart(t, "notes.txt", initiated.UploadID, Part{PartNumber: 1, ETag: etag}); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, expected a policy violation", resp.StatusCode)
+	}
+	var session = loadUploadSession(initiated.UploadID, "notes.txt", "")
+	if session == nil {
+		t.Fatalf("the session was deleted with the rejected upload")
+	}
+	if _, err := os.Stat(session.partPath(1)); err != nil {
+		t.Fatalf("the part was deleted with the rejected upload")
+	}
+
+	// once the policy allows it, the same parts complete the upload
+	collection.UploadPolicy.AllowedMIME = []string{"text/*"}
+	if err := db.Save(&collection).Error; err != nil {
+		t.Fatal(err)
+	}
+	if resp = completeMultipart(t, "notes.txt", initiated.UploadID, Part{PartNumber: 1, ETag: etag}); resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("retry: status %d: %s", resp.StatusCode, body)
+	}
+	if loadUploadSession(initiated.UploadID, "notes.txt", "") != nil {
+		t.Fatalf("the session outlived the ingested upload")
+	}
+	if _, err := os.Stat(session.dir()); !os.IsNotExist(err) {
+		t.Fatalf("the parts outlived the ingested upload")
+	}
+}
+
+func TestSweepUploadSessions(t *testing.T) {
+	setupTest(t)
+	var sessions [2]*UploadSession
+	for i := range sessions {
+		sessions[i] = &UploadSession{Key: "video.mp4"}
+		if err := sessions[i].Create(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sessions[i].SavePart(1, []byte("data"), "8d777f385d3dfec8815d20f7496026dc"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var expired, active = sessions[0], sessions[1]
+	if err := db.Model(expired).Update("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	SweepUploadSessions()
+	var count int64
+	db.Model(&UploadSession{}).Where("upload_id = ?", expired.UploadID).Count(&count)
+	if count != 0 {
+		t.Fatalf("the expired session was kept")
+	}
+	db.Model(&UploadPart{}).Where("upload_id = ?", expired.UploadID).Count(&count)
+	if count != 0 {
+		t.Fatalf("the parts of the expired session were kept")
+	}
+	if _, err := os.Stat(expired.dir()); !os.IsNotExist(err) {
+		t.Fatalf("the directory of the expired session was kept")
+	}
+
+	if loadUploadSession(active.UploadID, "video.mp4", "") == nil {
+		t.Fatalf("the active session was swept")
+	}
+	if parts, err := active.ReceivedParts(); err != nil || len(parts) != 1 {
+		t.Fatalf("the active session lost its parts: %v %v", parts, err)
+	}
+	if _, err := os.Stat(active.partPath(1)); err != nil {
+		t.Fatalf("the active session lost its part file")
+	}
+}
+
+// compositeETag returns the S3 ETag of an object assembled from parts: the MD5 of the part MD5s and the part count.
+func compositeETag(parts ...string) string {
+	var composite = md5.New()
+	for _, part := range parts {
+		var sum = md5.Sum([]byte(part))
+		composite.Write(sum[:])
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(composite.Sum(nil)), len(parts))
+}
+
+func TestAssembleUpload(t *testing.T) {
+	setupTest(t)
+	var session = UploadSession{Key: "video.mp4"}
+	if err := session.Create(); err != nil {
+		t.Fatal(err)
+	}
+	var etags = map[int]string{}
+	for number, data := range map[int]string{1: "first ", 2: "second ", 3: "third"} {
+		var sum = md5.Sum([]byte(data))
+		etags[number] = hex.EncodeToString(sum[:])
+		if _, err := session.SavePart(number, []byte(data), etags[number]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name     string
+		parts    []Part
+		expected int64
+		err      error
+		content  string
+		etag     string
+	}{
+		{"all parts", []Part{{1, etags[1]}, {2, etags[2]}, {3, etags[3]}}, 0, nil, "first second third", compositeETag("first ", "second ", "third")},
+		{"quoted ETags", []Part{{1, `"` + etags[1] + `"`}, {2, `"` + etags[2] + `"`}}, 0, nil, "first second ", compositeETag("first ", "second ")},
+		{"unlisted parts are left out", []Part{{1, etags[1]}, {3, etags[3]}}, 0, nil, "first third", compositeETag("first ", "third")},
+		{"ETag mismatch", []Part{{1, etags[1]}, {2, etags[3]}}, 0, ErrInvalidPart, "", ""},
+		{"unknown part", []Part{{1, etags[1]}, {4, etags[3]}}, 0, ErrInvalidPart, "", ""},
+		{"out of order", []Part{{2, etags[2]}, {1, etags[1]}}, 0, ErrInvalidPartOrder, "", ""},
+		{"repeated part", []Part{{1, etags[1]}, {1, etags[1]}}, 0, ErrInvalidPartOrder, "", ""},
+		{"no parts", nil, 0, ErrMalformedXML, "", ""},
+		{"smaller than announced", []Part{{1, etags[1]}, {2, etags[2]}}, 18, ErrIncompleteBody, "", ""},
+		{"as large as announced", []Part{{1, etags[1]}, {2, etags[2]}, {3, etags[3]}}, 18, nil, "first second third", compositeETag("first ", "second ", "third")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session.ExpectedSize = test.expected
+			err, upload := Controller{}.AssembleUpload(&session, CompleteMultipartUpload{Parts: test.parts})
+			if test.err != nil {
+				if !errors.Is(err, test.err) || upload != nil {
+					t.Fatalf("expected %v, got %v", test.err, err)
+				}
+				if files, _ := filepath.Glob(filepath.Join(TemporaryDir, "assembled-*")); len(files) != 0 {
+					t.Fatalf("left behind %v", files)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(upload.File)
+			data, err := os.ReadFile(upload.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var checksum = sha256.Sum256(data)
+			if string(data) != test.content || upload.Checksum != hex.EncodeToString(checksum[:]) {
+				t.Fatalf("assembled %q with checksum %s", data, upload.Checksum)
+			}
+			if upload.ETag != test.etag {
+				t.Fatalf("ETag %s, expected %s", upload.ETag, test.etag)
+			}
+		})
+	}
+}
+
+func TestMultipartCompleteETag(t *testing.T) {
+	setupTest(t)
+	var uploadID = startMultipart(t, "notes.txt")
+	var first, second = uploadPart(t, "notes.txt", uploadID, 1, "hello "), uploadPart(t, "notes.txt", uploadID, 2, "world")
+	resp := completeMultipart(t, "notes.txt", uploadID, Part{PartNumber: 1, ETag: first}, Part{PartNumber: 2, ETag: second})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	var result CompleteMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.ETag != `"`+compositeETag("hello ", "world")+`"` {
+		t.Fatalf("ETag %s, expected the composite of both parts", result.ETag)
+	}
+}
+
+// listMultipart sends a listing request and decodes the XML it answers with into result.
+func listMultipart(t *testing.T, target string, result any) {
+	t.Helper()
+	resp := testRequest(t, httptest.NewRequest(http.MethodGet, target, nil))
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s: status %d: %s", target, resp.StatusCode, body)
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultipartContentMD5(t *testing.T) {
+	setupTest(t)
+	var uploadID = startMultipart(t, "notes.txt")
+	var digest = func(data string) string {
+		var sum = md5.Sum([]byte(data))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	var tests = []struct {
+		name   string
+		header string
+		code   string
+	}{
+		{"matching digest", digest("hello"), ""},
+		{"digest of other data", digest("hell0"), "BadDigest"},
+		{"not base64", "not a digest!", "InvalidDigest"},
+		{"too short", base64.StdEncoding.EncodeToString([]byte("short")), "InvalidDigest"},
+		{"hex instead of base64", hex.EncodeToString([]byte(digest("hello"))), "InvalidDigest"},
+	}
+	for number, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var req = httptest.NewRequest(http.MethodPut, fmt.Sprintf("/admin/media/multipart/upload/notes.txt?uploadId=%s&partNumber=%d", uploadID, number+1), strings.NewReader("hello"))
+			req.Header.Set("Content-MD5", test.header)
+			resp := testRequest(t, req)
+			if test.code == "" {
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("status %d", resp.StatusCode)
+				}
+				return
+			}
+			var s3err S3Error
+			if resp.StatusCode != http.StatusBadRequest || xml.NewDecoder(resp.Body).Decode(&s3err) != nil || s3err.Code != test.code {
+				t.Fatalf("status %d, code %q, expected %s", resp.StatusCode, s3err.Code, test.code)
+			}
+		})
+	}
+	// only the part with the matching digest was stored
+	var session = loadUploadSession(uploadID, "notes.txt", "")
+	if parts, err := session.ReceivedParts(); err != nil || len(parts) != 1 || parts[0].PartNumber != 1 {
+		t.Fatalf("stored parts %+v: %v", parts, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(session.dir(), "*")); len(files) != 1 {
+		t.Fatalf("part files %v", files)
+	}
+}
+
+func TestListPartsPagination(t *testing.T) {
+	setupTest(t)
+	var uploadID = startMultipart(t, "video.mp4")
+	var etags []string
+	for number := 1; number <= 5; number++ {
+		etags = append(etags, uploadPart(t, "video.mp4", uploadID, number, strings.Repeat("x", number)))
+	}
+
+	var pages [][]int
+	var listed []UploadedPart
+	var marker int
+	for {
+		var result ListPartsResult
+		listMultipart(t, fmt.Sprintf("/admin/media/multipart/upload/video.mp4?uploadId=%s&max-parts=2&part-number-marker=%d", uploadID, marker), &result)
+		if result.PartNumberMarker != marker || result.MaxParts != 2 {
+			t.Fatalf("marker %d and max parts %d echoed", result.PartNumberMarker, result.MaxParts)
+		}
+		var page []int
+		for _, part := range result.Parts {
+			page = append(page, part.PartNumber)
+		}
+		pages = append(pages, page)
+		listed = append(listed, result.Parts...)
+		if !result.IsTruncated {
+			if result.NextPartNumberMarker != 0 {
+				t.Fatalf("next marker %d on the last page", result.NextPartNumberMarker)
+			}
+			break
+		}
+		if result.NextPartNumberMarker != page[len(page)-1] {
+			t.Fatalf("next marker %d, expected the last part of %v", result.NextPartNumberMarker, page)
+		}
+		marker = result.NextPartNumberMarker
+	}
+	if fmt.Sprint(pages) != "[[1 2] [3 4] [5]]" {
+		t.Fatalf("pages %v", pages)
+	}
+	for i, part := range listed {
+		if part.ETag != etags[i] || part.Size != int64(i+1) {
+			t.Fatalf("part %d listed as %+v", i+1, part)
+		}
+	}
+
+	// a marker past the last part lists nothing
+	var result ListPartsResult
+	listMultipart(t, "/admin/media/multipart/upload/video.mp4?uploadId="+uploadID+"&part-number-marker=5", &result)
+	if len(result.Parts) != 0 || result.IsTruncated {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+func TestListMultipartUploadsPagination(t *testing.T) {
+	setupTest(t)
+	var expected []string
+	for _, key := range []string{"b.mp4", "a.mp4", "c_d.mp4", "a.mp4", "cxd.mp4"} {
+		expected = append(expected, key+" "+startMultipart(t, key))
+	}
+	sort.Strings(expected)
+	var expired = startMultipart(t, "a.mp4")
+	if err := db.Model(&UploadSession{}).Where("upload_id = ?", expired).Update("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var listed []string
+	var keyMarker, uploadIDMarker string
+	for pages := 0; ; pages++ {
+		if pages > len(expected) {
+			t.Fatalf("the listing does not end: %v", listed)
+		}
+		var result ListMultipartUploadsResult
+		listMultipart(t, "/admin/media/multipart/upload/?uploads&max-uploads=2&key-marker="+keyMarker+"&upload-id-marker="+uploadIDMarker, &result)
+		if result.KeyMarker != keyMarker || result.UploadIDMarker != uploadIDMarker || result.MaxUploads != 2 {
+			t.Fatalf("markers %q %q and max uploads %d echoed", result.KeyMarker, result.UploadIDMarker, result.MaxUploads)
+		}
+		for _, upload := range result.Uploads {
+			listed = append(listed, upload.Key+" "+upload.UploadID)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		var last = result.Uploads[len(result.Uploads)-1]
+		if result.NextKeyMarker != last.Key || result.NextUploadIDMarker != last.UploadID {
+			t.Fatalf("next markers %q %q, expected the last upload %+v", result.NextKeyMarker, result.NextUploadIDMarker, last)
+		}
+		keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
+	}
+	if strings.Join(listed, ",") != strings.Join(expected, ",") {
+		t.Fatalf("listed %v, expected %v", listed, expected)
+	}
+
+	// the prefix is matched literally, so _ is not a wildcard
+	var result ListMultipartUploadsResult
+	listMultipart(t, "/admin/media/multipart/upload/?uploads&prefix=c_", &result)
+	if len(result.Uploads) != 1 || result.Uploads[0].Key != "c_d.mp4" || result.Prefix != "c_" {
+		t.Fatalf("prefix listed %+v", result.Uploads)
+	}
+}
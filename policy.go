@@ -0,0 +1,236 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"github.com/getevo/evo/v2/lib/settings"
+	"net/http"
+	"strings"
+)
+
+// UploadPolicy restricts what may be uploaded. Zero values mean no limit.
+type UploadPolicy struct {
+	MaxSize          int64            `json:"max_size,omitempty"`           // bytes, for every type
+	MaxSizeByType    map[string]int64 `json:"max_size_by_type,omitempty"`   // bytes, by media type
+	AllowedMIME      []string         `json:"allowed_mime,omitempty"`       // exact types or wildcards such as image/*
+	DeniedMIME       []string         `json:"denied_mime,omitempty"`        // exact types or wildcards such as image/*
+	MaxVideoDuration int64            `json:"max_video_duration,omitempty"` // seconds
+	MaxImageWidth    int              `json:"max_image_width,omitempty"`
+	MaxImageHeight   int              `json:"max_image_height,omitempty"`
+	MaxParts         int              `json:"max_parts,omitempty"` // parts of a multipart upload
+}
+
+// PolicyViolation is returned when an upload breaks a rule of its UploadPolicy.
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	Limit   any    `json:"limit,omitempty"`
+	Value   any    `json:"value,omitempty"`
+}
+
+func (v PolicyViolation) Error() string {
+	return v.Message
+}
+
+// RoutePolicies override the default policy for uploads made through a route. They are keyed by a route
+// path prefix such as /admin/media/tus; the longest prefix of the route path applies.
+var RoutePolicies = map[string]UploadPolicy{}
+
+var mediaTypes = []string{"image", "video", "audio", "document"}
+
+// DefaultUploadPolicy reads the policy from MEDIA.MAX_SIZE, MEDIA.MAX_SIZE_<TYPE>, MEDIA.ALLOWED_MIME,
+// MEDIA.DENIED_MIME, MEDIA.MAX_VIDEO_DURATION, MEDIA.MAX_IMAGE_WIDTH, MEDIA.MAX_IMAGE_HEIGHT and MEDIA.MAX_PARTS.
+func DefaultUploadPolicy() UploadPolicy {
+	var policy = UploadPolicy{
+		MaxSize:        int64(settings.Get("MEDIA.MAX_SIZE").SizeInBytes()),
+		MaxSizeByType:  map[string]int64{},
+		AllowedMIME:    splitList(settings.Get("MEDIA.ALLOWED_MIME").String()),
+		DeniedMIME:     splitList(settings.Get("MEDIA.DENIED_MIME").String()),
+		MaxImageWidth:  settings.Get("MEDIA.MAX_IMAGE_WIDTH").Int(),
+		MaxImageHeight: settings.Get("MEDIA.MAX_IMAGE_HEIGHT").Int(),
+		MaxParts:       settings.Get("MEDIA.MAX_PARTS").Int(),
+	}
+	for _, t := range mediaTypes {
+		if size := int64(settings.Get("MEDIA.MAX_SIZE_" + strings.ToUpper(t)).SizeInBytes()); size > 0 {
+			policy.MaxSizeByType[t] = size
+		}
+	}
+	if d, err := settings.Get("MEDIA.MAX_VIDEO_DURATION").Duration(); err == nil && d > 0 {
+		policy.MaxVideoDuration = int64(d.Seconds())
+	}
+	return policy
+}
+
+// Merge returns p with every limit set in o taking precedence.
+func (p UploadPolicy) Merge(o UploadPolicy) UploadPolicy {
+	if o.MaxSize > 0 {
+		p.MaxSize = o.MaxSize
+	}
+	if len(o.MaxSizeByType) > 0 {
+		var sizes = map[string]int64{}
+		for t, size := range p.MaxSizeByType {
+			sizes[t] = size
+		}
+		for t, size := range o.MaxSizeByType {
+			sizes[t] = size
+		}
+		p.MaxSizeByType = sizes
+	}
+	if len(o.AllowedMIME) > 0 {
+		p.AllowedMIME = o.AllowedMIME
+	}
+	if len(o.DeniedMIME) > 0 {
+		p.DeniedMIME = append(append([]string{}, p.DeniedMIME...), o.DeniedMIME...)
+	}
+	if o.MaxVideoDuration > 0 {
+		p.MaxVideoDuration = o.MaxVideoDuration
+	}
+	if o.MaxImageWidth > 0 {
+		p.MaxImageWidth = o.MaxImageWidth
+	}
+	if o.MaxImageHeight > 0 {
+		p.MaxImageHeight = o.MaxImageHeight
+	}
+	if o.MaxParts > 0 {
+		p.MaxParts = o.MaxParts
+	}
+	return p
+}
+
+// SizeLimit returns the maximum size of a file of the media type, 0 meaning unlimited.
+// An empty type returns the largest limit of any type, for uploads whose type is not known yet.
+func (p UploadPolicy) SizeLimit(mediaType string) int64 {
+	if mediaType == "" {
+		var largest int64
+		for _, t := range mediaTypes {
+			var limit = p.SizeLimit(t)
+			if limit == 0 {
+				return 0
+			}
+			largest = max(largest, limit)
+		}
+		return largest
+	}
+	if limit, ok := p.MaxSizeByType[mediaType]; ok && limit > 0 {
+		return limit
+	}
+	return p.MaxSize
+}
+
+// CheckSize rejects files larger than the limit of their type.
+func (p UploadPolicy) CheckSize(mediaType string, size int64) error {
+	if limit := p.SizeLimit(mediaType); limit > 0 && size > limit {
+		return PolicyViolation{Rule: "max_size", Message: fmt.Sprintf("file exceeds the maximum size of %d bytes", limit), Limit: limit, Value: size}
+	}
+	return nil
+}
+
+// CheckParts rejects multipart uploads with too many parts.
+func (p UploadPolicy) CheckParts(parts int) error {
+	if p.MaxParts > 0 && parts > p.MaxParts {
+		return PolicyViolation{Rule: "max_parts", Message: fmt.Sprintf("upload exceeds the maximum of %d parts", p.MaxParts), Limit: p.MaxParts, Value: parts}
+	}
+	return nil
+}
+
+// Check verifies a detected and probed media against the policy.
+func (p UploadPolicy) Check(media *Media) error {
+	if mimeMatches(p.DeniedMIME, media.Mimetype) || (len(p.AllowedMIME) > 0 && !mimeMatches(p.AllowedMIME, media.Mimetype)) {
+		return PolicyViolation{Rule: "mime", Message: fmt.Sprintf("files of type %s are not allowed", media.Mimetype), Value: media.Mimetype}
+	}
+	if err := p.CheckSize(media.Type, media.FileSize); err != nil {
+		return err
+	}
+	if media.Type == "video" && p.MaxVideoDuration > 0 && media.Duration > p.MaxVideoDuration {
+		return PolicyViolation{Rule: "max_video_duration", Message: fmt.Sprintf("video exceeds the maximum duration of %d seconds", p.MaxVideoDuration), Limit: p.MaxVideoDuration, Value: media.Duration}
+	}
+	if media.Type == "image" && (p.MaxImageWidth > 0 || p.MaxImageHeight > 0) {
+		var width, height int
+		fmt.Sscanf(media.ScreenSize, "%dx%d", &width, &height)
+		if (p.MaxImageWidth > 0 && width > p.MaxImageWidth) || (p.MaxImageHeight > 0 && height > p.MaxImageHeight) {
+			return PolicyViolation{
+				Rule:    "max_image_dimensions",
+				Message: fmt.Sprintf("image exceeds the maximum dimensions of %dx%d", p.MaxImageWidth, p.MaxImageHeight),
+				Limit:   fmt.Sprintf("%dx%d", p.MaxImageWidth, p.MaxImageHeight),
+				Value:   media.ScreenSize,
+			}
+		}
+	}
+	return nil
+}
+
+// mimeMatches reports whether mimetype matches one of the patterns; a pattern ending in /* matches a whole family.
+func mimeMatches(patterns []string, mimetype string) bool {
+	mimetype = strings.ToLower(mimetype)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == mimetype || pattern == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mimetype, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadPolicyFor returns the policy of an upload made through request into the collection, if any:
+// the default policy overridden by RoutePolicies and then by the collection's own policy.
+func UploadPolicyFor(request *evo.Request, collectionID int64) (UploadPolicy, error) {
+	var policy = DefaultUploadPolicy()
+	var route, prefix = request.Context.Route().Path, ""
+	for p := range RoutePolicies {
+		if strings.HasPrefix(route, p) && len(p) > len(prefix) {
+			prefix = p
+		}
+	}
+	if override, ok := RoutePolicies[prefix]; ok {
+		policy = policy.Merge(override)
+	}
+	if collectionID > 0 {
+		var collection Collection
+		if db.Where("collection_id = ? AND deleted = 0", collectionID).Take(&collection).RowsAffected == 0 {
+			return policy, errors.New("collection not found")
+		}
+		if collection.UploadPolicy != nil {
+			policy = policy.Merge(*collection.UploadPolicy)
+		}
+	}
+	return policy, nil
+}
+
+// AddToCollection appends the media to the end of the collection.
+func AddToCollection(media *Media, collectionID int64) error {
+	var order int64
+	db.Model(&CollectionItems{}).Where("collection_id = ?", collectionID).Select("COALESCE(MAX(visual_order), 0)").Scan(&order)
+	return db.Create(&CollectionItems{
+		CollectionID: collectionID,
+		MediaID:      media.MediaID,
+		VisualOrder:  int(order) + 1,
+	}).Error
+}
+
+// policyError turns a PolicyViolation into a structured 422 response and passes other errors through.
+func policyError(err error) any {
+	var violation PolicyViolation
+	if errors.As(err, &violation) {
+		return outcome.Json(map[string]any{
+			"error":     "policy_violation",
+			"violation": violation,
+		}).Status(http.StatusUnprocessableEntity)
+	}
+	return err
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,238 @@
+package media
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/settings"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// violatedRule returns the rule err violates, or "" for nil.
+func violatedRule(t *testing.T, err error) string {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	var violation PolicyViolation
+	if !errors.As(err, &violation) {
+		t.Fatalf("%v is not a policy violation", err)
+	}
+	return violation.Rule
+}
+
+func TestUploadPolicyCheck(t *testing.T) {
+	var policy = UploadPolicy{
+		MaxSize:          1000,
+		MaxSizeByType:    map[string]int64{"video": 5000, "audio": 0},
+		AllowedMIME:      []string{"image/*", "video/mp4", "audio/*", "application/pdf"},
+		DeniedMIME:       []string{"image/svg+xml", "audio/*"},
+		MaxVideoDuration: 60,
+		MaxImageWidth:    1920,
+		MaxImageHeight:   1080,
+	}
+	var tests = []struct {
+		name  string
+		media Media
+		rule  string
+	}{
+		{"allowed by wildcard", Media{Type: "image", Mimetype: "image/png", FileSize: 1000}, ""},
+		{"wildcards ignore case", Media{Type: "image", Mimetype: "IMAGE/JPEG"}, ""},
+		{"allowed exactly", Media{Type: "video", Mimetype: "video/mp4"}, ""},
+		{"not allowed", Media{Type: "video", Mimetype: "video/quicktime"}, "mime"},
+		{"denied within an allowed family", Media{Type: "image", Mimetype: "image/svg+xml"}, "mime"},
+		{"denied wildcard wins over allowed wildcard", Media{Type: "audio", Mimetype: "audio/mpeg"}, "mime"},
+		{"wildcard does not match a prefix", Media{Type: "document", Mimetype: "application/pdfx"}, "mime"},
+		{"global size limit", Media{Type: "image", Mimetype: "image/png", FileSize: 1001}, "max_size"},
+		{"type size limit", Media{Type: "video", Mimetype: "video/mp4", FileSize: 5000}, ""},
+		{"beyond the type size limit", Media{Type: "video", Mimetype: "video/mp4", FileSize: 5001}, "max_size"},
+		{"zero type limit falls back to the global one", Media{Type: "document", Mimetype: "application/pdf", FileSize: 1001}, "max_size"},
+		{"video duration", Media{Type: "video", Mimetype: "video/mp4", Duration: 60}, ""},
+		{"video too long", Media{Type: "video", Mimetype: "video/mp4", Duration: 61}, "max_video_duration"},
+		{"image dimensions", Media{Type: "image", Mimetype: "image/png", ScreenSize: "1920x1080"}, ""},
+		{"image too wide", Media{Type: "image", Mimetype: "image/png", ScreenSize: "1921x1080"}, "max_image_dimensions"},
+		{"image too high", Media{Type: "image", Mimetype: "image/png", ScreenSize: "1080x1920"}, "max_image_dimensions"},
+		{"dimensions only apply to images", Media{Type: "video", Mimetype: "video/mp4", ScreenSize: "3840x2160"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if rule := violatedRule(t, policy.Check(&test.media)); rule != test.rule {
+				t.Fatalf("violated %q, expected %q", rule, test.rule)
+			}
+		})
+	}
+
+	if err := (UploadPolicy{}).Check(&Media{Type: "video", Mimetype: "video/x-anything", FileSize: 1 << 40, Duration: 1 << 20}); err != nil {
+		t.Fatalf("the empty policy rejected a media: %v", err)
+	}
+	if err := (UploadPolicy{MaxParts: 3}).CheckParts(4); violatedRule(t, err) != "max_parts" {
+		t.Fatalf("expected max_parts, got %v", err)
+	}
+}
+
+func TestUploadPolicySizeLimit(t *testing.T) {
+	var tests = []struct {
+		name   string
+		policy UploadPolicy
+		limits map[string]int64
+	}{
+		{"unlimited", UploadPolicy{}, map[string]int64{"": 0, "image": 0, "video": 0}},
+		{"global", UploadPolicy{MaxSize: 100}, map[string]int64{"": 100, "image": 100, "video": 100}},
+		{"by type", UploadPolicy{MaxSize: 100, MaxSizeByType: map[string]int64{"video": 500}}, map[string]int64{"": 500, "image": 100, "video": 500}},
+		{"type below the global limit", UploadPolicy{MaxSize: 100, MaxSizeByType: map[string]int64{"image": 50}}, map[string]int64{"": 100, "image": 50, "audio": 100}},
+		// a type without a limit makes an unknown type unlimited
+		{"some types only", UploadPolicy{MaxSizeByType: map[string]int64{"image": 50}}, map[string]int64{"": 0, "image": 50, "video": 0}},
+		{"every type", UploadPolicy{MaxSizeByType: map[string]int64{"image": 50, "video": 500, "audio": 20, "document": 10}}, map[string]int64{"": 500, "document": 10}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for mediaType, limit := range test.limits {
+				if got := test.policy.SizeLimit(mediaType); got != limit {
+					t.Fatalf("limit of %q is %d, expected %d", mediaType, got, limit)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadPolicyMerge(t *testing.T) {
+	var global = UploadPolicy{
+		MaxSize:        1000,
+		MaxSizeByType:  map[string]int64{"video": 5000, "image": 2000},
+		AllowedMIME:    []string{"image/*", "video/*"},
+		DeniedMIME:     []string{"image/svg+xml"},
+		MaxImageWidth:  4000,
+		MaxImageHeight: 4000,
+		MaxParts:       100,
+	}
+	var merged = global.Merge(UploadPolicy{
+		MaxSizeByType: map[string]int64{"video": 8000},
+		AllowedMIME:   []string{"image/*"},
+		DeniedMIME:    []string{"image/gif"},
+		MaxImageWidth: 1000,
+	})
+	var expected = UploadPolicy{
+		MaxSize:        1000,
+		MaxSizeByType:  map[string]int64{"video": 8000, "image": 2000},
+		AllowedMIME:    []string{"image/*"},
+		DeniedMIME:     []string{"image/svg+xml", "image/gif"},
+		MaxImageWidth:  1000,
+		MaxImageHeight: 4000,
+		MaxParts:       100,
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("merged %+v, expected %+v", merged, expected)
+	}
+	// merging does not modify the policy merged into
+	if global.MaxSizeByType["video"] != 5000 || len(global.DeniedMIME) != 1 {
+		t.Fatalf("the global policy was modified: %+v", global)
+	}
+	if !reflect.DeepEqual(global.Merge(UploadPolicy{}), global) {
+		t.Fatalf("an empty policy changed the global one")
+	}
+}
+
+var registerPolicyRoute sync.Once
+
+// policyFor answers with the policy UploadPolicyFor returns for a test route and the collection.
+func policyFor(t *testing.T, collectionID string) (UploadPolicy, int) {
+	t.Helper()
+	registerPolicyRoute.Do(func() {
+		evo.Get("/test/policy/:collection", func(request *evo.Request) any {
+			policy, err := UploadPolicyFor(request, request.Param("collection").Int64())
+			if err != nil {
+				return httpStatus(http.StatusNotFound)
+			}
+			return policy
+		})
+	})
+	resp := testRequest(t, httptest.NewRequest(http.MethodGet, "/test/policy/"+collectionID, nil))
+	var result struct {
+		Data UploadPolicy `json:"data"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return result.Data, resp.StatusCode
+}
+
+func TestUploadPolicyFor(t *testing.T) {
+	setupTest(t)
+	var routePolicies = RoutePolicies
+	t.Cleanup(func() {
+		for _, key := range []string{"MEDIA.MAX_SIZE", "MEDIA.MAX_SIZE_VIDEO", "MEDIA.DENIED_MIME"} {
+			settings.Set(key, "")
+		}
+		RoutePolicies = routePolicies
+	})
+	settings.Set("MEDIA.MAX_SIZE", "1000")
+	settings.Set("MEDIA.MAX_SIZE_VIDEO", "5000")
+	settings.Set("MEDIA.DENIED_MIME", "image/svg+xml, application/x-msdownload")
+	RoutePolicies = map[string]UploadPolicy{
+		"/test":        {MaxParts: 10, MaxImageWidth: 100},
+		"/test/policy": {MaxParts: 20},
+		"/admin":       {MaxParts: 30},
+	}
+	var collection = Collection{Title: "photos", UploadPolicy: &UploadPolicy{
+		MaxSize:     500,
+		AllowedMIME: []string{"image/*"},
+		DeniedMIME:  []string{"image/gif"},
+	}}
+	if err := db.Create(&collection).Error; err != nil {
+		t.Fatal(err)
+	}
+	var plain = Collection{Title: "plain"}
+	if err := db.Create(&plain).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var global = UploadPolicy{
+		MaxSize:       1000,
+		MaxSizeByType: map[string]int64{"video": 5000},
+		DeniedMIME:    []string{"image/svg+xml", "application/x-msdownload"},
+		MaxParts:      20, // the longest route prefix wins
+	}
+	var tests = []struct {
+		name       string
+		collection int64
+		expected   UploadPolicy
+	}{
+		{"without a collection", 0, global},
+		{"collection without a policy", plain.CollectionID, global},
+		{"collection with a policy", collection.CollectionID, UploadPolicy{
+			MaxSize:       500,
+			MaxSizeByType: map[string]int64{"video": 5000},
+			AllowedMIME:   []string{"image/*"},
+			DeniedMIME:    []string{"image/svg+xml", "application/x-msdownload", "image/gif"},
+			MaxParts:      20,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, status := policyFor(t, strconv.FormatInt(test.collection, 10))
+			if status != http.StatusOK {
+				t.Fatalf("status %d", status)
+			}
+			if !reflect.DeepEqual(policy, test.expected) {
+				t.Fatalf("policy %+v, expected %+v", policy, test.expected)
+			}
+		})
+	}
+
+	// the globally denied types stay denied in a collection allowing their family
+	policy, _ := policyFor(t, strconv.FormatInt(collection.CollectionID, 10))
+	if violatedRule(t, policy.Check(&Media{Type: "image", Mimetype: "image/svg+xml"})) != "mime" {
+		t.Fatalf("the collection allowed a globally denied type")
+	}
+	if _, status := policyFor(t, "999"); status != http.StatusNotFound {
+		t.Fatalf("unknown collection: status %d", status)
+	}
+}
@@ -0,0 +1,235 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/settings"
+	"gopkg.in/yaml.v3"
+	"strings"
+	"sync"
+)
+
+// DefaultProfile is the name of the profile used for media that do not ask for one.
+const DefaultProfile = "default"
+
+var ErrUnknownProfile = errors.New("unknown processing profile")
+
+// ProcessingProfile lists the steps run after upload for each media type.
+type ProcessingProfile struct {
+	Image    ProcessingSteps `json:"image" yaml:"image"`
+	Video    ProcessingSteps `json:"video" yaml:"video"`
+	Audio    ProcessingSteps `json:"audio" yaml:"audio"`
+	Document ProcessingSteps `json:"document" yaml:"document"`
+}
+
+// ProcessingSteps are the steps run for media of one type, in the order of the fields. Steps left nil are skipped;
+// preview, thumbnail and streaming only apply to videos.
+type ProcessingSteps struct {
+	Metadata  bool              `json:"metadata" yaml:"metadata"`
+	Preview   *PreviewStep      `json:"preview,omitempty" yaml:"preview"`
+	Thumbnail *ThumbnailStep    `json:"thumbnail,omitempty" yaml:"thumbnail"`
+	Streaming *StreamingProfile `json:"streaming,omitempty" yaml:"streaming"`
+}
+
+// DefaultProcessingProfile extracts the metadata of every media, and makes the DefaultPreview,
+// the DefaultThumbnail and the DefaultStreamingProfile streams of videos.
+func DefaultProcessingProfile() ProcessingProfile {
+	var preview, thumbnail, streaming = DefaultPreview, DefaultThumbnail, DefaultStreamingProfile()
+	return ProcessingProfile{
+		Image:    ProcessingSteps{Metadata: true},
+		Video:    ProcessingSteps{Metadata: true, Preview: &preview, Thumbnail: &thumbnail, Streaming: &streaming},
+		Audio:    ProcessingSteps{Metadata: true},
+		Document: ProcessingSteps{Metadata: true},
+	}
+}
+
+var (
+	profiles   = map[string]ProcessingProfile{}
+	profilesMu sync.RWMutex
+)
+
+// RegisterProfile defines a profile in code. It takes precedence over a profile of the same name in MEDIA.PROFILES.
+func RegisterProfile(name string, profile ProcessingProfile) {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	profiles[name] = profile
+}
+
+// Profile returns the named profile, registered with RegisterProfile or defined in MEDIA.PROFILES.
+// An empty name is the default profile, which is DefaultProcessingProfile unless it is redefined.
+func Profile(name string) (ProcessingProfile, error) {
+	if name == "" {
+		name = DefaultProfile
+	}
+	profilesMu.RLock()
+	profile, ok := profiles[name]
+	profilesMu.RUnlock()
+	if ok {
+		return profile.withDefaults(), nil
+	}
+	configured, err := configuredProfiles()
+	if err != nil {
+		return ProcessingProfile{}, err
+	}
+	if profile, ok = configured[name]; ok {
+		return profile, nil
+	}
+	if name == DefaultProfile {
+		return DefaultProcessingProfile(), nil
+	}
+	return ProcessingProfile{}, fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+}
+
+// configuredProfiles parses MEDIA.PROFILES, either nested in the YAML settings or given as a YAML or JSON
+// document, into profiles by name:
+//
+//	MEDIA:
+//	  PROFILES:
+//	    social:
+//	      video:
+//	        metadata: true
+//	        thumbnail: {position: 10, width: 320}
+//	        preview: {clips: 6, clip_duration: 2, height: 360}
+//	        streaming: {hls: true, ladder: [{height: 360}, {height: 720}]}
+func configuredProfiles() (map[string]ProcessingProfile, error) {
+	var raw any
+	if tree, ok := settings.Get("MEDIA").Input.(map[string]any); ok {
+		for key, value := range tree {
+			if strings.EqualFold(key, "PROFILES") {
+				raw = value
+			}
+		}
+	}
+	if raw == nil {
+		raw = settings.Get("MEDIA.PROFILES").String()
+	}
+	var document []byte
+	if s, ok := raw.(string); ok {
+		document = []byte(s)
+	} else {
+		var err error
+		if document, err = yaml.Marshal(raw); err != nil {
+			return nil, fmt.Errorf("invalid MEDIA.PROFILES: %w", err)
+		}
+	}
+	var result map[string]ProcessingProfile
+	if err := yaml.Unmarshal(document, &result); err != nil {
+		return nil, fmt.Errorf("invalid MEDIA.PROFILES: %w", err)
+	}
+	for name, profile := range result {
+		result[name] = profile.withDefaults()
+	}
+	return result, nil
+}
+
+// withDefaults fills in the bitrates of renditions that only give their height, and the MEDIA.HLS_LADDER
+// of streaming steps without a ladder.
+func (p ProcessingProfile) withDefaults() ProcessingProfile {
+	for _, steps := range []*ProcessingSteps{&p.Image, &p.Video, &p.Audio, &p.Document} {
+		if steps.Streaming == nil {
+			continue
+		}
+		var streaming = *steps.Streaming
+		if len(streaming.Ladder) == 0 {
+			streaming.Ladder = Ladder()
+		}
+		streaming.Ladder = append([]Rendition{}, streaming.Ladder...)
+		for i, r := range streaming.Ladder {
+			var defaults = rendition(r.Height)
+			if r.VideoBitrate == "" {
+				streaming.Ladder[i].VideoBitrate = defaults.VideoBitrate
+			}
+			if r.AudioBitrate == "" {
+				streaming.Ladder[i].AudioBitrate = defaults.AudioBitrate
+			}
+		}
+		steps.Streaming = &streaming
+	}
+	return p
+}
+
+// Steps returns the steps of the media type.
+func (p ProcessingProfile) Steps(mediaType string) ProcessingSteps {
+	switch mediaType {
+	case "image":
+		return p.Image
+	case "video":
+		return p.Video
+	case "audio":
+		return p.Audio
+	case "document":
+		return p.Document
+	}
+	return ProcessingSteps{}
+}
+
+// Process runs the steps of the media's type. A failing step does not stop the others, so whatever succeeded
+// is kept; the errors are returned together so the job is retried.
+func (p ProcessingProfile) Process(media *Media) error {
+	var steps = p.Steps(media.Type)
+	if steps.Metadata {
+		var metadata = ExtractMediaMetadata(media)
+		if len(metadata) > 0 {
+			db.Save(metadata)
+		}
+	}
+	if media.Type != "video" || (steps.Preview == nil && steps.Thumbnail == nil && steps.Streaming == nil) {
+		return nil
+	}
+
+	// transcoding takes far longer than the preview, so the progress is split by the work each step does
+	var streaming = steps.Streaming != nil && (steps.Streaming.HLS || steps.Streaming.DASH)
+	var previewEnd, thumbnailEnd = 90.0, 100.0
+	if streaming {
+		previewEnd, thumbnailEnd = 15, 20
+	}
+	if steps.Preview == nil {
+		previewEnd = 0
+	}
+	var errs []error
+	if steps.Preview != nil {
+		ProgressStage(media, 0, previewEnd)
+		if err := steps.Preview.Run(media); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if steps.Thumbnail != nil {
+		ProgressStage(media, previewEnd, thumbnailEnd)
+		if err := steps.Thumbnail.Run(media); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if streaming {
+		ProgressStage(media, thumbnailEnd, 100)
+		if err := PackageStreams(media, *steps.Streaming); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// only the outputs are written, a media cancelled meanwhile keeps its status
+	var err = db.Model(&Media{}).Where("media_id = ?", media.MediaID).Updates(map[string]any{
+		"preview":   media.Preview,
+		"thumbnail": media.Thumbnail,
+		"hls":       media.HLS,
+		"dash":      media.DASH,
+	}).Error
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ProfileFor returns the profile name of an upload into the collection, if any: the requested one, else the
+// collection's, else the default. The name is checked to exist.
+func ProfileFor(requested string, collectionID int64) (string, error) {
+	var name = requested
+	if name == "" && collectionID > 0 {
+		var collection Collection
+		db.Select("processing_profile").Where("collection_id = ? AND deleted = 0", collectionID).Take(&collection)
+		name = collection.ProcessingProfile
+	}
+	if _, err := Profile(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
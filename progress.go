@@ -0,0 +1,210 @@
+package media
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/json"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is the least time between two progress writes of a media.
+const progressInterval = time.Second
+
+// progressStage maps the fraction done of the step processing a media onto a range of Media.Progress.
+type progressStage struct {
+	from, to float64
+	written  time.Time
+}
+
+var (
+	progressStages   = map[int64]*progressStage{}
+	progressStagesMu sync.Mutex
+)
+
+// ProgressStage makes the steps processing media from now on report their progress between from and to percent.
+func ProgressStage(media *Media, from, to float64) {
+	progressStagesMu.Lock()
+	progressStages[media.MediaID] = &progressStage{from: from, to: to}
+	progressStagesMu.Unlock()
+	SetProgress(media, from)
+}
+
+// SetProgress records the progress of media in percent.
+func SetProgress(media *Media, percent float64) {
+	progressStagesMu.Lock()
+	media.Progress = percent
+	progressStagesMu.Unlock()
+	saveProgress(media.MediaID, percent)
+}
+
+// reportProgress records that fraction of the current step processing media is done. Progress only moves
+// forward and is written at most once per progressInterval, except when a stage completes.
+func reportProgress(media *Media, fraction float64) {
+	if media.MediaID == 0 {
+		return
+	}
+	progressStagesMu.Lock()
+	var stage, ok = progressStages[media.MediaID]
+	if !ok {
+		stage = &progressStage{from: 0, to: 100}
+		progressStages[media.MediaID] = stage
+	}
+	var percent = stage.from + min(max(fraction, 0), 1)*(stage.to-stage.from)
+	if percent <= media.Progress || (percent < stage.to && time.Since(stage.written) < progressInterval) {
+		progressStagesMu.Unlock()
+		return
+	}
+	stage.written = time.Now()
+	media.Progress = percent
+	progressStagesMu.Unlock()
+	saveProgress(media.MediaID, percent)
+}
+
+// clearProgress forgets the stage of media once it has been processed.
+func clearProgress(media *Media) {
+	progressStagesMu.Lock()
+	delete(progressStages, media.MediaID)
+	progressStagesMu.Unlock()
+}
+
+func saveProgress(mediaID int64, percent float64) {
+	if mediaID == 0 {
+		return
+	}
+	if err := db.Model(&Media{}).Where("media_id = ?", mediaID).Update("progress", percent).Error; err != nil {
+		log.Error(err)
+	}
+}
+
+// fractionOf returns the share of duration seconds that position covers.
+func fractionOf(position time.Duration, duration float64) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	return position.Seconds() / duration
+}
+
+// runFFmpeg runs ffmpeg for op with args, calling progress with the position of the output whenever ffmpeg reports it.
+func runFFmpeg(ctx context.Context, op string, args []string, progress func(position time.Duration)) error {
+	if progress == nil {
+		return runTool(ctx, op, "ffmpeg", args, nil)
+	}
+	return runTool(ctx, op, "ffmpeg", append([]string{"-progress", "pipe:1", "-nostats"}, args...), &progressWriter{progress: progress})
+}
+
+// progressWriter parses the key=value lines ffmpeg writes with -progress.
+type progressWriter struct {
+	line     []byte
+	progress func(position time.Duration)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c != '\n' {
+			w.line = append(w.line, c)
+			continue
+		}
+		if key, value, ok := strings.Cut(string(w.line), "="); ok && key == "out_time" {
+			if position, ok := parseOutTime(value); ok {
+				w.progress(position)
+			}
+		}
+		w.line = w.line[:0]
+	}
+	return len(p), nil
+}
+
+// parseOutTime parses the HH:MM:SS.micro out_time of ffmpeg progress reports.
+func parseOutTime(s string) (time.Duration, bool) {
+	var parts = strings.Split(strings.TrimPrefix(s, "-"), ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	hours, err1 := strconv.Atoi(parts[0])
+	minutes, err2 := strconv.Atoi(parts[1])
+	seconds, err3 := strconv.ParseFloat(parts[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, false
+	}
+	if strings.HasPrefix(s, "-") {
+		return 0, true
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), true
+}
+
+// MediaEvent is the payload of the events streamed by EventsHandler.
+type MediaEvent struct {
+	MediaID  int64   `json:"media_id"`
+	Status   string  `json:"status"`
+	Progress float64 `json:"progress"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// EventsHandler streams the status and progress of a media as Server-Sent Events. A "progress" event is sent
+// whenever either changes, and a final "done" event once the media is ready or failed.
+// The media is polled from the database every MEDIA.EVENTS_INTERVAL, so it also follows jobs run on worker nodes.
+func (c Controller) EventsHandler(request *evo.Request) any {
+	var media Media
+	var id = request.Param("id").Int64()
+	if db.Where("media_id = ? AND deleted = 0", id).Take(&media).RowsAffected == 0 {
+		return httpStatus(http.StatusNotFound)
+	}
+	var interval, err = settings.Get("MEDIA.EVENTS_INTERVAL", "1s").Duration()
+	if err != nil || interval <= 0 {
+		interval = time.Second
+	}
+
+	var ctx = request.Context
+	ctx.Set("Content-Type", "text/event-stream")
+	ctx.Set("Cache-Control", "no-cache")
+	ctx.Set("X-Accel-Buffering", "no")
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		var last MediaEvent
+		var sent = time.Now()
+		for {
+			var event = MediaEvent{MediaID: media.MediaID, Status: media.Status, Progress: media.Progress, Error: media.Error}
+			var done = event.Status == READY || event.Status == FAILED
+			switch {
+			case done:
+				_ = writeEvent(w, "done", event)
+				return
+			case event != last:
+				if writeEvent(w, "progress", event) != nil {
+					return
+				}
+				last, sent = event, time.Now()
+			case time.Since(sent) > 15*time.Second:
+				// a comment keeps proxies from closing an idle stream and notices a gone client
+				if _, err := w.WriteString(": ping\n\n"); err != nil || w.Flush() != nil {
+					return
+				}
+				sent = time.Now()
+			}
+			time.Sleep(interval)
+			if db.Select("media_id", "status", "progress", "error").Where("media_id = ? AND deleted = 0", id).Take(&media).RowsAffected == 0 {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func writeEvent(w *bufio.Writer, name string, event MediaEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,207 @@
+package media
+
+import (
+	"encoding/json"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/settings"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOutTime(t *testing.T) {
+	var tests = []struct {
+		value    string
+		position time.Duration
+		ok       bool
+	}{
+		{"00:00:01.500000", 1500 * time.Millisecond, true},
+		{"01:02:03.250000", time.Hour + 2*time.Minute + 3250*time.Millisecond, true},
+		{"00:00:07", 7 * time.Second, true},
+		{"-00:00:00.023220", 0, true}, // ffmpeg reports a negative time before the first frame
+		{"N/A", 0, false},
+		{"00:01.5", 0, false},
+		{"aa:00:01.5", 0, false},
+		{"00:00:x", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		position, ok := parseOutTime(test.value)
+		if position != test.position || ok != test.ok {
+			t.Errorf("%q: %v %v, expected %v %v", test.value, position, ok, test.position, test.ok)
+		}
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var positions []time.Duration
+	var w = &progressWriter{progress: func(position time.Duration) {
+		positions = append(positions, position)
+	}}
+	// lines are split across writes and only out_time is read
+	for _, chunk := range []string{"frame=1\nout_time=00:00", ":01.000000\nout_time_ms=1000000\n", "out_time=N/A\nout_time=00:00:02.000000", "\nprogress=end\n"} {
+		if n, err := w.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Fatalf("write: %d %v", n, err)
+		}
+	}
+	if !slices.Equal(positions, []time.Duration{time.Second, 2 * time.Second}) {
+		t.Fatalf("unexpected positions %v", positions)
+	}
+}
+
+func TestReportProgress(t *testing.T) {
+	setupTest(t)
+	var media = Media{Filename: "clip.mp4", Type: "video", Status: PROCESSING}
+	if err := db.Create(&media).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		clearProgress(&media)
+	})
+	var assertProgress = func(expected float64) {
+		t.Helper()
+		var stored Media
+		db.Take(&stored, media.MediaID)
+		if media.Progress != expected || stored.Progress != expected {
+			t.Fatalf("progress %v, stored %v, expected %v", media.Progress, stored.Progress, expected)
+		}
+	}
+	// elapse lets the next report through the throttle
+	var elapse = func() {
+		progressStagesMu.Lock()
+		progressStages[media.MediaID].written = time.Now().Add(-progressInterval)
+		progressStagesMu.Unlock()
+	}
+
+	ProgressStage(&media, 20, 60)
+	assertProgress(20)
+	reportProgress(&media, 0.5)
+	assertProgress(40)
+	// reports within progressInterval are dropped, unless they complete the stage
+	reportProgress(&media, 0.75)
+	assertProgress(40)
+	elapse()
+	reportProgress(&media, 0.75)
+	assertProgress(50)
+	reportProgress(&media, 1)
+	assertProgress(60)
+
+	// progress never moves back or beyond its stage
+	elapse()
+	reportProgress(&media, 0.9)
+	assertProgress(60)
+	reportProgress(&media, 2)
+	assertProgress(60)
+
+	ProgressStage(&media, 60, 100)
+	elapse()
+	reportProgress(&media, -1)
+	assertProgress(60)
+	reportProgress(&media, 0.5)
+	assertProgress(80)
+
+	// without a stage the fraction spans the whole range
+	clearProgress(&media)
+	reportProgress(&media, 0.9)
+	assertProgress(90)
+
+	// media that were not stored are ignored
+	var unsaved = Media{}
+	reportProgress(&unsaved, 0.5)
+	if unsaved.Progress != 0 {
+		t.Fatalf("an unsaved media reported progress")
+	}
+	progressStagesMu.Lock()
+	defer progressStagesMu.Unlock()
+	if _, ok := progressStages[0]; ok {
+		t.Fatalf("a stage was kept for an unsaved media")
+	}
+}
+
+// sseEvent is an event read from a Server-Sent Events stream.
+type sseEvent struct {
+	name  string
+	event MediaEvent
+}
+
+// readEvents parses the events of an SSE body, skipping comments.
+func readEvents(t *testing.T, body io.Reader) []sseEvent {
+	t.Helper()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []sseEvent
+	for _, block := range strings.Split(strings.TrimSpace(string(data)), "\n\n") {
+		var event sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			if name, ok := strings.CutPrefix(line, "event: "); ok {
+				event.name = name
+			}
+			if payload, ok := strings.CutPrefix(line, "data: "); ok {
+				if err = json.Unmarshal([]byte(payload), &event.event); err != nil {
+					t.Fatalf("%q: %v", payload, err)
+				}
+			}
+		}
+		if event.name != "" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func TestEventsHandler(t *testing.T) {
+	setupTest(t)
+	t.Cleanup(func() {
+		settings.Set("MEDIA.EVENTS_INTERVAL", "1s")
+	})
+	settings.Set("MEDIA.EVENTS_INTERVAL", "10ms")
+	var media = Media{Filename: "clip.mp4", Type: "video", Status: PROCESSING}
+	if err := db.Create(&media).Error; err != nil {
+		t.Fatal(err)
+	}
+	var target = "/admin/media/" + strconv.FormatInt(media.MediaID, 10) + "/events"
+
+	go func() {
+		for _, progress := range []float64{25, 50} {
+			time.Sleep(100 * time.Millisecond)
+			db.Model(&Media{}).Where("media_id = ?", media.MediaID).Update("progress", progress)
+		}
+		time.Sleep(100 * time.Millisecond)
+		db.Model(&Media{}).Where("media_id = ?", media.MediaID).Updates(map[string]any{"status": READY, "progress": 100})
+	}()
+	resp := testRequest(t, httptest.NewRequest(http.MethodGet, target, nil))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("status %d, Content-Type %q, Cache-Control %q", resp.StatusCode, resp.Header.Get("Content-Type"), resp.Header.Get("Cache-Control"))
+	}
+	var events = readEvents(t, resp.Body)
+	// every change is sent once, polling the unchanged media sends nothing
+	var expected = []sseEvent{
+		{"progress", MediaEvent{MediaID: media.MediaID, Status: PROCESSING, Progress: 0}},
+		{"progress", MediaEvent{MediaID: media.MediaID, Status: PROCESSING, Progress: 25}},
+		{"progress", MediaEvent{MediaID: media.MediaID, Status: PROCESSING, Progress: 50}},
+		{"done", MediaEvent{MediaID: media.MediaID, Status: READY, Progress: 100}},
+	}
+	if !slices.Equal(events, expected) {
+		t.Fatalf("events %+v, expected %+v", events, expected)
+	}
+
+	// a failed media ends the stream at once with its error
+	if err := db.Model(&media).Updates(map[string]any{"status": FAILED, "error": "transcode failed"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	events = readEvents(t, testRequest(t, httptest.NewRequest(http.MethodGet, target, nil)).Body)
+	if len(events) != 1 || events[0].name != "done" || events[0].event.Status != FAILED || events[0].event.Error != "transcode failed" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	if resp = testRequest(t, httptest.NewRequest(http.MethodGet, "/admin/media/999/events", nil)); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown media: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,112 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/settings"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command is a single invocation of a media tool.
+type Command struct {
+	Op     string // OpProbe, OpThumbnail, OpPreview or OpTranscode
+	Name   string // ffmpeg or ffprobe
+	Args   []string
+	Stdout io.Writer // receives the standard output if not nil
+}
+
+func (c Command) String() string {
+	return c.Name + " " + strings.Join(c.Args, " ")
+}
+
+// Runner runs the media tools. ExecRunner is used unless another runner is assigned to Tools.
+type Runner interface {
+	// Run runs cmd until it exits or ctx is done.
+	Run(ctx context.Context, cmd Command) error
+	// Available reports whether the tool can be run.
+	Available(name string) bool
+}
+
+var Tools Runner = ExecRunner{}
+
+// toolPath returns the binary of the tool set in MEDIA.<TOOL>_PATH, defaulting to the tool's name looked up in PATH.
+func toolPath(name string) string {
+	return settings.Get("MEDIA."+strings.ToUpper(name)+"_PATH", name).String()
+}
+
+// ExecRunner runs the tools as child processes. The binaries are set by MEDIA.FFMPEG_PATH and MEDIA.FFPROBE_PATH.
+//
+// Every tool runs in its own process group, which is killed as a whole once ctx is done. ffmpeg is capped to
+// MEDIA.FFMPEG_THREADS threads, and every tool runs with the priority set by MEDIA.NICE and the I/O scheduling
+// class set by MEDIA.IONICE_CLASS where supported. Only the end of standard error is kept for the error message.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, c Command) error {
+	var args = c.Args
+	if c.Name == "ffmpeg" {
+		args = threadArgs(args)
+	}
+	var command = append(priorityArgs(), toolPath(c.Name))
+	cmd := exec.CommandContext(ctx, command[0], append(command[1:], args...)...)
+	configureProcess(cmd)
+	cmd.WaitDelay = 5 * time.Second
+	var stderr = &tailBuffer{limit: stderrLimit}
+	if c.Stdout != nil {
+		cmd.Stdout = c.Stdout
+	}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cmd failed: %v - stderr: %s", err, stderr.String())
+	}
+	return nil
+}
+
+func (ExecRunner) Available(name string) bool {
+	_, err := exec.LookPath(toolPath(name))
+	return err == nil
+}
+
+// RecordingRunner records the commands it is given instead of running them, for tests and dry runs.
+// Handle, if set, decides the outcome of each command, for example by writing canned ffprobe output to
+// cmd.Stdout, creating the output file, or passing the command on to ExecRunner.
+type RecordingRunner struct {
+	Handle   func(ctx context.Context, cmd Command) error
+	mu       sync.Mutex
+	commands []Command
+}
+
+func (r *RecordingRunner) Run(ctx context.Context, cmd Command) error {
+	r.mu.Lock()
+	cmd.Args = append([]string{}, cmd.Args...)
+	r.commands = append(r.commands, cmd)
+	r.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if r.Handle != nil {
+		return r.Handle(ctx, cmd)
+	}
+	return nil
+}
+
+func (r *RecordingRunner) Available(name string) bool {
+	return true
+}
+
+// Commands returns the commands run so far, in order.
+func (r *RecordingRunner) Commands() []Command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Command{}, r.commands...)
+}
+
+// Reset forgets the recorded commands.
+func (r *RecordingRunner) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = nil
+}
@@ -0,0 +1,266 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/settings"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTools replaces the media tools with a RecordingRunner running handle, with ffprobe reported as
+// available, until the test ends.
+func fakeTools(t *testing.T, handle func(ctx context.Context, cmd Command) error) *RecordingRunner {
+	t.Helper()
+	var tools, available = Tools, ffprobeAvailable
+	t.Cleanup(func() {
+		Tools, ffprobeAvailable = tools, available
+	})
+	var runner = &RecordingRunner{Handle: handle}
+	Tools, ffprobeAvailable = runner, func() bool { return true }
+	return runner
+}
+
+// answer handles every command by writing stdout to its standard output, if it is read.
+func answer(stdout string) func(ctx context.Context, cmd Command) error {
+	return func(ctx context.Context, cmd Command) error {
+		if cmd.Stdout == nil {
+			return nil
+		}
+		_, err := io.WriteString(cmd.Stdout, stdout)
+		return err
+	}
+}
+
+// fakeOutputs handles ffprobe by answering probe and ffmpeg by writing the files it would have written:
+// its output and, for HLS playlists, a first segment.
+func fakeOutputs(probe string) func(ctx context.Context, cmd Command) error {
+	return func(ctx context.Context, cmd Command) error {
+		if cmd.Name == "ffprobe" {
+			return answer(probe)(ctx, cmd)
+		}
+		var output = cmd.Args[len(cmd.Args)-1]
+		if strings.HasSuffix(output, ".m3u8") {
+			if err := os.WriteFile(filepath.Join(filepath.Dir(output), "segment_00000.ts"), nil, 0644); err != nil {
+				return err
+			}
+		}
+		return os.WriteFile(output, []byte(cmd.String()), 0644)
+	}
+}
+
+// assertArgs compares the arguments of cmd with expected, where an expected "*" matches any argument.
+func assertArgs(t *testing.T, cmd Command, name string, expected ...string) {
+	t.Helper()
+	var matches = cmd.Name == name && len(cmd.Args) == len(expected)
+	for i := 0; matches && i < len(expected); i++ {
+		matches = expected[i] == "*" || expected[i] == cmd.Args[i]
+	}
+	if !matches {
+		t.Fatalf("ran %s\nexpected %s %s", cmd, name, strings.Join(expected, " "))
+	}
+}
+
+// localVideo stores a video file and returns its media and the local path tools are given.
+func localVideo(t *testing.T, duration int64) (*Media, string) {
+	t.Helper()
+	file, checksum, size, err := SaveTemp(strings.NewReader(fmt.Sprintf("a video of %d seconds", duration)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var media = Media{Filename: "clip.mp4", Type: "video", FileSize: size, Duration: duration, ScreenSize: "1280x720"}
+	if err = StoreBlob(&media, file, checksum); err != nil {
+		t.Fatal(err)
+	}
+	input, err := Store.(LocalPather).LocalPath(media.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &media, input
+}
+
+func TestVideoInfoArgs(t *testing.T) {
+	var runner = fakeTools(t, answer(`{"streams":[{"width":1920,"height":1080,"display_aspect_ratio":"16:9"}],"format":{"duration":"12.5"}}`))
+	info, err := videoInfo(context.Background(), "/in/clip.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 1920 || info.Height != 1080 || info.Duration != 12.5 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	var commands = runner.Commands()
+	if len(commands) != 1 || commands[0].Op != OpProbe {
+		t.Fatalf("unexpected commands %v", commands)
+	}
+	assertArgs(t, commands[0], "ffprobe",
+		"-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height,display_aspect_ratio",
+		"-show_entries", "format=duration",
+		"-of", "json", "/in/clip.mp4")
+}
+
+func TestPreviewStepArgs(t *testing.T) {
+	setupTest(t)
+	var runner = fakeTools(t, fakeOutputs(""))
+
+	// short videos: the beginning, as long as all clips together
+	media, input := localVideo(t, 10)
+	if err := (PreviewStep{Clips: 4, ClipDuration: 2.5, Height: 480}).Run(media); err != nil {
+		t.Fatal(err)
+	}
+	var commands = runner.Commands()
+	if len(commands) != 1 || commands[0].Op != OpPreview {
+		t.Fatalf("unexpected commands %v", commands)
+	}
+	assertArgs(t, commands[0], "ffmpeg", "-progress", "pipe:1", "-nostats",
+		"-y", "-ss", "0.00", "-t", "10.00", "-i", input, "-an", "-vf", "scale=-2:480",
+		"-c:v", "libx264", "-preset", "fast", "*")
+	if output := commands[0].Args[len(commands[0].Args)-1]; !strings.HasPrefix(output, TemporaryDir) || filepath.Base(output) != "preview.mp4" {
+		t.Fatalf("unexpected output %s", output)
+	}
+
+	// longer videos: a clip out of every part but the first, then concatenated and re-encoded
+	runner.Reset()
+	media, input = localVideo(t, 100)
+	if err := (PreviewStep{Clips: 4, ClipDuration: 2, Height: 360}).Run(media); err != nil {
+		t.Fatal(err)
+	}
+	commands = runner.Commands()
+	if len(commands) != 6 {
+		t.Fatalf("expected 4 clips, a concat and a finalize, got %v", commands)
+	}
+	var starts []string
+	for _, cmd := range commands[:4] {
+		assertArgs(t, cmd, "ffmpeg", "-progress", "pipe:1", "-nostats",
+			"-y", "-ss", "*", "-t", "2.00", "-i", input, "-an", "-vf", "scale=-2:360",
+			"-c:v", "libx264", "-preset", "fast", "*")
+		starts = append(starts, cmd.Args[5])
+	}
+	// the clips are extracted concurrently
+	slices.Sort(starts)
+	if !slices.Equal(starts, []string{"20.00", "40.00", "60.00", "80.00"}) {
+		t.Fatalf("unexpected clip starts %v", starts)
+	}
+	assertArgs(t, commands[4], "ffmpeg", "-y", "-f", "concat", "-safe", "0", "-i", "*", "-c", "copy", "*")
+	assertArgs(t, commands[5], "ffmpeg", "-progress", "pipe:1", "-nostats",
+		"-y", "-i", commands[4].Args[len(commands[4].Args)-1], "-an", "-vf", "scale=-2:360",
+		"-c:v", "libx264", "-preset", "fast", "*")
+}
+
+func TestThumbnailStepArgs(t *testing.T) {
+	setupTest(t)
+	var runner = fakeTools(t, fakeOutputs(""))
+	for _, test := range []struct {
+		step  ThumbnailStep
+		scale []string
+	}{
+		{ThumbnailStep{Position: 50, Height: 720}, []string{"-vf", "scale=-1:720"}},
+		{ThumbnailStep{Position: 150, Width: 320}, []string{"-vf", "scale=320:-1"}},
+		{ThumbnailStep{Position: 25, Width: 320, Height: 180}, []string{"-vf", "scale=320:180"}},
+		{ThumbnailStep{Position: -5}, nil},
+	} {
+		runner.Reset()
+		media, input := localVideo(t, 40)
+		if err := test.step.Run(media); err != nil {
+			t.Fatal(err)
+		}
+		var commands = runner.Commands()
+		if len(commands) != 1 || commands[0].Op != OpThumbnail {
+			t.Fatalf("unexpected commands %v", commands)
+		}
+		var position = map[float64]string{50: "20.00", 150: "40.00", 25: "10.00", -5: "0.00"}[test.step.Position]
+		var expected = append([]string{"-y", "-ss", position, "-i", input, "-vframes", "1", "-q:v", "2"}, test.scale...)
+		assertArgs(t, commands[0], "ffmpeg", append(expected, "*")...)
+	}
+}
+
+func TestStreamingArgs(t *testing.T) {
+	var runner = fakeTools(t, answer(""))
+	if err := ffmpegRendition(context.Background(), "/in/clip.mp4", "/out/720p.mp4", rendition(720), nil); err != nil {
+		t.Fatal(err)
+	}
+	assertArgs(t, runner.Commands()[0], "ffmpeg",
+		"-y", "-i", "/in/clip.mp4", "-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", "scale=-2:720", "-c:v", "libx264", "-preset", "fast",
+		"-b:v", "2800k", "-maxrate", "2800k", "-bufsize", "5600k",
+		"-g", "48", "-keyint_min", "48", "-sc_threshold", "0",
+		"-c:a", "aac", "-b:a", "128k", "-movflags", "+faststart", "/out/720p.mp4")
+
+	runner.Reset()
+	if err := ffmpegHLS(context.Background(), "/out/720p.mp4", "/out/hls/720p"); err != nil {
+		t.Fatal(err)
+	}
+	assertArgs(t, runner.Commands()[0], "ffmpeg",
+		"-y", "-i", "/out/720p.mp4", "-c", "copy", "-f", "hls", "-hls_time", "6", "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join("/out/hls/720p", "segment_%05d.ts"), filepath.Join("/out/hls/720p", "index.m3u8"))
+
+	// ffprobe finding an audio stream in the first rendition adds it as its own adaptation set
+	for stdout, audio := range map[string][]string{"1\n": {"-map", "0:a:0"}, "": nil} {
+		runner = fakeTools(t, answer(stdout))
+		if err := ffmpegDASH(context.Background(), []string{"/out/360p.mp4", "/out/720p.mp4"}, "/out/dash"); err != nil {
+			t.Fatal(err)
+		}
+		var commands = runner.Commands()
+		if len(commands) != 2 || commands[0].Name != "ffprobe" || commands[0].Args[len(commands[0].Args)-1] != "/out/360p.mp4" {
+			t.Fatalf("unexpected commands %v", commands)
+		}
+		var sets = "id=0,streams=v"
+		if audio != nil {
+			sets += " id=1,streams=a"
+		}
+		var expected = append([]string{"-y", "-i", "/out/360p.mp4", "-i", "/out/720p.mp4", "-map", "0:v:0", "-map", "1:v:0"}, audio...)
+		assertArgs(t, commands[1], "ffmpeg", append(expected,
+			"-c", "copy", "-f", "dash", "-seg_duration", "6", "-use_template", "1", "-use_timeline", "1",
+			"-init_seg_name", "init-$RepresentationID$.m4s", "-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+			"-adaptation_sets", sets, filepath.Join("/out/dash", "manifest.mpd"))...)
+	}
+}
+
+func TestThreadArgs(t *testing.T) {
+	var args = []string{"-y", "-i", "in.mp4", "-c:v", "libx264", "out.mp4"}
+	t.Cleanup(func() {
+		settings.Set("MEDIA.FFMPEG_THREADS", 0)
+	})
+	settings.Set("MEDIA.FFMPEG_THREADS", 0)
+	if result := threadArgs(args); !slices.Equal(result, args) {
+		t.Fatalf("without a cap the arguments should be kept, got %v", result)
+	}
+	settings.Set("MEDIA.FFMPEG_THREADS", 2)
+	var expected = []string{"-filter_threads", "2", "-y", "-i", "in.mp4", "-c:v", "libx264", "-threads", "2", "out.mp4"}
+	if result := threadArgs(args); !slices.Equal(result, expected) {
+		t.Fatalf("got %v, expected %v", result, expected)
+	}
+	if !slices.Equal(args, []string{"-y", "-i", "in.mp4", "-c:v", "libx264", "out.mp4"}) {
+		t.Fatalf("the arguments were modified: %v", args)
+	}
+}
+
+func TestRunFFmpegProgress(t *testing.T) {
+	var runner = fakeTools(t, answer("frame=10\nout_time=00:00:01.500000\nprogress=continue\nout_time=00:01:02.250000\nprogress=end\n"))
+	var positions []time.Duration
+	if err := runFFmpeg(context.Background(), OpTranscode, []string{"-i", "in.mp4", "out.mp4"}, func(position time.Duration) {
+		positions = append(positions, position)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertArgs(t, runner.Commands()[0], "ffmpeg", "-progress", "pipe:1", "-nostats", "-i", "in.mp4", "out.mp4")
+	if !slices.Equal(positions, []time.Duration{1500 * time.Millisecond, 62250 * time.Millisecond}) {
+		t.Fatalf("unexpected positions %v", positions)
+	}
+
+	// without a progress callback ffmpeg's standard output is not read
+	runner.Reset()
+	if err := runFFmpeg(context.Background(), OpTranscode, []string{"-i", "in.mp4", "out.mp4"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var cmd = runner.Commands()[0]
+	if cmd.Stdout != nil {
+		t.Fatalf("standard output should not be captured")
+	}
+	assertArgs(t, cmd, "ffmpeg", "-i", "in.mp4", "out.mp4")
+}
@@ -1,6 +1,9 @@
 package media
 
-import "encoding/xml"
+import (
+	"encoding/xml"
+	"time"
+)
 
 // InitiateMultipartUploadResult represents the XML structure.
 type InitiateMultipartUploadResult struct {
@@ -31,6 +34,120 @@ type Part struct {
 	ETag       string `xml:"ETag"`
 }
 
+// CompleteMultipartUploadResult represents the XML structure returned once a multipart upload is assembled.
+type CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func (v CompleteMultipartUploadResult) String() string {
+	output, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return ""
+	}
+
+	return xml.Header + string(output)
+}
+
+// ListPartsResult represents the XML structure returned when listing the parts of a multipart upload.
+type ListPartsResult struct {
+	XMLName              xml.Name       `xml:"ListPartsResult"`
+	Bucket               string         `xml:"Bucket"`
+	Key                  string         `xml:"Key"`
+	UploadID             string         `xml:"UploadId"`
+	PartNumberMarker     int            `xml:"PartNumberMarker"`
+	NextPartNumberMarker int            `xml:"NextPartNumberMarker"`
+	MaxParts             int            `xml:"MaxParts"`
+	IsTruncated          bool           `xml:"IsTruncated"`
+	Parts                []UploadedPart `xml:"Part"`
+}
+
+func (v ListPartsResult) String() string {
+	output, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return ""
+	}
+
+	return xml.Header + string(output)
+}
+
+// UploadedPart represents a part already received by the server.
+type UploadedPart struct {
+	PartNumber   int       `xml:"PartNumber"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+}
+
+// ListMultipartUploadsResult represents the XML structure returned when listing the uploads in progress.
+type ListMultipartUploadsResult struct {
+	XMLName            xml.Name          `xml:"ListMultipartUploadsResult"`
+	Bucket             string            `xml:"Bucket"`
+	Prefix             string            `xml:"Prefix"`
+	KeyMarker          string            `xml:"KeyMarker"`
+	UploadIDMarker     string            `xml:"UploadIdMarker"`
+	NextKeyMarker      string            `xml:"NextKeyMarker"`
+	NextUploadIDMarker string            `xml:"NextUploadIdMarker"`
+	MaxUploads         int               `xml:"MaxUploads"`
+	IsTruncated        bool              `xml:"IsTruncated"`
+	Uploads            []MultipartUpload `xml:"Upload"`
+}
+
+func (v ListMultipartUploadsResult) String() string {
+	output, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return ""
+	}
+
+	return xml.Header + string(output)
+}
+
+// MultipartUpload represents an upload that has been initiated but not completed or aborted.
+type MultipartUpload struct {
+	Key       string    `xml:"Key"`
+	UploadID  string    `xml:"UploadId"`
+	Initiated time.Time `xml:"Initiated"`
+}
+
+// ListBucketResult represents the XML structure returned by ListObjectsV2.
+type ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Contents              []Object `xml:"Contents"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+}
+
+// Object represents a single object of a bucket listing.
+type Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+}
+
+// S3Error represents the XML error document returned by S3-compatible servers.
+type S3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func (e S3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e S3Error) String() string {
+	output, err := xml.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return ""
+	}
+
+	return xml.Header + string(output)
+}
+
 // FileInfo holds the detected file type and MIME type
 type FileInfo struct {
 	Type     string // one of: image, video, audio, document
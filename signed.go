@@ -0,0 +1,96 @@
+package media
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/settings"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSigningKeyMissing = errors.New("MEDIA.SIGNING_KEY is not configured")
+	ErrSignatureExpired  = errors.New("signature expired")
+	ErrSignatureInvalid  = errors.New("invalid signature")
+)
+
+// SignedURL returns a delivery URL for a variant of the media that stays valid for ttl.
+func (m *Media) SignedURL(variant string, ttl time.Duration) (string, error) {
+	return m.signURL(variant, ttl, "")
+}
+
+// SignedURLForIP is like SignedURL but the URL is only accepted from the given client IP.
+func (m *Media) SignedURLForIP(variant string, ttl time.Duration, ip string) (string, error) {
+	return m.signURL(variant, ttl, ip)
+}
+
+func (m *Media) signURL(variant string, ttl time.Duration, ip string) (string, error) {
+	if variant == "" {
+		variant = "original"
+	}
+	var expires = time.Now().Add(ttl).Unix()
+	signature, err := signParams(m.signatureParams(variant, expires, ip)...)
+	if err != nil {
+		return "", err
+	}
+
+	var query = url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", signature)
+	if ip != "" {
+		query.Set("bind_ip", "1")
+	}
+	return fmt.Sprintf("%s/media/%d/%s?%s", settings.Get("MEDIA.BASE_URL").String(), m.MediaID, variant, query.Encode()), nil
+}
+
+// VerifySignature checks a signature issued by SignedURL for the variant.
+// ip is the address of the client and is only compared if the URL was bound to an IP.
+func (m *Media) VerifySignature(variant string, expires int64, signature string, bindIP bool, ip string) error {
+	if variant == "" {
+		variant = "original"
+	}
+	if time.Now().Unix() > expires {
+		return ErrSignatureExpired
+	}
+	if !bindIP {
+		ip = ""
+	}
+	expected, err := signParams(m.signatureParams(variant, expires, ip)...)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+// RevokeSignatures invalidates every signed URL issued for the media so far.
+func (m *Media) RevokeSignatures() error {
+	m.SignatureVersion++
+	return db.Model(m).Update("signature_version", m.SignatureVersion).Error
+}
+
+func (m *Media) signatureParams(variant string, expires int64, ip string) []string {
+	return []string{
+		strconv.FormatInt(m.MediaID, 10),
+		variant,
+		strconv.FormatInt(expires, 10),
+		strconv.Itoa(m.SignatureVersion),
+		ip,
+	}
+}
+
+// signParams computes the HMAC-SHA256 of params with MEDIA.SIGNING_KEY.
+func signParams(params ...string) (string, error) {
+	var key = settings.Get("MEDIA.SIGNING_KEY").String()
+	if key == "" {
+		return "", ErrSigningKeyMissing
+	}
+	return hex.EncodeToString(hmacSHA256([]byte(key), strings.Join(params, "\n"))), nil
+}
@@ -0,0 +1,275 @@
+package media
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// formUpload posts content as the file field of a multipart form together with fields.
+func formUpload(t *testing.T, target, filename string, content []byte, fields map[string]string) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	var form = multipart.NewWriter(&body)
+	for k, v := range fields {
+		if err := form.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+	var req = httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return testRequest(t, req)
+}
+
+// responseMedia decodes the media a handler answered with.
+func responseMedia(t *testing.T, resp *http.Response) Media {
+	t.Helper()
+	var result struct {
+		Data Media `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result.Data
+}
+
+// relativeURL strips MEDIA.BASE_URL from a signed URL so it can be sent through testRequest.
+func relativeURL(link string) string {
+	return strings.TrimPrefix(link, settings.Get("MEDIA.BASE_URL").String())
+}
+
+func TestSignedURL(t *testing.T) {
+	settings.Set("MEDIA.SIGNING_KEY", "test-key")
+	var media = Media{MediaID: 7}
+	var verify = func(link, variant, ip string) error {
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var query = u.Query()
+		var expires, _ = strconv.ParseInt(query.Get("expires"), 10, 64)
+		return media.VerifySignature(variant, expires, query.Get("signature"), query.Has("bind_ip"), ip)
+	}
+
+	link, err := media.SignedURL("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(strings.Split(link, "?")[0], "/media/7/original") {
+		t.Fatalf("unexpected URL %s", link)
+	}
+	if err = verify(link, "original", "10.0.0.1"); err != nil {
+		t.Fatalf("valid URL rejected: %v", err)
+	}
+	if err = verify(link, "", ""); err != nil {
+		t.Fatalf("the empty variant is the original: %v", err)
+	}
+	if err = verify(link, "preview", ""); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("other variant: expected ErrSignatureInvalid, got %v", err)
+	}
+	if err = verify(strings.Replace(link, "expires=", "expires=1", 1), "original", ""); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("extended expiry: expected ErrSignatureInvalid, got %v", err)
+	}
+	if err = (&Media{MediaID: 8}).VerifySignature("original", time.Now().Add(time.Hour).Unix(), "00", false, ""); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("bad signature: expected ErrSignatureInvalid, got %v", err)
+	}
+
+	link, _ = media.SignedURL("thumbnail", -time.Minute)
+	if err = verify(link, "thumbnail", ""); !errors.Is(err, ErrSignatureExpired) {
+		t.Fatalf("expected ErrSignatureExpired, got %v", err)
+	}
+
+	link, _ = media.SignedURLForIP("preview", time.Hour, "10.0.0.1")
+	if err = verify(link, "preview", "10.0.0.1"); err != nil {
+		t.Fatalf("bound IP rejected: %v", err)
+	}
+	if err = verify(link, "preview", "10.0.0.2"); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("other IP: expected ErrSignatureInvalid, got %v", err)
+	}
+	if err = verify(strings.Replace(link, "&bind_ip=1", "", 1), "preview", "10.0.0.2"); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("dropped IP binding: expected ErrSignatureInvalid, got %v", err)
+	}
+
+	settings.Set("MEDIA.SIGNING_KEY", "")
+	if _, err = media.SignedURL("", time.Hour); !errors.Is(err, ErrSigningKeyMissing) {
+		t.Fatalf("expected ErrSigningKeyMissing, got %v", err)
+	}
+	settings.Set("MEDIA.SIGNING_KEY", "test-key")
+}
+
+func TestRevokeSignatures(t *testing.T) {
+	setupTest(t)
+	settings.Set("MEDIA.SIGNING_KEY", "test-key")
+	var media = storeContent(t, "a.txt", "revocable")
+	link, err := media.SignedURL("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := testRequest(t, httptest.NewRequest(http.MethodGet, relativeURL(link), nil)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d before revoking", resp.StatusCode)
+	}
+
+	var target = "/admin/media/" + strconv.FormatInt(media.MediaID, 10) + "/revoke"
+	if resp := testRequest(t, httptest.NewRequest(http.MethodPost, target, nil)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke: status %d", resp.StatusCode)
+	}
+	var stored Media
+	db.Take(&stored, media.MediaID)
+	if stored.SignatureVersion != media.SignatureVersion+1 {
+		t.Fatalf("signature version %d, expected %d", stored.SignatureVersion, media.SignatureVersion+1)
+	}
+	if resp := testRequest(t, httptest.NewRequest(http.MethodGet, relativeURL(link), nil)); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status %d after revoking", resp.StatusCode)
+	}
+
+	// URLs issued afterwards work again
+	resp := testRequest(t, httptest.NewRequest(http.MethodGet, "/admin/media/"+strconv.FormatInt(media.MediaID, 10)+"/signed-url?ttl=1m", nil))
+	var result struct {
+		Data string `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if resp = testRequest(t, httptest.NewRequest(http.MethodGet, relativeURL(result.Data), nil)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d with a new URL", resp.StatusCode)
+	}
+}
+
+func TestDeliverySignatures(t *testing.T) {
+	setupTest(t)
+	settings.Set("MEDIA.SIGNING_KEY", "test-key")
+	var public, private = storeContent(t, "public.txt", "public"), storeContent(t, "private.txt", "private")
+	if err := db.Model(private).Update("private", true).Error; err != nil {
+		t.Fatal(err)
+	}
+	var target = func(media *Media) string {
+		return "/media/" + strconv.FormatInt(media.MediaID, 10)
+	}
+	var sign = func(media *Media, variant string, ttl time.Duration) string {
+		link, err := media.SignedURL(variant, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return relativeURL(link)
+	}
+	var signForIP = func(media *Media, ip string) string {
+		link, err := media.SignedURLForIP("", time.Hour, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return relativeURL(link)
+	}
+
+	var tests = []struct {
+		name, target string
+		status       int
+		cache        string
+	}{
+		{"public", target(public), http.StatusOK, ""},
+		{"public with a signature", sign(public, "", time.Hour), http.StatusOK, "private"},
+		{"public with a bad signature", target(public) + "?expires=9999999999&signature=00", http.StatusForbidden, ""},
+		{"private unsigned", target(private), http.StatusForbidden, ""},
+		{"private unsigned original", target(private) + "/original", http.StatusForbidden, ""},
+		{"private signed", sign(private, "", time.Hour), http.StatusOK, "private"},
+		{"private expired", sign(private, "", -time.Minute), http.StatusForbidden, ""},
+		{"private signed for another variant", strings.Replace(sign(private, "thumbnail", time.Hour), "/thumbnail", "/original", 1), http.StatusForbidden, ""},
+		{"private signed for another media", strings.Replace(sign(public, "", time.Hour), target(public), target(private), 1), http.StatusForbidden, ""},
+		// test requests come from 0.0.0.0
+		{"private bound to the client", signForIP(private, "0.0.0.0"), http.StatusOK, "private"},
+		{"private bound to another client", signForIP(private, "10.0.0.1"), http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := testRequest(t, httptest.NewRequest(http.MethodGet, test.target, nil))
+			if resp.StatusCode != test.status {
+				t.Fatalf("status %d, expected %d", resp.StatusCode, test.status)
+			}
+			if test.cache != "" && resp.Header.Get("Cache-Control") != test.cache {
+				t.Fatalf("Cache-Control %q, expected %q", resp.Header.Get("Cache-Control"), test.cache)
+			}
+		})
+	}
+}
+
+func TestUploadsCanBePrivate(t *testing.T) {
+	var content = testPNG(t)
+	var archive bytes.Buffer
+	var writer = zip.NewWriter(&archive)
+	entry, _ := writer.Create("dot.png")
+	entry.Write(content)
+	writer.Close()
+
+	var uploads = map[string]func(t *testing.T) int64{
+		"form": func(t *testing.T) int64 {
+			return responseMedia(t, formUpload(t, "/admin/media/upload", "dot.png", content, map[string]string{"private": "true"})).MediaID
+		},
+		"json": func(t *testing.T) int64 {
+			var req = httptest.NewRequest(http.MethodPost, "/admin/media/upload", strings.NewReader(
+				`{"filename": "dot.png", "base64": true, "private": true, "content": "`+base64.StdEncoding.EncodeToString(content)+`"}`))
+			req.Header.Set("Content-Type", "application/json")
+			return responseMedia(t, testRequest(t, req)).MediaID
+		},
+		"tus": func(t *testing.T) int64 {
+			resp := tusRequest(t, http.MethodPost, "/admin/media/tus/", string(content), map[string]string{
+				"Upload-Length":   strconv.Itoa(len(content)),
+				"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("dot.png")) + ",private " + base64.StdEncoding.EncodeToString([]byte("true")),
+				"Content-Type":    tusContentType,
+			})
+			id, _ := strconv.ParseInt(resp.Header.Get("X-Media-ID"), 10, 64)
+			return id
+		},
+		"multipart": func(t *testing.T) int64 {
+			var req = httptest.NewRequest(http.MethodPost, "/admin/media/multipart/upload/dot.png", nil)
+			req.Header.Set("X-File-Private", "true")
+			var initiated InitiateMultipartUploadResult
+			if err := xml.NewDecoder(testRequest(t, req).Body).Decode(&initiated); err != nil {
+				t.Fatal(err)
+			}
+			var etag = uploadPart(t, "dot.png", initiated.UploadID, 1, string(content))
+			id, _ := strconv.ParseInt(completeMultipart(t, "dot.png", initiated.UploadID, Part{PartNumber: 1, ETag: etag}).Header.Get("X-Media-ID"), 10, 64)
+			return id
+		},
+		"zip": func(t *testing.T) int64 {
+			resp := formUpload(t, "/admin/media/zip", "photos.zip", archive.Bytes(), map[string]string{"private": "true"})
+			var result struct {
+				Data ZipImportResult `json:"data"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || len(result.Data.Entries) != 1 {
+				t.Fatalf("unexpected result %+v: %v", result.Data, err)
+			}
+			return result.Data.Entries[0].MediaID
+		},
+	}
+	for name, upload := range uploads {
+		t.Run(name, func(t *testing.T) {
+			setupTest(t)
+			var id = upload(t)
+			var media Media
+			if db.Take(&media, id).RowsAffected == 0 {
+				t.Fatalf("no media was created")
+			}
+			if !media.Private {
+				t.Fatalf("the media is public")
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package media
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+)
+
+// sigV4Scope returns the credential scope for a request signed at date (YYYYMMDD).
+func sigV4Scope(date, region, service string) string {
+	return date + "/" + region + "/" + service + "/aws4_request"
+}
+
+// sigV4CanonicalRequest builds the canonical request of AWS Signature Version 4.
+// uri must already be URI encoded, header returns the value of a lower-cased header name.
+func sigV4CanonicalRequest(method, uri string, query url.Values, header func(name string) string, signedHeaders []string, payloadHash string) string {
+	if uri == "" {
+		uri = "/"
+	}
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		headers.WriteString(name)
+		headers.WriteByte(':')
+		headers.WriteString(strings.Join(strings.Fields(header(name)), " "))
+		headers.WriteByte('\n')
+	}
+	return strings.Join([]string{
+		method,
+		uri,
+		sigV4CanonicalQuery(query),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// sigV4CanonicalQuery sorts and encodes the query string, leaving out any signature parameter.
+func sigV4CanonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, sigV4Encode(key, true)+"="+sigV4Encode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// sigV4Signature signs the canonical request with the secret key.
+func sigV4Signature(secretKey, amzDate, scope, canonicalRequest string) string {
+	var stringToSign = sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	var parts = strings.Split(scope, "/")
+	var key = hmacSHA256([]byte("AWS4"+secretKey), parts[0])
+	for _, part := range parts[1:] {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// sigV4Encode URI encodes s the way AWS expects: every byte except the unreserved characters is escaped.
+func sigV4Encode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			sb.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,175 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrObjectNotFound is returned by storage drivers when the requested object does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// Storage is the backend finished media files are persisted to.
+// Paths are slash separated and relative to the root of the storage.
+type Storage interface {
+	// Put writes the content of reader to path, replacing any existing object.
+	Put(path string, reader io.Reader) error
+	// Get opens the object at path for reading.
+	Get(path string) (io.ReadCloser, error)
+	// OpenRange opens length bytes of the object starting at offset. A negative length reads until the end.
+	OpenRange(path string, offset, length int64) (io.ReadCloser, error)
+	// Stat returns information about the object at path.
+	Stat(path string) (*ObjectInfo, error)
+	// Delete removes the object at path. Deleting a missing object is not an error.
+	Delete(path string) error
+	// List returns every object stored under prefix.
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// FileStorage is implemented by drivers that can take over a local file
+// more efficiently than streaming it through Put, e.g. by renaming it.
+type FileStorage interface {
+	PutFile(path string, src string) error
+}
+
+// LocalPather is implemented by drivers whose objects already live on the local filesystem.
+type LocalPather interface {
+	LocalPath(path string) (string, error)
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	ETag    string    `json:"etag"`
+}
+
+// StorageDriver creates a Storage from the MEDIA.* settings.
+type StorageDriver func() (Storage, error)
+
+var storageDrivers = map[string]StorageDriver{
+	"local": func() (Storage, error) {
+		return NewLocalStorage(LocalUploadDir), nil
+	},
+	"s3": newS3Storage,
+}
+
+// Store is the storage selected by MEDIA.STORAGE.
+var Store Storage
+
+// RegisterStorage makes a storage driver selectable through MEDIA.STORAGE.
+func RegisterStorage(name string, driver StorageDriver) {
+	storageDrivers[name] = driver
+}
+
+// NewStorage creates a storage using the driver registered under name.
+func NewStorage(name string) (Storage, error) {
+	driver, ok := storageDrivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage driver: %s", name)
+	}
+	return driver()
+}
+
+// StoreFile moves a local file into the storage at path.
+func StoreFile(path, src string) error {
+	if s, ok := Store.(FileStorage); ok {
+		return s.PutFile(path, src)
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	err = Store.Put(path, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// StoreDir moves every file below the local directory dir into the storage under prefix, after deleting the
+// objects under prefix that dir does not have, e.g. left behind by an interrupted run. Files named in last,
+// relative to dir, are stored after all others, so a manifest only shows up once everything it references is stored.
+func StoreDir(prefix, dir string, last ...string) error {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stored, err := Store.List(prefix + "/")
+	if err != nil {
+		return err
+	}
+	for _, object := range stored {
+		if !slices.Contains(files, strings.TrimPrefix(object.Path, prefix+"/")) {
+			if err = Store.Delete(object.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return !slices.Contains(last, files[i]) && slices.Contains(last, files[j])
+	})
+	for _, file := range files {
+		if err = StoreFile(path.Join(prefix, file), filepath.Join(dir, filepath.FromSlash(file))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FetchFile returns a local path holding the object at path so it can be handed to tools like ffmpeg.
+// Objects of remote storages are downloaded into TemporaryDir; cleanup removes such copies.
+func FetchFile(path string) (string, func(), error) {
+	var cleanup = func() {}
+	if s, ok := Store.(LocalPather); ok {
+		p, err := s.LocalPath(path)
+		return p, cleanup, err
+	}
+
+	reader, err := Store.Get(path)
+	if err != nil {
+		return "", cleanup, err
+	}
+	defer reader.Close()
+
+	f, err := os.CreateTemp(TemporaryDir, "fetch-*")
+	if err != nil {
+		return "", cleanup, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer f.Close()
+	cleanup = func() {
+		_ = os.Remove(f.Name())
+	}
+
+	if _, err = io.Copy(f, reader); err != nil {
+		cleanup()
+		return "", func() {}, fmt.Errorf("failed to download %s: %w", path, err)
+	}
+
+	local, err := getPath(f.Name())
+	return local, cleanup, err
+}
@@ -0,0 +1,149 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStorage keeps media files in a directory of the local filesystem.
+type LocalStorage struct {
+	Root string
+}
+
+// NewLocalStorage returns a storage rooted at dir.
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{Root: dir}
+}
+
+// resolve maps a storage path to a filesystem path that cannot escape Root.
+func (s *LocalStorage) resolve(p string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+func (s *LocalStorage) Put(p string, reader io.Reader) error {
+	var dst = s.resolve(p)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	// write next to the destination and rename so readers never see a partial file
+	f, err := os.CreateTemp(filepath.Dir(dst), ".put-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	if _, err = io.Copy(f, reader); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	_ = os.Chmod(f.Name(), 0644)
+	if err = os.Rename(f.Name(), dst); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to rename: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) PutFile(p string, src string) error {
+	return MoveFile(src, s.resolve(p))
+}
+
+func (s *LocalStorage) Get(p string) (io.ReadCloser, error) {
+	f, err := os.Open(s.resolve(p))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	return f, err
+}
+
+func (s *LocalStorage) OpenRange(p string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.resolve(p))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (s *LocalStorage) Stat(p string) (*ObjectInfo, error) {
+	stat, err := os.Stat(s.resolve(p))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+	return &ObjectInfo{
+		Path:    strings.TrimPrefix(path.Clean("/"+p), "/"),
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+	}, nil
+}
+
+func (s *LocalStorage) Delete(p string) error {
+	err := os.Remove(s.resolve(p))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) List(prefix string) ([]ObjectInfo, error) {
+	var root = s.resolve(prefix)
+	var objects []ObjectInfo
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.Root, p)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return objects, err
+}
+
+func (s *LocalStorage) LocalPath(p string) (string, error) {
+	return getPath(s.resolve(p))
+}
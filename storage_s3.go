@@ -0,0 +1,291 @@
+package media
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/settings"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const minS3PartSize = 5 * 1024 * 1024
+
+// S3Storage keeps media files in a bucket of an S3-compatible object storage.
+type S3Storage struct {
+	Endpoint  string // e.g. https://s3.eu-central-1.amazonaws.com or http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool  // address the bucket in the path instead of the host name
+	PartSize  int64 // objects larger than this are sent as multipart uploads
+	Client    *http.Client
+}
+
+// newS3Storage creates an S3Storage from the MEDIA.S3_* settings.
+func newS3Storage() (Storage, error) {
+	var s = &S3Storage{
+		Endpoint:  settings.Get("MEDIA.S3_ENDPOINT").String(),
+		Region:    settings.Get("MEDIA.S3_REGION", "us-east-1").String(),
+		Bucket:    settings.Get("MEDIA.S3_BUCKET").String(),
+		AccessKey: settings.Get("MEDIA.S3_ACCESS_KEY").String(),
+		SecretKey: settings.Get("MEDIA.S3_SECRET_KEY").String(),
+		PathStyle: settings.Get("MEDIA.S3_PATH_STYLE").Bool(),
+		PartSize:  int64(settings.Get("MEDIA.S3_PART_SIZE", "16mb").SizeInBytes()),
+	}
+	if s.Endpoint == "" || s.Bucket == "" {
+		return nil, errors.New("MEDIA.S3_ENDPOINT and MEDIA.S3_BUCKET are required by the s3 storage")
+	}
+	return s, nil
+}
+
+func (s *S3Storage) Put(key string, reader io.Reader) error {
+	var partSize = s.PartSize
+	if partSize < minS3PartSize {
+		partSize = minS3PartSize
+	}
+	var buf = make([]byte, partSize)
+	n, err := io.ReadFull(reader, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := s.do(http.MethodPut, key, nil, buf[:n], nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// object does not fit in a single part, switch to a multipart upload
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var initiate InitiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&initiate)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to parse multipart upload response: %w", err)
+	}
+
+	var complete CompleteMultipartUpload
+	for {
+		var part = Part{PartNumber: len(complete.Parts) + 1}
+		resp, err = s.do(http.MethodPut, key, url.Values{
+			"partNumber": {strconv.Itoa(part.PartNumber)},
+			"uploadId":   {initiate.UploadID},
+		}, buf[:n], nil)
+		if err != nil {
+			s.abort(key, initiate.UploadID)
+			return err
+		}
+		resp.Body.Close()
+		part.ETag = resp.Header.Get("ETag")
+		complete.Parts = append(complete.Parts, part)
+
+		n, err = io.ReadFull(reader, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			s.abort(key, initiate.UploadID)
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		s.abort(key, initiate.UploadID)
+		return err
+	}
+	resp, err = s.do(http.MethodPost, key, url.Values{"uploadId": {initiate.UploadID}}, body, nil)
+	if err != nil {
+		s.abort(key, initiate.UploadID)
+		return err
+	}
+	defer resp.Body.Close()
+
+	// CompleteMultipartUpload may report a failure with a 200 status
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var s3err S3Error
+	if xml.Unmarshal(result, &s3err) == nil && s3err.Code != "" {
+		return s3err
+	}
+	return nil
+}
+
+func (s *S3Storage) abort(key, uploadID string) {
+	resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	return s.OpenRange(key, 0, -1)
+}
+
+func (s *S3Storage) OpenRange(key string, offset, length int64) (io.ReadCloser, error) {
+	var headers map[string]string
+	switch {
+	case length == 0:
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	case length > 0:
+		headers = map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}
+	case offset > 0:
+		headers = map[string]string{"Range": fmt.Sprintf("bytes=%d-", offset)}
+	}
+	resp, err := s.do(http.MethodGet, key, nil, nil, headers)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Stat(key string) (*ObjectInfo, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	var info = ObjectInfo{
+		Path: key,
+		Size: resp.ContentLength,
+		ETag: strings.Trim(resp.Header.Get("ETag"), `"`),
+	}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &info, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	var query = url.Values{
+		"list-type": {"2"},
+		"prefix":    {strings.TrimPrefix(prefix, "/")},
+	}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bucket listing: %w", err)
+		}
+		for _, object := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Path:    object.Key,
+				Size:    object.Size,
+				ModTime: object.LastModified,
+				ETag:    strings.Trim(object.ETag, `"`),
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends a signed request for key and turns error responses into errors.
+func (s *S3Storage) do(method, key string, query url.Values, body []byte, headers map[string]string) (*http.Response, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	key = strings.TrimPrefix(path.Clean("/"+key), "/")
+	var uri = "/" + sigV4Encode(key, false)
+	if s.PathStyle {
+		uri = "/" + sigV4Encode(s.Bucket, true) + uri
+	} else {
+		endpoint.Host = s.Bucket + "." + endpoint.Host
+	}
+	endpoint.Path, _ = url.PathUnescape(uri)
+	endpoint.RawPath = uri
+	endpoint.RawQuery = sigV4CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	s.sign(req, uri, query, body, time.Now())
+
+	var client = s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrObjectNotFound
+	}
+	var s3err S3Error
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &s3err) == nil && s3err.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s failed: %w", method, key, s3err)
+	}
+	return nil, fmt.Errorf("s3 %s %s failed: %s", method, key, resp.Status)
+}
+
+func (s *S3Storage) sign(req *http.Request, uri string, query url.Values, body []byte, now time.Time) {
+	var amzDate = now.UTC().Format(sigV4TimeFormat)
+	var payloadHash = sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var signedHeaders = []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Range") != "" {
+		signedHeaders = append(signedHeaders, "range")
+	}
+	sort.Strings(signedHeaders)
+
+	var header = func(name string) string {
+		if name == "host" {
+			return req.URL.Host
+		}
+		return req.Header.Get(name)
+	}
+	var scope = sigV4Scope(amzDate[:8], s.Region, "s3")
+	var canonical = sigV4CanonicalRequest(req.Method, uri, query, header, signedHeaders, payloadHash)
+	var signature = sigV4Signature(s.SecretKey, amzDate, scope, canonical)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.AccessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
@@ -0,0 +1,186 @@
+package media
+
+import (
+	"fmt"
+	"github.com/getevo/evo/v2/lib/settings"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rendition is a single rung of an adaptive bitrate ladder.
+type Rendition struct {
+	Height       int    `json:"height" yaml:"height"`
+	VideoBitrate string `json:"video_bitrate" yaml:"video_bitrate"` // ffmpeg notation, e.g. 2800k
+	AudioBitrate string `json:"audio_bitrate" yaml:"audio_bitrate"`
+}
+
+// DefaultRenditions maps the common heights to their bitrates.
+var DefaultRenditions = map[int]Rendition{
+	240:  {Height: 240, VideoBitrate: "400k", AudioBitrate: "64k"},
+	360:  {Height: 360, VideoBitrate: "800k", AudioBitrate: "96k"},
+	480:  {Height: 480, VideoBitrate: "1400k", AudioBitrate: "128k"},
+	720:  {Height: 720, VideoBitrate: "2800k", AudioBitrate: "128k"},
+	1080: {Height: 1080, VideoBitrate: "5000k", AudioBitrate: "192k"},
+	1440: {Height: 1440, VideoBitrate: "8000k", AudioBitrate: "192k"},
+	2160: {Height: 2160, VideoBitrate: "14000k", AudioBitrate: "192k"},
+}
+
+// Ladder returns the renditions configured in MEDIA.HLS_LADDER as a comma separated list of heights.
+func Ladder() []Rendition {
+	var heights = strings.Split(settings.Get("MEDIA.HLS_LADDER", "360,720,1080").String(), ",")
+	var ladder []Rendition
+	for _, h := range heights {
+		height, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(h), "p")))
+		if err != nil || height <= 0 {
+			continue
+		}
+		ladder = append(ladder, rendition(height))
+	}
+	return ladder
+}
+
+// rendition returns the default rendition for height, estimating the bitrate of unusual heights.
+func rendition(height int) Rendition {
+	if r, ok := DefaultRenditions[height]; ok {
+		return r
+	}
+	return Rendition{
+		Height:       height,
+		VideoBitrate: fmt.Sprintf("%dk", height*height*5000/(1080*1080)+100),
+		AudioBitrate: "128k",
+	}
+}
+
+// fitLadder drops renditions taller than the source so videos are never upscaled.
+// If every rendition is taller, a single rendition at the source height is used.
+func fitLadder(ladder []Rendition, sourceHeight int) []Rendition {
+	var result []Rendition
+	for _, r := range ladder {
+		if sourceHeight == 0 || r.Height <= sourceHeight {
+			result = append(result, r)
+		}
+	}
+	if len(result) == 0 && sourceHeight > 0 {
+		result = append(result, rendition(sourceHeight-sourceHeight%2))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Height < result[j].Height
+	})
+	return result
+}
+
+// screenSize parses the WxH ScreenSize of media.
+func screenSize(media *Media) (int, int) {
+	var w, h int
+	_, _ = fmt.Sscanf(media.ScreenSize, "%dx%d", &w, &h)
+	return w, h
+}
+
+// bitrate converts ffmpeg bitrate notation into bits per second.
+func bitrate(s string) int {
+	var multiplier = 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier = 1000
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1000 * 1000
+	}
+	v, _ := strconv.Atoi(strings.TrimRight(s, "kM"))
+	return v * multiplier
+}
+
+// StreamingProfile selects the adaptive streaming formats a video is packaged into.
+type StreamingProfile struct {
+	Ladder []Rendition `json:"ladder" yaml:"ladder"`
+	HLS    bool        `json:"hls" yaml:"hls"`
+	DASH   bool        `json:"dash" yaml:"dash"`
+}
+
+// DefaultStreamingProfile returns the profile configured by MEDIA.HLS, MEDIA.DASH and MEDIA.HLS_LADDER.
+func DefaultStreamingProfile() StreamingProfile {
+	return StreamingProfile{
+		Ladder: Ladder(),
+		HLS:    settings.Get("MEDIA.HLS").Bool(),
+		DASH:   settings.Get("MEDIA.DASH").Bool(),
+	}
+}
+
+// PackageStreams encodes the video once per rendition of the profile and packages the
+// renditions into every format the profile enables, recording the manifests on media.
+// Formats already packaged from the same ladder for another media sharing the file are reused.
+func PackageStreams(media *Media, profile StreamingProfile) error {
+	if !profile.HLS && !profile.DASH {
+		return nil
+	}
+	width, height := screenSize(media)
+	var ladder = fitLadder(profile.Ladder, height)
+	if len(ladder) == 0 {
+		return fmt.Errorf("no renditions to package")
+	}
+	var prefix = path.Dir(derivativePath(media, ladder, "streams"))
+	var hls, dash = path.Join(prefix, "hls", "master.m3u8"), path.Join(prefix, "dash", "manifest.mpd")
+	if profile.HLS && derivativeExists(hls) {
+		media.HLS, profile.HLS = hls, false
+	}
+	if profile.DASH && derivativeExists(dash) {
+		media.DASH, profile.DASH = dash, false
+	}
+	if !profile.HLS && !profile.DASH {
+		reportProgress(media, 1)
+		return nil
+	}
+
+	input, cleanup, err := FetchFile(media.Path)
+	if err != nil {
+		return fmt.Errorf("failed to fetch input: %w", err)
+	}
+	defer cleanup()
+
+	tmpDir, err := os.MkdirTemp(TemporaryDir, "streams-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	var ctx = mediaContext(media)
+
+	// encoding is reported as the first 90% of the work, split evenly between the renditions
+	var renditions []string
+	for i, r := range ladder {
+		var output = filepath.Join(tmpDir, fmt.Sprintf("%dp.mp4", r.Height))
+		if err := ffmpegRendition(ctx, input, output, r, func(position time.Duration) {
+			reportProgress(media, (float64(i)+min(fractionOf(position, float64(media.Duration)), 1))/float64(len(ladder))*0.9)
+		}); err != nil {
+			return fmt.Errorf("failed to encode %dp: %w", r.Height, err)
+		}
+		renditions = append(renditions, output)
+	}
+
+	if profile.HLS {
+		var dir = filepath.Join(tmpDir, "hls")
+		if err := writeHLS(ctx, dir, renditions, ladder, width, height); err != nil {
+			return err
+		}
+		if err := StoreDir(path.Dir(hls), dir, path.Base(hls)); err != nil {
+			return fmt.Errorf("failed to store hls: %w", err)
+		}
+		media.HLS = hls
+		reportProgress(media, 0.95)
+	}
+	if profile.DASH {
+		var dir = filepath.Join(tmpDir, "dash")
+		if err := writeDASH(ctx, dir, renditions); err != nil {
+			return err
+		}
+		if err := StoreDir(path.Dir(dash), dir, path.Base(dash)); err != nil {
+			return fmt.Errorf("failed to store dash: %w", err)
+		}
+		media.DASH = dash
+	}
+	reportProgress(media, 1)
+	return nil
+}
@@ -0,0 +1,285 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const maxTransformDimension = 4096
+
+// ImageTransform describes how an image is resized and converted.
+type ImageTransform struct {
+	Width   int    `json:"w"`       // 0 keeps the aspect ratio
+	Height  int    `json:"h"`       // 0 keeps the aspect ratio
+	Fit     string `json:"fit"`     // cover, contain or fill
+	Format  string `json:"format"`  // jpeg, png or webp
+	Quality int    `json:"quality"` // 1-100
+}
+
+// ImagePresets are the transformations that may be requested without a signature.
+// Presets can be added in code or through MEDIA.IMAGE_PRESETS, a JSON object of name => query string.
+var ImagePresets = map[string]ImageTransform{
+	"thumbnail": {Width: 320, Height: 320, Fit: "cover", Format: "webp", Quality: 80},
+	"small":     {Width: 640, Fit: "contain", Format: "webp", Quality: 80},
+	"medium":    {Width: 1280, Fit: "contain", Format: "webp", Quality: 80},
+	"large":     {Width: 1920, Fit: "contain", Format: "jpeg", Quality: 85},
+}
+
+// CacheDir holds generated derivatives that can be rebuilt at any time.
+var CacheDir = ""
+
+// ParseImageTransform reads a transformation from the w, h, fit, format and q query parameters.
+func ParseImageTransform(query url.Values) (ImageTransform, error) {
+	var t = ImageTransform{
+		Fit:     query.Get("fit"),
+		Format:  query.Get("format"),
+		Quality: 80,
+	}
+	var err error
+	if v := query.Get("w"); v != "" {
+		if t.Width, err = strconv.Atoi(v); err != nil {
+			return t, fmt.Errorf("invalid width: %w", err)
+		}
+	}
+	if v := query.Get("h"); v != "" {
+		if t.Height, err = strconv.Atoi(v); err != nil {
+			return t, fmt.Errorf("invalid height: %w", err)
+		}
+	}
+	if v := query.Get("q"); v != "" {
+		if t.Quality, err = strconv.Atoi(v); err != nil {
+			return t, fmt.Errorf("invalid quality: %w", err)
+		}
+	}
+	if t.Fit == "" {
+		t.Fit = "contain"
+	}
+	if t.Format == "" {
+		t.Format = "jpeg"
+	}
+	return t, t.Validate()
+}
+
+// Validate checks the transformation is within the supported limits.
+func (t ImageTransform) Validate() error {
+	if t.Width < 0 || t.Height < 0 || t.Width > maxTransformDimension || t.Height > maxTransformDimension {
+		return fmt.Errorf("dimensions must be between 0 and %d", maxTransformDimension)
+	}
+	if t.Width == 0 && t.Height == 0 {
+		return errors.New("width or height is required")
+	}
+	if !slices.Contains([]string{"cover", "contain", "fill"}, t.Fit) {
+		return fmt.Errorf("unsupported fit: %s", t.Fit)
+	}
+	if (t.Fit == "cover" || t.Fit == "fill") && (t.Width == 0 || t.Height == 0) {
+		return fmt.Errorf("fit %s requires width and height", t.Fit)
+	}
+	if !slices.Contains([]string{"jpeg", "png", "webp"}, t.Format) {
+		return fmt.Errorf("unsupported format: %s", t.Format)
+	}
+	if t.Quality < 1 || t.Quality > 100 {
+		return errors.New("quality must be between 1 and 100")
+	}
+	return nil
+}
+
+// Encode returns the canonical query string of the transformation.
+func (t ImageTransform) Encode() string {
+	return fmt.Sprintf("w=%d&h=%d&fit=%s&format=%s&q=%d", t.Width, t.Height, t.Fit, t.Format, t.Quality)
+}
+
+// Extension returns the file extension of the output format.
+func (t ImageTransform) Extension() string {
+	if t.Format == "jpeg" {
+		return ".jpg"
+	}
+	return "." + t.Format
+}
+
+func (t ImageTransform) ffmpegArgs() []string {
+	var w, h = strconv.Itoa(t.Width), strconv.Itoa(t.Height)
+	if t.Width == 0 {
+		w = "-1"
+	}
+	if t.Height == 0 {
+		h = "-1"
+	}
+	var filter string
+	switch t.Fit {
+	case "cover":
+		filter = fmt.Sprintf("scale=%s:%s:force_original_aspect_ratio=increase,crop=%s:%s", w, h, w, h)
+	case "fill":
+		filter = fmt.Sprintf("scale=%s:%s", w, h)
+	default:
+		if t.Width > 0 && t.Height > 0 {
+			filter = fmt.Sprintf("scale=%s:%s:force_original_aspect_ratio=decrease", w, h)
+		} else {
+			filter = fmt.Sprintf("scale=%s:%s", w, h)
+		}
+	}
+
+	var args = []string{"-vf", filter, "-frames:v", "1"}
+	switch t.Format {
+	case "jpeg":
+		// map quality 1-100 onto the mjpeg scale 31-2
+		args = append(args, "-q:v", strconv.Itoa(2+(100-t.Quality)*29/100))
+	case "webp":
+		args = append(args, "-c:v", "libwebp", "-quality", strconv.Itoa(t.Quality))
+	}
+	return args
+}
+
+// TransformURL returns a URL for an arbitrary transformation of the media that stays valid for ttl.
+func (m *Media) TransformURL(t ImageTransform, ttl time.Duration) (string, error) {
+	return m.transformURL(t, ttl, "")
+}
+
+// TransformURLForIP is like TransformURL but the URL is only accepted from the given client IP.
+func (m *Media) TransformURLForIP(t ImageTransform, ttl time.Duration, ip string) (string, error) {
+	return m.transformURL(t, ttl, ip)
+}
+
+func (m *Media) transformURL(t ImageTransform, ttl time.Duration, ip string) (string, error) {
+	if err := t.Validate(); err != nil {
+		return "", err
+	}
+	var expires = time.Now().Add(ttl).Unix()
+	signature, err := signParams(m.signatureParams(transformVariant(t), expires, ip)...)
+	if err != nil {
+		return "", err
+	}
+	var query = "&expires=" + strconv.FormatInt(expires, 10) + "&signature=" + signature
+	if ip != "" {
+		query += "&bind_ip=1"
+	}
+	return fmt.Sprintf("%s/media/%d/transform?%s%s", settings.Get("MEDIA.BASE_URL").String(), m.MediaID, t.Encode(), query), nil
+}
+
+// transformVariant is what transformation signatures are issued for, so they share expiry, IP binding
+// and revocation with the delivery signatures of SignedURL.
+func transformVariant(t ImageTransform) string {
+	return "transform?" + t.Encode()
+}
+
+// imagePreset looks a preset up in MEDIA.IMAGE_PRESETS and ImagePresets.
+func imagePreset(name string) (ImageTransform, bool) {
+	var presets map[string]string
+	if settings.Get("MEDIA.IMAGE_PRESETS").ParseJSON(&presets) == nil {
+		if query, ok := presets[name]; ok {
+			values, err := url.ParseQuery(query)
+			if err != nil {
+				return ImageTransform{}, false
+			}
+			t, err := ParseImageTransform(values)
+			return t, err == nil
+		}
+	}
+	t, ok := ImagePresets[name]
+	return t, ok
+}
+
+// TransformHandler serves a resized or converted copy of an image, generating and caching it on first use.
+// Only presets or transformations signed by TransformURL are accepted so clients cannot fill the cache.
+func (c Controller) TransformHandler(request *evo.Request) any {
+	var media Media
+	if db.Where("media_id = ? AND deleted = 0", request.Param("id").Int64()).Take(&media).RowsAffected == 0 {
+		return httpStatus(http.StatusNotFound)
+	}
+	if media.Status != READY {
+		return httpStatus(http.StatusNotFound)
+	}
+
+	var t ImageTransform
+	var signature = request.Query("signature").String()
+	switch preset := request.Query("preset").String(); {
+	case signature == "" && (preset == "" || media.Private):
+		// private media are only transformed through signed URLs
+		return httpStatus(http.StatusForbidden)
+	case signature == "":
+		var ok bool
+		if t, ok = imagePreset(preset); !ok {
+			return httpStatus(http.StatusNotFound)
+		}
+	default:
+		var err error
+		if t, err = ParseImageTransform(request.URL().Query); err != nil {
+			return httpStatus(http.StatusBadRequest)
+		}
+		err = media.VerifySignature(transformVariant(t), request.Query("expires").Int64(), signature,
+			request.Query("bind_ip").Bool(), request.IP())
+		if err != nil {
+			return httpStatus(http.StatusForbidden)
+		}
+	}
+
+	var source = media.Path
+	if media.Type != "image" {
+		source = media.Thumbnail
+	}
+	if source == "" {
+		return httpStatus(http.StatusNotFound)
+	}
+
+	// the checksum (or path for older media) keys the cache so a replaced file never serves stale derivatives
+	var version = media.Checksum
+	if version == "" {
+		version = media.Path
+	}
+	var cache = NewLocalStorage(filepath.Join(CacheDir, "transform"))
+	var cached = path.Join(strconv.FormatInt(media.MediaID, 10), sha256Hex([]byte(version+"?"+t.Encode()))+t.Extension())
+	if _, err := cache.Stat(cached); errors.Is(err, ErrObjectNotFound) {
+		if !ffmpegAvailable() {
+			// API nodes without ffmpeg only serve transformations cached before
+			return httpStatus(http.StatusServiceUnavailable)
+		}
+		if err := transformImage(source, t, cache, cached); err != nil {
+			log.Error(err)
+			return httpStatus(http.StatusUnprocessableEntity)
+		}
+	}
+
+	if media.Private {
+		request.Context.Set("Cache-Control", "private")
+	}
+	return serveObject(request, cache, cached, mime.TypeByExtension(t.Extension()), "")
+}
+
+// transformImage renders source with t and stores the result in cache.
+func transformImage(source string, t ImageTransform, cache *LocalStorage, cached string) error {
+	input, cleanup, err := FetchFile(source)
+	if err != nil {
+		return fmt.Errorf("failed to fetch input: %w", err)
+	}
+	defer cleanup()
+
+	tmpDir, err := os.MkdirTemp(TemporaryDir, "transform-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	var output = filepath.Join(tmpDir, "output"+t.Extension())
+
+	var args = append([]string{"-y", "-i", input}, t.ffmpegArgs()...)
+	if err := runTool(baseContext, OpThumbnail, "ffmpeg", append(args, output), nil); err != nil {
+		return fmt.Errorf("image transformation failed: %w", err)
+	}
+	return cache.PutFile(cached, output)
+}
+
+// purgeTransformCache removes every cached transformation of the media.
+func purgeTransformCache(media *Media) error {
+	return os.RemoveAll(filepath.Join(CacheDir, "transform", strconv.FormatInt(media.MediaID, 10)))
+}
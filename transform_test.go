@@ -0,0 +1,98 @@
+package media
+
+import (
+	"errors"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/settings"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransformURLSignature(t *testing.T) {
+	settings.Set("MEDIA.SIGNING_KEY", "test-key")
+	var media = Media{MediaID: 7}
+	var transform = ImageTransform{Width: 400, Height: 300, Fit: "cover", Format: "webp", Quality: 80}
+
+	var verify = func(link, ip string) error {
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var query = u.Query()
+		parsed, err := ParseImageTransform(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expires, _ = strconv.ParseInt(query.Get("expires"), 10, 64)
+		return media.VerifySignature(transformVariant(parsed), expires, query.Get("signature"), query.Has("bind_ip"), ip)
+	}
+
+	link, err := media.TransformURL(transform, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verify(link, "10.0.0.1"); err != nil {
+		t.Fatalf("valid URL rejected: %v", err)
+	}
+	if err = verify(strings.Replace(link, "w=400", "w=4000", 1), ""); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("changed parameters: expected ErrSignatureInvalid, got %v", err)
+	}
+
+	link, _ = media.TransformURL(transform, -time.Minute)
+	if err = verify(link, ""); !errors.Is(err, ErrSignatureExpired) {
+		t.Fatalf("expected ErrSignatureExpired, got %v", err)
+	}
+
+	link, _ = media.TransformURLForIP(transform, time.Hour, "10.0.0.1")
+	if err = verify(link, "10.0.0.1"); err != nil {
+		t.Fatalf("bound IP rejected: %v", err)
+	}
+	if err = verify(link, "10.0.0.2"); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("other IP: expected ErrSignatureInvalid, got %v", err)
+	}
+
+	link, _ = media.TransformURL(transform, time.Hour)
+	media.SignatureVersion++
+	if err = verify(link, ""); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("revoked: expected ErrSignatureInvalid, got %v", err)
+	}
+}
+
+func TestTransformHandlerAccess(t *testing.T) {
+	setupTest(t)
+	settings.Set("MEDIA.SIGNING_KEY", "test-key")
+	var public = Media{Title: "public", Type: "image", Status: READY}
+	var private = Media{Title: "private", Type: "image", Status: READY, Private: true}
+	db.Create(&public)
+	db.Create(&private)
+	var transform = ImageTransform{Width: 100, Fit: "contain", Format: "jpeg", Quality: 80}
+	expired, _ := private.TransformURL(transform, -time.Minute)
+	valid, _ := private.TransformURL(transform, time.Hour)
+	valid = strings.TrimPrefix(valid, settings.Get("MEDIA.BASE_URL").String())
+	expired = strings.TrimPrefix(expired, settings.Get("MEDIA.BASE_URL").String())
+
+	var tests = []struct {
+		name, target string
+		status       int
+	}{
+		{"unsigned parameters", "/media/" + strconv.FormatInt(public.MediaID, 10) + "/transform?w=100", http.StatusForbidden},
+		{"unknown preset", "/media/" + strconv.FormatInt(public.MediaID, 10) + "/transform?preset=huge", http.StatusNotFound},
+		{"private preset", "/media/" + strconv.FormatInt(private.MediaID, 10) + "/transform?preset=thumbnail", http.StatusForbidden},
+		{"private unsigned parameters", "/media/" + strconv.FormatInt(private.MediaID, 10) + "/transform?w=100", http.StatusForbidden},
+		{"invalid signature", "/media/" + strconv.FormatInt(private.MediaID, 10) + "/transform?w=100&signature=00", http.StatusForbidden},
+		{"expired signature", expired, http.StatusForbidden},
+		// the signature is accepted; the media has no file to transform
+		{"valid signature", valid, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		resp := testRequest(t, httptest.NewRequest(http.MethodGet, test.target, nil))
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: status %d, expected %d", test.name, resp.StatusCode, test.status)
+		}
+	}
+}
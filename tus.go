@@ -0,0 +1,374 @@
+package media
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/json"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"github.com/getevo/evo/v2/lib/settings"
+	"hash"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,creation-with-upload,termination,checksum,expiration"
+	tusAlgorithms  = "md5,sha1,sha256"
+	tusContentType = "application/offset+octet-stream"
+
+	// StatusChecksumMismatch is returned by the tus checksum extension when a chunk does not match its checksum.
+	StatusChecksumMismatch = 460
+)
+
+// tusLocks serializes requests that modify the same upload.
+var tusLocks sync.Map
+
+// TusUpload is the state of a tus upload, stored as JSON next to the received data.
+type TusUpload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Offset    int64             `json:"offset"`
+	Metadata  map[string]string `json:"metadata"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+func tusDir() string {
+	return filepath.Join(TemporaryDir, "tus")
+}
+
+func (u *TusUpload) dataPath() string {
+	return filepath.Join(tusDir(), u.ID+".bin")
+}
+
+func (u *TusUpload) infoPath() string {
+	return filepath.Join(tusDir(), u.ID+".info")
+}
+
+func (u *TusUpload) save() error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(u.infoPath(), data, 0644)
+}
+
+// remove deletes the upload together with its lock.
+func (u *TusUpload) remove() {
+	_ = os.Remove(u.dataPath())
+	_ = os.Remove(u.infoPath())
+	tusLocks.Delete(u.ID)
+}
+
+// loadTusUpload reads the state of an upload, returning nil for unknown or expired uploads.
+func loadTusUpload(id string) *TusUpload {
+	if !uploadIDPattern.MatchString(id) {
+		return nil
+	}
+	var upload = TusUpload{ID: id}
+	data, err := os.ReadFile(upload.infoPath())
+	if err != nil {
+		return nil
+	}
+	if err = json.Unmarshal(data, &upload); err != nil {
+		return nil
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		upload.remove()
+		return nil
+	}
+	return &upload
+}
+
+func tusMaxSize() int64 {
+	return int64(settings.Get("MEDIA.TUS_MAX_SIZE").SizeInBytes())
+}
+
+func tusExpiration() time.Duration {
+	d, err := settings.Get("MEDIA.TUS_EXPIRATION", "24h").Duration()
+	if err != nil || d <= 0 {
+		return 24 * time.Hour
+	}
+	return d
+}
+
+// tusResponse builds a response carrying the Tus-Resumable header.
+func tusResponse(status int, headers map[string]string) outcome.Response {
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	headers["Tus-Resumable"] = tusVersion
+	return outcome.Response{
+		StatusCode:  status,
+		ContentType: "text/plain; charset=utf-8",
+		Headers:     headers,
+		Data:        "",
+	}
+}
+
+// parseTusMetadata decodes the Upload-Metadata header: comma separated keys with base64 encoded values.
+func parseTusMetadata(header string) (map[string]string, error) {
+	var metadata = map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata %s: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func (c Controller) TusOptionsHandler(request *evo.Request) any {
+	var headers = map[string]string{
+		"Tus-Version":            tusVersion,
+		"Tus-Extension":          tusExtensions,
+		"Tus-Checksum-Algorithm": tusAlgorithms,
+	}
+	if max := tusMaxSize(); max > 0 {
+		headers["Tus-Max-Size"] = strconv.FormatInt(max, 10)
+	}
+	return tusResponse(http.StatusNoContent, headers)
+}
+
+func (c Controller) TusCreateHandler(request *evo.Request) any {
+	if request.Header("Tus-Resumable") != tusVersion {
+		return tusResponse(http.StatusPreconditionFailed, map[string]string{"Tus-Version": tusVersion})
+	}
+	length, err := strconv.ParseInt(request.Header("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return tusResponse(http.StatusBadRequest, nil)
+	}
+	if max := tusMaxSize(); max > 0 && length > max {
+		return tusResponse(http.StatusRequestEntityTooLarge, nil)
+	}
+	metadata, err := parseTusMetadata(request.Header("Upload-Metadata"))
+	if err != nil {
+		return tusResponse(http.StatusBadRequest, nil)
+	}
+	collectionID, _ := strconv.ParseInt(metadata["collection_id"], 10, 64)
+	policy, err := UploadPolicyFor(request, collectionID)
+	if err != nil {
+		return tusResponse(http.StatusBadRequest, nil)
+	}
+	if _, err = ProfileFor(metadata["profile"], collectionID); err != nil {
+		return tusResponse(http.StatusBadRequest, nil)
+	}
+	if policy.CheckSize("", length) != nil {
+		return tusResponse(http.StatusRequestEntityTooLarge, nil)
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		return err
+	}
+	var upload = TusUpload{
+		ID:        id,
+		Length:    length,
+		Metadata:  metadata,
+		ExpiresAt: time.Now().Add(tusExpiration()),
+	}
+	if err = os.MkdirAll(tusDir(), 0755); err != nil {
+		return err
+	}
+	if err = os.WriteFile(upload.dataPath(), nil, 0644); err != nil {
+		return err
+	}
+	if err = upload.save(); err != nil {
+		return err
+	}
+
+	var headers = map[string]string{
+		"Location":       strings.TrimSuffix(request.Path(), "/") + "/" + upload.ID,
+		"Upload-Expires": upload.ExpiresAt.UTC().Format(http.TimeFormat),
+	}
+	// creation-with-upload: the request may already carry the first chunk
+	if request.Header("Content-Type") == tusContentType && len(request.Context.Body()) > 0 {
+		status, patchHeaders := c.tusAppend(&upload, request)
+		for k, v := range patchHeaders {
+			headers[k] = v
+		}
+		if status != http.StatusNoContent {
+			return tusResponse(status, headers)
+		}
+	}
+	return tusResponse(http.StatusCreated, headers)
+}
+
+func (c Controller) TusHeadHandler(request *evo.Request) any {
+	var upload = loadTusUpload(request.Param("id").String())
+	if upload == nil {
+		return tusResponse(http.StatusNotFound, nil)
+	}
+	return tusResponse(http.StatusOK, map[string]string{
+		"Upload-Offset":  strconv.FormatInt(upload.Offset, 10),
+		"Upload-Length":  strconv.FormatInt(upload.Length, 10),
+		"Upload-Expires": upload.ExpiresAt.UTC().Format(http.TimeFormat),
+		"Cache-Control":  "no-store",
+	})
+}
+
+func (c Controller) TusPatchHandler(request *evo.Request) any {
+	if request.Header("Tus-Resumable") != tusVersion {
+		return tusResponse(http.StatusPreconditionFailed, map[string]string{"Tus-Version": tusVersion})
+	}
+	if request.Header("Content-Type") != tusContentType {
+		return tusResponse(http.StatusUnsupportedMediaType, nil)
+	}
+	var id = request.Param("id").String()
+	var upload = loadTusUpload(id)
+	if upload == nil {
+		return tusResponse(http.StatusNotFound, nil)
+	}
+
+	lock, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	if !lock.(*sync.Mutex).TryLock() {
+		return tusResponse(http.StatusLocked, nil)
+	}
+	defer lock.(*sync.Mutex).Unlock()
+
+	// reload now that we hold the lock
+	if upload = loadTusUpload(id); upload == nil {
+		return tusResponse(http.StatusNotFound, nil)
+	}
+	offset, err := strconv.ParseInt(request.Header("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		return tusResponse(http.StatusConflict, nil)
+	}
+	status, headers := c.tusAppend(upload, request)
+	return tusResponse(status, headers)
+}
+
+// tusAppend verifies and appends the request body to the upload and ingests it once complete.
+func (c Controller) tusAppend(upload *TusUpload, request *evo.Request) (int, map[string]string) {
+	var chunk = request.Context.Body()
+	if upload.Offset+int64(len(chunk)) > upload.Length {
+		return http.StatusRequestEntityTooLarge, nil
+	}
+
+	if header := request.Header("Upload-Checksum"); header != "" {
+		algorithm, encoded, _ := strings.Cut(header, " ")
+		var h hash.Hash
+		switch algorithm {
+		case "md5":
+			h = md5.New()
+		case "sha1":
+			h = sha1.New()
+		case "sha256":
+			h = sha256.New()
+		default:
+			return http.StatusBadRequest, nil
+		}
+		expected, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+		h.Write(chunk)
+		if !bytes.Equal(h.Sum(nil), expected) {
+			return StatusChecksumMismatch, nil
+		}
+	}
+
+	f, err := os.OpenFile(upload.dataPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, nil
+	}
+	_, err = f.Write(chunk)
+	f.Close()
+	if err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, nil
+	}
+	upload.Offset += int64(len(chunk))
+	upload.ExpiresAt = time.Now().Add(tusExpiration())
+	if err = upload.save(); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, nil
+	}
+
+	var headers = map[string]string{
+		"Upload-Offset":  strconv.FormatInt(upload.Offset, 10),
+		"Upload-Expires": upload.ExpiresAt.UTC().Format(http.TimeFormat),
+	}
+	if upload.Offset < upload.Length {
+		return http.StatusNoContent, headers
+	}
+
+	var media = Media{
+		Filename:    NormalizeFileName(upload.Metadata["filename"]),
+		Title:       upload.Metadata["title"],
+		Description: upload.Metadata["description"],
+	}
+	media.Private, _ = strconv.ParseBool(upload.Metadata["private"])
+	if media.Filename == "" {
+		media.Filename = upload.ID
+	}
+	collectionID, _ := strconv.ParseInt(upload.Metadata["collection_id"], 10, 64)
+	policy, err := UploadPolicyFor(request, collectionID)
+	if err == nil {
+		media.Profile, err = ProfileFor(upload.Metadata["profile"], collectionID)
+	}
+	if err == nil {
+		err = IngestFile(&media, upload.dataPath(), "", policy)
+	}
+	upload.remove()
+	if err == nil && collectionID > 0 {
+		err = AddToCollection(&media, collectionID)
+	}
+	if err != nil {
+		log.Error(err)
+		return http.StatusUnprocessableEntity, headers
+	}
+	headers["X-Media-ID"] = strconv.FormatInt(media.MediaID, 10)
+	return http.StatusNoContent, headers
+}
+
+func (c Controller) TusDeleteHandler(request *evo.Request) any {
+	if request.Header("Tus-Resumable") != tusVersion {
+		return tusResponse(http.StatusPreconditionFailed, map[string]string{"Tus-Version": tusVersion})
+	}
+	var upload = loadTusUpload(request.Param("id").String())
+	if upload == nil {
+		return tusResponse(http.StatusNotFound, nil)
+	}
+	upload.remove()
+	return tusResponse(http.StatusNoContent, nil)
+}
+
+// SweepTusUploads deletes the data of every expired tus upload.
+func SweepTusUploads() {
+	entries, err := os.ReadDir(tusDir())
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Error(err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".info"); ok {
+			// loading an expired upload removes it
+			if loadTusUpload(id) == nil {
+				tusLocks.Delete(id)
+			}
+		}
+	}
+}
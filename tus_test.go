@@ -0,0 +1,226 @@
+package media
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"github.com/getevo/evo/v2/lib/db"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tusRequest sends a tus request carrying the Tus-Resumable header and the given headers.
+func tusRequest(t *testing.T, method, target, body string, headers map[string]string) *http.Response {
+	t.Helper()
+	var req = httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return testRequest(t, req)
+}
+
+// createTusUpload creates a tus upload of length bytes named filename and returns its ID.
+func createTusUpload(t *testing.T, length int, filename string) string {
+	t.Helper()
+	resp := tusRequest(t, http.MethodPost, "/admin/media/tus/", "", map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(filename)),
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status %d", resp.StatusCode)
+	}
+	var id = path.Base(resp.Header.Get("Location"))
+	if !uploadIDPattern.MatchString(id) {
+		t.Fatalf("unexpected location %q", resp.Header.Get("Location"))
+	}
+	return id
+}
+
+// tusPatch appends chunk at offset, with an Upload-Checksum header when checksum is not empty.
+func tusPatch(t *testing.T, id string, offset int, chunk, checksum string) *http.Response {
+	t.Helper()
+	var headers = map[string]string{
+		"Content-Type":  tusContentType,
+		"Upload-Offset": strconv.Itoa(offset),
+	}
+	if checksum != "" {
+		headers["Upload-Checksum"] = checksum
+	}
+	return tusRequest(t, http.MethodPatch, "/admin/media/tus/"+id, chunk, headers)
+}
+
+// md5Checksum returns the Upload-Checksum header of s.
+func md5Checksum(s string) string {
+	var sum = md5.Sum([]byte(s))
+	return "md5 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// tusOffset returns the offset HEAD reports for an upload.
+func tusOffset(t *testing.T, id string) string {
+	t.Helper()
+	resp := tusRequest(t, http.MethodHead, "/admin/media/tus/"+id, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("head: status %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Upload-Offset")
+}
+
+func TestTusUpload(t *testing.T) {
+	setupTest(t)
+	if resp := tusRequest(t, http.MethodOptions, "/admin/media/tus/", "", nil); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Tus-Extension") != tusExtensions {
+		t.Fatalf("options: status %d, extensions %q", resp.StatusCode, resp.Header.Get("Tus-Extension"))
+	}
+	var req = httptest.NewRequest(http.MethodPost, "/admin/media/tus/", nil)
+	req.Header.Set("Upload-Length", "10")
+	if resp := testRequest(t, req); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("create without Tus-Resumable: status %d", resp.StatusCode)
+	}
+
+	var id = createTusUpload(t, 10, "Notes.txt")
+	resp := tusRequest(t, http.MethodHead, "/admin/media/tus/"+id, "", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Upload-Offset") != "0" || resp.Header.Get("Upload-Length") != "10" {
+		t.Fatalf("head: status %d, offset %q, length %q", resp.StatusCode, resp.Header.Get("Upload-Offset"), resp.Header.Get("Upload-Length"))
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("head responses must not be cached")
+	}
+
+	if resp = tusPatch(t, id, 0, "hello", md5Checksum("hello")); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != "5" {
+		t.Fatalf("patch: status %d, offset %q", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+	for _, test := range []struct {
+		name     string
+		offset   int
+		chunk    string
+		checksum string
+		status   int
+	}{
+		{"offset behind", 0, "world", "", http.StatusConflict},
+		{"offset ahead", 7, "world", "", http.StatusConflict},
+		{"checksum mismatch", 5, "world", md5Checksum("w0rld"), StatusChecksumMismatch},
+		{"unknown algorithm", 5, "world", "crc32 AAAAAA==", http.StatusBadRequest},
+		{"past the length", 5, "world!", "", http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if resp := tusPatch(t, id, test.offset, test.chunk, test.checksum); resp.StatusCode != test.status {
+				t.Fatalf("status %d, expected %d", resp.StatusCode, test.status)
+			}
+			// a rejected chunk is not appended
+			if offset := tusOffset(t, id); offset != "5" {
+				t.Fatalf("offset moved to %s", offset)
+			}
+		})
+	}
+
+	resp = tusPatch(t, id, 5, "world", md5Checksum("world"))
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != "10" {
+		t.Fatalf("last patch: status %d, offset %q", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+	mediaID, err := strconv.ParseInt(resp.Header.Get("X-Media-ID"), 10, 64)
+	if err != nil {
+		t.Fatalf("the completed upload was not ingested: %q", resp.Header.Get("X-Media-ID"))
+	}
+	var media Media
+	if err = db.Take(&media, mediaID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if media.Filename != "notes.txt" || media.FileSize != 10 {
+		t.Fatalf("unexpected media %+v", media)
+	}
+	f, err := Store.Get(media.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if data, _ := io.ReadAll(f); string(data) != "helloworld" {
+		t.Fatalf("stored %q", data)
+	}
+
+	// the finished upload is gone together with its lock
+	var upload = TusUpload{ID: id}
+	for _, p := range []string{upload.dataPath(), upload.infoPath()} {
+		if _, err = os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("%s outlived the upload", p)
+		}
+	}
+	if _, ok := tusLocks.Load(id); ok {
+		t.Fatalf("the lock outlived the upload")
+	}
+	if resp = tusRequest(t, http.MethodHead, "/admin/media/tus/"+id, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("head after completion: status %d", resp.StatusCode)
+	}
+}
+
+func TestTusCreationWithUpload(t *testing.T) {
+	setupTest(t)
+	resp := tusRequest(t, http.MethodPost, "/admin/media/tus/", "hello", map[string]string{
+		"Upload-Length":   "10",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("notes.txt")),
+		"Content-Type":    tusContentType,
+	})
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Upload-Offset") != "5" {
+		t.Fatalf("status %d, offset %q", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+	if offset := tusOffset(t, path.Base(resp.Header.Get("Location"))); offset != "5" {
+		t.Fatalf("offset %s after the first chunk", offset)
+	}
+}
+
+func TestTusExpiry(t *testing.T) {
+	setupTest(t)
+	var expired, active = createTusUpload(t, 10, "a.txt"), createTusUpload(t, 10, "b.txt")
+	if resp := tusPatch(t, expired, 0, "hello", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("patch: status %d", resp.StatusCode)
+	}
+	var expire = func(id string) {
+		var upload = loadTusUpload(id)
+		upload.ExpiresAt = time.Now().Add(-time.Minute)
+		if err := upload.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expire(expired)
+	if resp := tusRequest(t, http.MethodHead, "/admin/media/tus/"+expired, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("head of an expired upload: status %d", resp.StatusCode)
+	}
+	if resp := tusPatch(t, expired, 5, "world", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("patch of an expired upload: status %d", resp.StatusCode)
+	}
+	var upload = TusUpload{ID: expired}
+	if _, err := os.Stat(upload.dataPath()); !os.IsNotExist(err) {
+		t.Fatalf("the data of the expired upload was kept")
+	}
+
+	// the sweep removes expired uploads nobody asks for and keeps the others
+	var swept = createTusUpload(t, 10, "c.txt")
+	expire(swept)
+	SweepTusUploads()
+	upload = TusUpload{ID: swept}
+	for _, p := range []string{upload.dataPath(), upload.infoPath()} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("%s was not swept", p)
+		}
+	}
+	if offset := tusOffset(t, active); offset != "0" {
+		t.Fatalf("the active upload is at %s", offset)
+	}
+}
+
+func TestTusDelete(t *testing.T) {
+	setupTest(t)
+	var id = createTusUpload(t, 10, "a.txt")
+	if resp := tusRequest(t, http.MethodDelete, "/admin/media/tus/"+id, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status %d", resp.StatusCode)
+	}
+	if resp := tusRequest(t, http.MethodHead, "/admin/media/tus/"+id, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("head after delete: status %d", resp.StatusCode)
+	}
+}
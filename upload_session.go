@@ -0,0 +1,151 @@
+package media
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// maxPartNumber is the highest part number of a multipart upload, as on S3.
+const maxPartNumber = 10000
+
+// uploadIDPattern matches the IDs issued by newUploadID to multipart and tus uploads; nothing else may reach
+// the file system.
+var uploadIDPattern = regexp.MustCompile(`^[a-f0-9]{32}$`)
+
+// newUploadID returns a random, opaque upload ID.
+func newUploadID() (string, error) {
+	var id = make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func multipartExpiration() time.Duration {
+	d, err := settings.Get("MEDIA.MULTIPART_EXPIRATION", "24h").Duration()
+	if err != nil || d <= 0 {
+		return 24 * time.Hour
+	}
+	return d
+}
+
+// Create assigns an upload ID to the session and starts the multipart upload.
+func (s *UploadSession) Create() error {
+	var err error
+	if s.UploadID, err = newUploadID(); err != nil {
+		return err
+	}
+	s.ExpiresAt = time.Now().Add(multipartExpiration())
+	if err = os.MkdirAll(s.dir(), 0755); err != nil {
+		return fmt.Errorf("failed to create upload dir: %w", err)
+	}
+	if err = db.Create(s).Error; err != nil {
+		_ = os.RemoveAll(s.dir())
+		return err
+	}
+	return nil
+}
+
+// loadUploadSession returns the session of the upload of key started by owner, or nil if it is unknown or expired.
+func loadUploadSession(uploadID, key, owner string) *UploadSession {
+	if !uploadIDPattern.MatchString(uploadID) {
+		return nil
+	}
+	var session UploadSession
+	if db.Where("upload_id = ? AND object_key = ? AND owner = ?", uploadID, key, owner).Take(&session).RowsAffected == 0 {
+		return nil
+	}
+	if time.Now().After(session.ExpiresAt) {
+		if err := session.Delete(); err != nil {
+			log.Error(err)
+		}
+		return nil
+	}
+	return &session
+}
+
+func (s *UploadSession) dir() string {
+	return filepath.Join(TemporaryDir, "multipart", s.UploadID)
+}
+
+func (s *UploadSession) partPath(number int) string {
+	return filepath.Join(s.dir(), strconv.Itoa(number))
+}
+
+// SavePart stores a part, replacing any part previously uploaded with the same number, and extends the session.
+// etag is the hex encoded MD5 of data.
+func (s *UploadSession) SavePart(number int, data []byte, etag string) (*UploadPart, error) {
+	if number < 1 || number > maxPartNumber {
+		return nil, ErrInvalidPartNumber
+	}
+	if err := os.WriteFile(s.partPath(number), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write part: %w", err)
+	}
+	var part = UploadPart{
+		UploadID:   s.UploadID,
+		PartNumber: number,
+		ETag:       etag,
+		Size:       int64(len(data)),
+	}
+	if err := db.Where("upload_id = ? AND part_number = ?", s.UploadID, number).Delete(&UploadPart{}).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Create(&part).Error; err != nil {
+		return nil, err
+	}
+	s.ExpiresAt = time.Now().Add(multipartExpiration())
+	if err := db.Model(s).Update("expires_at", s.ExpiresAt).Error; err != nil {
+		return nil, err
+	}
+	return &part, nil
+}
+
+// ReceivedParts returns the parts received so far ordered by part number.
+func (s *UploadSession) ReceivedParts() ([]UploadPart, error) {
+	var parts []UploadPart
+	err := db.Where("upload_id = ?", s.UploadID).Order("part_number").Find(&parts).Error
+	return parts, err
+}
+
+// receivedSize returns the size of every part received so far except the given one.
+func (s *UploadSession) receivedSize(except int) int64 {
+	var size int64
+	db.Model(&UploadPart{}).Where("upload_id = ? AND part_number <> ?", s.UploadID, except).Select("COALESCE(SUM(size), 0)").Scan(&size)
+	return size
+}
+
+// Delete removes the session together with its parts. Only the session's own directory is removed.
+func (s *UploadSession) Delete() error {
+	if uploadIDPattern.MatchString(s.UploadID) {
+		if err := os.RemoveAll(s.dir()); err != nil {
+			return err
+		}
+	}
+	if err := db.Where("upload_id = ?", s.UploadID).Delete(&UploadPart{}).Error; err != nil {
+		return err
+	}
+	return db.Where("upload_id = ?", s.UploadID).Delete(&UploadSession{}).Error
+}
+
+// SweepUploadSessions aborts every expired multipart upload and deletes its parts.
+func SweepUploadSessions() {
+	var sessions []UploadSession
+	if err := db.Where("expires_at < ?", time.Now()).Find(&sessions).Error; err != nil {
+		log.Error(err)
+		return
+	}
+	for i := range sessions {
+		if err := sessions[i].Delete(); err != nil {
+			log.Error(err)
+		}
+	}
+}
@@ -1,54 +1,111 @@
 package media
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"github.com/getevo/evo/v2/lib/text"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
+// PreviewStep cuts a short silent preview out of a video: the beginning of short videos, or Clips clips
+// spread over longer ones.
+type PreviewStep struct {
+	Clips        int     `json:"clips" yaml:"clips"`
+	ClipDuration float64 `json:"clip_duration" yaml:"clip_duration"` // seconds
+	Height       int     `json:"height" yaml:"height"`
+}
+
+// DefaultPreview is the preview made by CreateVideoPreview: 4 clips of 2.5s at 480p.
+var DefaultPreview = PreviewStep{Clips: 4, ClipDuration: 2.5, Height: 480}
+
 func CreateVideoPreview(media *Media) error {
-	absInput, err := getPath(filepath.Join(LocalUploadDir, media.Path))
-	if err != nil {
-		return fmt.Errorf("absolute input path error: %w", err)
+	return DefaultPreview.Run(media)
+}
+
+// Run creates the preview of media and records it in media.Preview. A preview made with the same parameters for
+// another media sharing the file is reused.
+func (s PreviewStep) Run(media *Media) error {
+	if s.Clips <= 0 {
+		s.Clips = DefaultPreview.Clips
 	}
-	absOutput, err := getPath(filepath.Join(LocalUploadDir, filepath.Dir(media.Path), "preview.mp4"))
+	if s.ClipDuration <= 0 {
+		s.ClipDuration = DefaultPreview.ClipDuration
+	}
+	if s.Height <= 0 {
+		s.Height = DefaultPreview.Height
+	}
+	var preview = derivativePath(media, s, "preview.mp4")
+	if derivativeExists(preview) {
+		media.Preview = preview
+		return nil
+	}
+	absInput, cleanup, err := FetchFile(media.Path)
 	if err != nil {
-		return fmt.Errorf("absolute output path error: %w", err)
+		return fmt.Errorf("failed to fetch input: %w", err)
 	}
-
-	// Step 1: Get duration
-	var duration = float64(media.Duration)
+	defer cleanup()
+	var ctx = mediaContext(media)
 
 	// Create temp directory
-	tmpDir := filepath.Join(filepath.Dir(absOutput), "tmp_preview")
-	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+	tmpDir, err := os.MkdirTemp(TemporaryDir, "preview-*")
+	if err != nil {
 		return fmt.Errorf("failed to create temp dir: %w", err)
 	}
 	defer os.RemoveAll(tmpDir)
+	tmpDir, err = getPath(tmpDir)
+	if err != nil {
+		return fmt.Errorf("absolute temp path error: %w", err)
+	}
+	absOutput := filepath.Join(tmpDir, "preview.mp4")
+
+	// Step 1: Get duration
+	var duration = float64(media.Duration)
+	var length = float64(s.Clips) * s.ClipDuration
 
-	if duration < 30 {
-		// Simple case: first 10s
-		return ffmpegExtract(absInput, absOutput, 0, 10)
+	if duration < length*3 {
+		// Simple case: the beginning, as long as all clips together
+		var extracted = min(duration, length)
+		if err := ffmpegExtract(ctx, absInput, absOutput, 0, length, s.Height, func(position time.Duration) {
+			reportProgress(media, fractionOf(position, extracted))
+		}); err != nil {
+			return err
+		}
+		if err := StoreFile(preview, absOutput); err != nil {
+			return fmt.Errorf("failed to store preview: %w", err)
+		}
+		media.Preview = preview
+		return nil
 	}
 
-	// Complex case: Split and process (skip first 1/5th)
-	partDuration := duration / 5.0
+	// Complex case: Split and process (skip the first part)
+	partDuration := duration / float64(s.Clips+1)
 	var wg sync.WaitGroup
-	var errs = make([]error, 4) // Using 4 parts (pieces 1 to 4)
+	var errs = make([]error, s.Clips)
+	// extracting the parts is reported as the first 80% of the preview, encoding the combined video as the rest
+	var done = make([]float64, s.Clips)
+	var doneMu sync.Mutex
 
-	for i := 1; i <= 4; i++ {
+	for i := 1; i <= s.Clips; i++ {
 		index := i - 1
 		start := partDuration * float64(i)
 		out := filepath.Join(tmpDir, fmt.Sprintf("part%d.mp4", i))
 		wg.Add(1)
 		go func(index int, start float64, out string) {
 			defer wg.Done()
-			errs[index] = ffmpegExtract(absInput, out, start, 2.5)
+			errs[index] = ffmpegExtract(ctx, absInput, out, start, s.ClipDuration, s.Height, func(position time.Duration) {
+				doneMu.Lock()
+				done[index] = min(fractionOf(position, s.ClipDuration), 1)
+				var total float64
+				for _, d := range done {
+					total += d
+				}
+				doneMu.Unlock()
+				reportProgress(media, total/float64(s.Clips)*0.8)
+			})
 		}(index, start, out)
 	}
 	wg.Wait()
@@ -63,7 +120,7 @@ func CreateVideoPreview(media *Media) error {
 	random := text.Random(5)
 	concatFile := filepath.Join(tmpDir, "concat-"+random+".txt")
 	var concatList strings.Builder
-	for i := 1; i <= 4; i++ {
+	for i := 1; i <= s.Clips; i++ {
 		concatList.WriteString(fmt.Sprintf("file '%s'\n", filepath.Join(tmpDir, fmt.Sprintf("part%d.mp4", i))))
 	}
 	if err := os.WriteFile(concatFile, []byte(concatList.String()), 0644); err != nil {
@@ -72,98 +129,141 @@ func CreateVideoPreview(media *Media) error {
 
 	// Final concat
 	combined := filepath.Join(tmpDir, "combined.mp4")
-	cmd := exec.Command("ffmpeg",
+	err = runTool(ctx, OpPreview, "ffmpeg", []string{
 		"-y", "-f", "concat", "-safe", "0",
 		"-i", concatFile,
 		"-c", "copy",
 		combined,
-	)
-	if err := runCmd(cmd); err != nil {
+	}, nil)
+	if err != nil {
 		return fmt.Errorf("failed to concat: %w", err)
 	}
 	defer os.Remove(concatFile)
 
 	// Resize + remove audio from combined
-	err = ffmpegFinalize(combined, absOutput)
+	err = ffmpegFinalize(ctx, combined, absOutput, s.Height, func(position time.Duration) {
+		reportProgress(media, 0.8+0.2*fractionOf(position, length))
+	})
 	if err != nil {
 		return fmt.Errorf("failed to finalize combined: %w", err)
 	}
-	media.Preview = filepath.Join(filepath.Dir(media.Path), "preview.mp4")
+	if err := StoreFile(preview, absOutput); err != nil {
+		return fmt.Errorf("failed to store preview: %w", err)
+	}
+	media.Preview = preview
 	return nil
 }
 
-func ffmpegExtract(input, output string, start, duration float64) error {
-	cmd := exec.Command("ffmpeg",
+func ffmpegExtract(ctx context.Context, input, output string, start, duration float64, height int, progress func(time.Duration)) error {
+	return runFFmpeg(ctx, OpPreview, []string{
 		"-y",
 		"-ss", fmt.Sprintf("%.2f", start),
 		"-t", fmt.Sprintf("%.2f", duration),
 		"-i", input,
-		"-an",                 // remove audio
-		"-vf", "scale=-2:480", // 480p
+		"-an", // remove audio
+		"-vf", fmt.Sprintf("scale=-2:%d", height),
 		"-c:v", "libx264", // h264
 		"-preset", "fast",
 		output,
-	)
-	return runCmd(cmd)
+	}, progress)
 }
 
-func ffmpegFinalize(input, output string) error {
-	cmd := exec.Command("ffmpeg",
+// ffmpegRendition encodes a single rung of an adaptive bitrate ladder. Keyframes are placed
+// at fixed intervals so segments of different renditions line up.
+func ffmpegRendition(ctx context.Context, input, output string, r Rendition, progress func(time.Duration)) error {
+	return runFFmpeg(ctx, OpTranscode, []string{
 		"-y",
 		"-i", input,
-		"-an",                 // remove audio
-		"-vf", "scale=-2:480", // 480p
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", fmt.Sprintf("scale=-2:%d", r.Height),
 		"-c:v", "libx264",
 		"-preset", "fast",
+		"-b:v", r.VideoBitrate,
+		"-maxrate", r.VideoBitrate,
+		"-bufsize", fmt.Sprintf("%dk", bitrate(r.VideoBitrate)*2/1000),
+		"-g", "48", "-keyint_min", "48", "-sc_threshold", "0",
+		"-c:a", "aac",
+		"-b:a", r.AudioBitrate,
+		"-movflags", "+faststart",
 		output,
-	)
-	return runCmd(cmd)
+	}, progress)
 }
 
-func runCmd(cmd *exec.Cmd) error {
-	var out, stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("cmd failed: %v - stderr: %s", err, stderr.String())
-	}
-	return nil
+func ffmpegFinalize(ctx context.Context, input, output string, height int, progress func(time.Duration)) error {
+	return runFFmpeg(ctx, OpPreview, []string{
+		"-y",
+		"-i", input,
+		"-an", // remove audio
+		"-vf", fmt.Sprintf("scale=-2:%d", height),
+		"-c:v", "libx264",
+		"-preset", "fast",
+		output,
+	}, progress)
 }
 
+// ThumbnailStep grabs a JPG thumbnail from a video.
+type ThumbnailStep struct {
+	Position float64 `json:"position" yaml:"position"` // percent of the duration
+	Width    int     `json:"width" yaml:"width"`       // 0 keeps the aspect ratio of Height
+	Height   int     `json:"height" yaml:"height"`     // 0 keeps the aspect ratio of Width
+}
+
+// DefaultThumbnail is the thumbnail made by GenerateVideoThumbnail: 720p from the midpoint.
+var DefaultThumbnail = ThumbnailStep{Position: 50, Height: 720}
+
 // GenerateVideoThumbnail generates a 720p JPG thumbnail from the midpoint of the video.
-// Returns the absolute thumbnail path.
 func GenerateVideoThumbnail(media *Media) error {
-	absInput, err := getPath(filepath.Join(LocalUploadDir, media.Path))
-	if err != nil {
-		return fmt.Errorf("absolute input path error: %w", err)
+	return DefaultThumbnail.Run(media)
+}
+
+// Run creates the thumbnail of media and records it in media.Thumbnail. A thumbnail made with the same parameters
+// for another media sharing the file is reused.
+func (s ThumbnailStep) Run(media *Media) error {
+	var thumbnail = derivativePath(media, s, "thumbnail.jpg")
+	if derivativeExists(thumbnail) {
+		media.Thumbnail = thumbnail
+		return nil
 	}
-	absOutput, err := getPath(filepath.Join(LocalUploadDir, filepath.Dir(media.Path), "preview.jpg"))
+	absInput, cleanup, err := FetchFile(media.Path)
 	if err != nil {
-		return fmt.Errorf("absolute output path error: %w", err)
+		return fmt.Errorf("failed to fetch input: %w", err)
 	}
+	defer cleanup()
 
-	// Grab frame at middle of video
-	midpoint := media.Duration / 2.0
+	tmpDir, err := os.MkdirTemp(TemporaryDir, "thumbnail-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	absOutput := filepath.Join(tmpDir, "thumbnail.jpg")
 
-	cmd := exec.Command("ffmpeg",
+	var position = float64(media.Duration) * min(max(s.Position, 0), 100) / 100
+	var args = []string{
 		"-y",
-		"-ss", fmt.Sprintf("%.2f", float64(midpoint)),
+		"-ss", fmt.Sprintf("%.2f", position),
 		"-i", absInput,
 		"-vframes", "1",
 		"-q:v", "2", // High quality JPEG
-		"-vf", "scale=-1:720", // scale to 720p height, keep aspect ratio
-		absOutput,
-	)
-
-	var out, stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("thumbnail generation failed: %w\n%s", err, stderr.String())
 	}
-	media.Thumbnail = filepath.Join(filepath.Dir(media.Path), "preview.jpg")
+	if s.Width > 0 || s.Height > 0 {
+		var width, height = s.Width, s.Height
+		// -1 keeps the aspect ratio for the missing dimension
+		if width <= 0 {
+			width = -1
+		}
+		if height <= 0 {
+			height = -1
+		}
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:%d", width, height))
+	}
+	err = runTool(mediaContext(media), OpThumbnail, "ffmpeg", append(args, absOutput), nil)
+	if err != nil {
+		return fmt.Errorf("thumbnail generation failed: %w", err)
+	}
+	if err := StoreFile(thumbnail, absOutput); err != nil {
+		return fmt.Errorf("failed to store thumbnail: %w", err)
+	}
+	media.Thumbnail = thumbnail
 	return nil
 }
 
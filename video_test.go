@@ -0,0 +1,284 @@
+package media
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sharedVideos stores two media with the same content, so they share a blob.
+func sharedVideos(t *testing.T) (*Media, *Media) {
+	t.Helper()
+	var media [2]*Media
+	for i := range media {
+		file, checksum, size, err := SaveTemp(strings.NewReader("the same video"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		media[i] = &Media{Filename: "clip.mp4", Type: "video", FileSize: size, Duration: 10, ScreenSize: "1280x720"}
+		if err = StoreBlob(media[i], file, checksum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if media[0].Path != media[1].Path {
+		t.Fatalf("the media do not share a blob")
+	}
+	return media[0], media[1]
+}
+
+func TestDerivativesArePerParameters(t *testing.T) {
+	setupTest(t)
+	var runner = fakeTools(t, fakeOutputs("1\n"))
+	a, b := sharedVideos(t)
+	var dir = path.Dir(a.Path)
+
+	var steps = []struct {
+		name       string
+		run        func(media *Media, small bool) error
+		derivative func(media *Media) string
+	}{
+		{"thumbnail", func(media *Media, small bool) error {
+			var step = ThumbnailStep{Position: 50, Height: 720}
+			if small {
+				step.Height = 360
+			}
+			return step.Run(media)
+		}, func(media *Media) string { return media.Thumbnail }},
+		{"preview", func(media *Media, small bool) error {
+			var step = PreviewStep{Clips: 4, ClipDuration: 2.5, Height: 480}
+			if small {
+				step.Height = 240
+			}
+			return step.Run(media)
+		}, func(media *Media) string { return media.Preview }},
+		{"hls", func(media *Media, small bool) error {
+			var step = StreamingProfile{Ladder: []Rendition{rendition(360), rendition(720)}, HLS: true}
+			if small {
+				step.Ladder = step.Ladder[:1]
+			}
+			return PackageStreams(media, step)
+		}, func(media *Media) string { return media.HLS }},
+		{"dash", func(media *Media, small bool) error {
+			var step = StreamingProfile{Ladder: []Rendition{rendition(360), rendition(720)}, DASH: true}
+			if small {
+				step.Ladder = step.Ladder[:1]
+			}
+			return PackageStreams(media, step)
+		}, func(media *Media) string { return media.DASH }},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			runner.Reset()
+			if err := step.run(a, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := step.run(b, true); err != nil {
+				t.Fatal(err)
+			}
+			var first, second = step.derivative(a), step.derivative(b)
+			if first == second || !strings.HasPrefix(first, dir+"/") || !strings.HasPrefix(second, dir+"/") {
+				t.Fatalf("derivatives %s and %s should differ and live below %s", first, second, dir)
+			}
+			for _, p := range []string{first, second} {
+				if !derivativeExists(p) {
+					t.Fatalf("%s was not stored", p)
+				}
+			}
+
+			// the same parameters reuse what was made for the other media
+			runner.Reset()
+			if err := step.run(b, false); err != nil {
+				t.Fatal(err)
+			}
+			if step.derivative(b) != first {
+				t.Fatalf("expected %s to be reused, got %s", first, step.derivative(b))
+			}
+			if commands := runner.Commands(); len(commands) != 0 {
+				t.Fatalf("the derivative was made again: %v", commands)
+			}
+		})
+	}
+
+	// the derivatives of every profile go with the blob
+	for _, media := range []*Media{a, b} {
+		if err := releaseBlob(media); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects, err := Store.List(dir + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Fatalf("left behind %v", objects)
+	}
+}
+
+// putRecorder records the order objects are written in. It does not implement FileStorage, so StoreFile uses Put.
+type putRecorder struct {
+	Storage
+	puts []string
+}
+
+func (s *putRecorder) Put(p string, reader io.Reader) error {
+	s.puts = append(s.puts, p)
+	return s.Storage.Put(p, reader)
+}
+
+func TestStoreDir(t *testing.T) {
+	setupTest(t)
+	var recorder = &putRecorder{Storage: Store}
+	Store = recorder
+	if err := Store.Put("streams/hls/720p/stale.ts", strings.NewReader("stale")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Store.Put("streams/hlsother/keep.ts", strings.NewReader("keep")); err != nil {
+		t.Fatal(err)
+	}
+
+	var dir = t.TempDir()
+	for _, name := range []string{"master.m3u8", "720p/index.m3u8", "720p/segment_00000.ts", "z.ts"} {
+		var p = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder.puts = nil
+	if err := StoreDir("streams/hls", dir, "master.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.puts) != 4 || recorder.puts[3] != "streams/hls/master.m3u8" {
+		t.Fatalf("the manifest should be stored last: %v", recorder.puts)
+	}
+
+	objects, err := Store.List("streams/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, object := range objects {
+		paths = append(paths, object.Path)
+	}
+	slices.Sort(paths)
+	var expected = []string{"streams/hls/720p/index.m3u8", "streams/hls/720p/segment_00000.ts", "streams/hls/master.m3u8", "streams/hls/z.ts", "streams/hlsother/keep.ts"}
+	if !slices.Equal(paths, expected) {
+		t.Fatalf("stored %v, expected %v", paths, expected)
+	}
+}
+
+// ffmpegFixture generates a video with a test pattern and a sine tone, skipping the test without ffmpeg and ffprobe.
+func ffmpegFixture(t *testing.T, seconds int) string {
+	t.Helper()
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+	var fixture = filepath.Join(t.TempDir(), "fixture.mp4")
+	var duration = strconv.Itoa(seconds)
+	out, err := exec.Command("ffmpeg", "-v", "error", "-y",
+		"-f", "lavfi", "-i", "testsrc=size=640x360:rate=24:duration="+duration,
+		"-f", "lavfi", "-i", "sine=frequency=440:duration="+duration,
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", "-c:a", "aac", "-shortest", fixture).CombinedOutput()
+	if err != nil {
+		t.Skipf("ffmpeg cannot generate the fixture: %v: %s", err, out)
+	}
+	return fixture
+}
+
+func TestFFmpegIntegration(t *testing.T) {
+	setupTest(t)
+	var fixture = ffmpegFixture(t, 12)
+	info, err := GetVideoInfo(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 640 || info.Height != 360 || info.Duration < 11 || info.Duration > 13 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	if !hasAudioStream(context.Background(), fixture) {
+		t.Fatalf("the fixture has a sine tone")
+	}
+
+	var media = Media{Filename: "fixture.mp4", Type: "video"}
+	if err = ProbeMedia(&media, fixture); err != nil {
+		t.Fatal(err)
+	}
+	if media.ScreenSize != "640x360" || media.Duration < 11 {
+		t.Fatalf("unexpected probe %+v", media)
+	}
+	checksum, err := HashFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = StoreBlob(&media, fixture, checksum); err != nil {
+		t.Fatal(err)
+	}
+
+	// 12 seconds are long enough for the preview to be cut out of 4 clips and concatenated
+	if err = (PreviewStep{Clips: 4, ClipDuration: 1, Height: 240}).Run(&media); err != nil {
+		t.Fatal(err)
+	}
+	if err = (ThumbnailStep{Position: 50, Height: 180}).Run(&media); err != nil {
+		t.Fatal(err)
+	}
+	if err = PackageStreams(&media, StreamingProfile{Ladder: []Rendition{rendition(240), rendition(360), rendition(720)}, HLS: true, DASH: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{media.Preview, media.Thumbnail, media.HLS, media.DASH} {
+		if !derivativeExists(p) {
+			t.Fatalf("%s was not stored", p)
+		}
+	}
+	objects, err := Store.List(path.Dir(media.HLS) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var renditions = map[string]bool{}
+	for _, object := range objects {
+		renditions[strings.SplitN(strings.TrimPrefix(object.Path, path.Dir(media.HLS)+"/"), "/", 2)[0]] = true
+	}
+	// 720p is dropped rather than upscaled
+	if !renditions["240p"] || !renditions["360p"] || renditions["720p"] {
+		t.Fatalf("unexpected renditions %v", renditions)
+	}
+
+	preview, err := Store.(LocalPather).LocalPath(media.Preview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previewInfo, err := GetVideoInfo(preview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previewInfo.Height != 240 || previewInfo.Duration < 3 || previewInfo.Duration > 5 {
+		t.Fatalf("unexpected preview %+v", previewInfo)
+	}
+}
+
+func TestFFmpegIntegrationCancel(t *testing.T) {
+	setupTest(t)
+	var fixture = ffmpegFixture(t, 30)
+	ctx, cancel := context.WithCancel(context.Background())
+	var started = time.Now()
+	time.AfterFunc(200*time.Millisecond, cancel)
+	// a slow encode of the whole fixture is killed with its process group
+	err := runTool(ctx, OpTranscode, "ffmpeg", []string{"-y", "-re", "-i", fixture, "-c:v", "libx264", filepath.Join(t.TempDir(), "out.mp4")}, nil)
+	if err == nil {
+		t.Fatalf("the encode was not cancelled")
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Fatalf("cancelling took %s", elapsed)
+	}
+}
@@ -0,0 +1,222 @@
+package media
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	ErrZipTooManyEntries = errors.New("archive has too many entries")
+	ErrZipTooLarge       = errors.New("archive expands beyond the maximum total size")
+)
+
+// ZipLimits guard against archives that expand far beyond their own size.
+type ZipLimits struct {
+	MaxEntries   int
+	MaxEntrySize int64 // uncompressed bytes of a single entry
+	MaxTotalSize int64 // uncompressed bytes of the whole archive
+	MaxRatio     int64 // uncompressed to compressed size ratio of an entry
+}
+
+// ZipEntryResult reports what happened to a single entry of an archive.
+type ZipEntryResult struct {
+	Name    string `json:"name"`
+	MediaID int64  `json:"media_id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ZipImportResult is the per entry report of ImportZip.
+type ZipImportResult struct {
+	CollectionID int64            `json:"collection_id"`
+	Succeeded    int              `json:"succeeded"`
+	Failed       int              `json:"failed"`
+	Entries      []ZipEntryResult `json:"entries"`
+}
+
+// DefaultZipLimits reads MEDIA.ZIP_MAX_ENTRIES, MEDIA.ZIP_MAX_ENTRY_SIZE, MEDIA.ZIP_MAX_TOTAL_SIZE and MEDIA.ZIP_MAX_RATIO.
+func DefaultZipLimits() ZipLimits {
+	return ZipLimits{
+		MaxEntries:   settings.Get("MEDIA.ZIP_MAX_ENTRIES", 1000).Int(),
+		MaxEntrySize: int64(settings.Get("MEDIA.ZIP_MAX_ENTRY_SIZE", "2gb").SizeInBytes()),
+		MaxTotalSize: int64(settings.Get("MEDIA.ZIP_MAX_TOTAL_SIZE", "10gb").SizeInBytes()),
+		MaxRatio:     settings.Get("MEDIA.ZIP_MAX_RATIO", 100).Int64(),
+	}
+}
+
+// ImportZip ingests every file of the archive as its own Media, processed with the named profile and private if
+// asked to, and appends them to the collection in archive order. The collection is created if it has no ID yet. Directories and hidden files
+// are skipped, and a failing entry is reported without stopping the others.
+func ImportZip(file string, collection *Collection, policy UploadPolicy, profile string, private bool, limits ZipLimits) (*ZipImportResult, error) {
+	archive, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer archive.Close()
+	if limits.MaxEntries > 0 && len(archive.File) > limits.MaxEntries {
+		return nil, ErrZipTooManyEntries
+	}
+	if collection.CollectionID == 0 {
+		if err = db.Create(collection).Error; err != nil {
+			return nil, err
+		}
+	}
+	var collectionID = collection.CollectionID
+
+	var result = ZipImportResult{CollectionID: collectionID, Entries: []ZipEntryResult{}}
+	var total int64
+	for _, entry := range archive.File {
+		// an unsafe name such as ../x starts like a hidden file, but is reported as it marks a malicious archive
+		if entry.FileInfo().IsDir() || (safeZipEntry(entry.Name) && hiddenZipEntry(entry.Name)) {
+			continue
+		}
+		var report = ZipEntryResult{Name: entry.Name}
+		size, err := importZipEntry(entry, collectionID, policy, profile, private, limits, limits.MaxTotalSize-total, &report)
+		total += size
+		if err != nil {
+			report.Error = err.Error()
+			result.Failed++
+		} else {
+			result.Succeeded++
+		}
+		result.Entries = append(result.Entries, report)
+		if errors.Is(err, ErrZipTooLarge) {
+			break
+		}
+	}
+	return &result, nil
+}
+
+// importZipEntry extracts and ingests a single entry and returns the number of bytes it expanded to.
+func importZipEntry(entry *zip.File, collectionID int64, policy UploadPolicy, profile string, private bool, limits ZipLimits, remaining int64, report *ZipEntryResult) (int64, error) {
+	// entries are never extracted by name, but an unsafe name still marks a malicious archive
+	if !safeZipEntry(entry.Name) {
+		return 0, fmt.Errorf("unsafe entry name")
+	}
+	if limits.MaxRatio > 0 && entry.CompressedSize64 > 0 && entry.UncompressedSize64/entry.CompressedSize64 > uint64(limits.MaxRatio) {
+		return 0, fmt.Errorf("compression ratio exceeds %d", limits.MaxRatio)
+	}
+	var limit = policy.SizeLimit("")
+	if limits.MaxEntrySize > 0 && (limit == 0 || limits.MaxEntrySize < limit) {
+		limit = limits.MaxEntrySize
+	}
+	if limit > 0 && entry.UncompressedSize64 > uint64(limit) {
+		if err := policy.CheckSize("", int64(entry.UncompressedSize64)); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("entry exceeds the maximum size of %d bytes", limit)
+	}
+
+	reader, err := entry.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	// the sizes in the archive headers can lie, so the limits are enforced on the decompressed stream too
+	var capacity = limit
+	if limits.MaxTotalSize > 0 && (capacity == 0 || remaining < capacity) {
+		capacity = remaining
+	}
+	var stream io.Reader = reader
+	if capacity > 0 {
+		stream = io.LimitReader(reader, capacity+1)
+	}
+	tmp, checksum, size, err := SaveTemp(stream)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	if capacity > 0 && size > capacity {
+		if capacity == remaining {
+			return size, ErrZipTooLarge
+		}
+		return size, fmt.Errorf("entry exceeds the maximum size of %d bytes", capacity)
+	}
+
+	var media = Media{Filename: NormalizeFileName(path.Base(entry.Name)), Profile: profile, Private: private}
+	if err = IngestFile(&media, tmp, checksum, policy); err != nil {
+		return size, err
+	}
+	report.MediaID = media.MediaID
+	if collectionID > 0 {
+		if err = AddToCollection(&media, collectionID); err != nil {
+			return size, err
+		}
+	}
+	return size, nil
+}
+
+func hiddenZipEntry(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") || segment == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+func safeZipEntry(name string) bool {
+	if name == "" || strings.Contains(name, "\\") || strings.HasPrefix(name, "/") {
+		return false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// ZipUploadHandler extracts an uploaded ZIP archive into a new collection, or into collection_id if given.
+func (c Controller) ZipUploadHandler(request *evo.Request) any {
+	file, err := request.FormFile("file")
+	if err != nil {
+		return err
+	}
+	var collectionID = request.BodyValue("collection_id").Int64()
+	policy, err := UploadPolicyFor(request, collectionID)
+	if err != nil {
+		return err
+	}
+	profile, err := ProfileFor(request.BodyValue("profile").String(), collectionID)
+	if err != nil {
+		return err
+	}
+	var limits = DefaultZipLimits()
+	if limits.MaxTotalSize > 0 && file.Size > limits.MaxTotalSize {
+		return ErrZipTooLarge
+	}
+
+	reader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	tmp, _, _, err := SaveTemp(reader)
+	reader.Close()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer os.Remove(tmp)
+
+	var collection = Collection{
+		CollectionID: collectionID,
+		Title:        request.BodyValue("title").String(),
+	}
+	if collection.Title == "" {
+		collection.Title = strings.TrimSuffix(NormalizeFileName(file.Filename), ".zip")
+	}
+	result, err := ImportZip(tmp, &collection, policy, profile, request.BodyValue("private").Bool(), limits)
+	if err != nil {
+		return err
+	}
+	return result
+}
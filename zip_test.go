@@ -0,0 +1,199 @@
+package media
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"github.com/getevo/evo/v2/lib/db"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// zipEntry is an entry of a crafted archive. A declared size other than 0 replaces the real uncompressed size in
+// the headers.
+type zipEntry struct {
+	name     string
+	content  []byte
+	declared uint64
+}
+
+// buildZip writes the entries into an archive below t.TempDir() and returns its path.
+func buildZip(t *testing.T, entries ...zipEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	var writer = zip.NewWriter(&buf)
+	for _, entry := range entries {
+		var compressed bytes.Buffer
+		deflate, _ := flate.NewWriter(&compressed, flate.BestCompression)
+		deflate.Write(entry.content)
+		deflate.Close()
+		var header = zip.FileHeader{
+			Name:               entry.name,
+			Method:             zip.Deflate,
+			CRC32:              crc32.ChecksumIEEE(entry.content),
+			CompressedSize64:   uint64(compressed.Len()),
+			UncompressedSize64: uint64(len(entry.content)),
+		}
+		if entry.declared > 0 {
+			header.UncompressedSize64 = entry.declared
+		}
+		w, err := writer.CreateRaw(&header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(compressed.Bytes())
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var file = filepath.Join(t.TempDir(), "archive.zip")
+	if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// entryResults maps the entries of a result to their errors.
+func entryResults(result *ZipImportResult) map[string]string {
+	var results = map[string]string{}
+	for _, entry := range result.Entries {
+		results[entry.Name] = entry.Error
+	}
+	return results
+}
+
+func TestImportZipEntryNames(t *testing.T) {
+	setupTest(t)
+	var file = buildZip(t,
+		zipEntry{name: "photos/a.txt", content: []byte("a")},
+		zipEntry{name: "../evil.txt", content: []byte("evil")},
+		zipEntry{name: "photos/../../evil.txt", content: []byte("evil")},
+		zipEntry{name: "/etc/evil.txt", content: []byte("evil")},
+		zipEntry{name: `..\evil.txt`, content: []byte("evil")},
+		zipEntry{name: "photos/.hidden.txt", content: []byte("hidden")},
+		zipEntry{name: ".git/config", content: []byte("hidden")},
+		zipEntry{name: "__MACOSX/photos/._a.txt", content: []byte("resource fork")},
+		zipEntry{name: "photos/", content: nil},
+		zipEntry{name: "photos/b.txt", content: []byte("b")},
+	)
+	var collection = Collection{Title: "photos"}
+	result, err := ImportZip(file, &collection, UploadPolicy{}, "", false, DefaultZipLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results = entryResults(result)
+	for _, name := range []string{"photos/.hidden.txt", ".git/config", "__MACOSX/photos/._a.txt", "photos/"} {
+		if _, ok := results[name]; ok {
+			t.Errorf("%s should be skipped", name)
+		}
+	}
+	for _, name := range []string{"../evil.txt", "photos/../../evil.txt", "/etc/evil.txt", `..\evil.txt`} {
+		if results[name] != "unsafe entry name" {
+			t.Errorf("%s: expected an unsafe name, got %q", name, results[name])
+		}
+	}
+	if result.Succeeded != 2 || result.Failed != 4 || results["photos/a.txt"] != "" || results["photos/b.txt"] != "" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	// nothing was written outside the storage, and only the safe entries became media of the collection
+	for _, p := range []string{filepath.Join(filepath.Dir(TemporaryDir), "evil.txt"), filepath.Join(LocalUploadDir, "..", "evil.txt"), "/etc/evil.txt"} {
+		if _, err = os.Stat(p); err == nil {
+			t.Fatalf("%s was written", p)
+		}
+	}
+	var items []CollectionItems
+	db.Where("collection_id = ?", collection.CollectionID).Order("visual_order").Preload("Media").Find(&items)
+	if len(items) != 2 || items[0].Media.Filename != "a.txt" || items[1].Media.Filename != "b.txt" {
+		t.Fatalf("unexpected collection items %+v", items)
+	}
+	assertNoTempFiles(t)
+}
+
+func TestImportZipBombs(t *testing.T) {
+	var limits = ZipLimits{MaxEntries: 10, MaxEntrySize: 1024, MaxTotalSize: 4096, MaxRatio: 100}
+	var tests = []struct {
+		name    string
+		entries []zipEntry
+		policy  UploadPolicy
+		errors  map[string]string
+	}{
+		{"size declared beyond the entry limit", []zipEntry{
+			{name: "big.txt", content: bytes.Repeat([]byte("0123456789"), 200)},
+		}, UploadPolicy{}, map[string]string{"big.txt": "entry exceeds the maximum size of 1024 bytes"}},
+		{"size declared beyond the policy", []zipEntry{
+			{name: "big.txt", content: bytes.Repeat([]byte("0123456789"), 20)},
+		}, UploadPolicy{MaxSize: 100}, map[string]string{"big.txt": "file exceeds the maximum size of 100 bytes"}},
+		{"size understated", []zipEntry{
+			{name: "liar.txt", content: randomText(2048), declared: 10},
+		}, UploadPolicy{}, map[string]string{"liar.txt": "*"}},
+		{"high compression ratio", []zipEntry{
+			{name: "zeros.txt", content: make([]byte, 10000)},
+		}, UploadPolicy{}, map[string]string{"zeros.txt": "compression ratio exceeds 100"}},
+		{"total size", []zipEntry{
+			{name: "1.txt", content: randomText(1000)},
+			{name: "2.txt", content: randomText(1000)},
+			{name: "3.txt", content: randomText(1000)},
+			{name: "4.txt", content: randomText(1000)},
+			{name: "5.txt", content: randomText(1000)},
+			{name: "6.txt", content: randomText(1000)},
+		}, UploadPolicy{}, map[string]string{"1.txt": "", "2.txt": "", "3.txt": "", "4.txt": "", "5.txt": ErrZipTooLarge.Error()}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			result, err := ImportZip(buildZip(t, test.entries...), &Collection{Title: test.name}, test.policy, "", false, limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var results = entryResults(result)
+			if len(results) != len(test.errors) {
+				t.Fatalf("entries %v, expected %v", results, test.errors)
+			}
+			for name, expected := range test.errors {
+				var got, ok = results[name]
+				if !ok || (expected == "*" && got == "") || (expected != "*" && got != expected) {
+					t.Fatalf("%s: error %q, expected %q", name, got, expected)
+				}
+			}
+			// no entry is stored beyond its limit
+			var count int64
+			db.Model(&Media{}).Where("file_size > ?", limits.MaxEntrySize).Count(&count)
+			if count != 0 {
+				t.Fatalf("an entry beyond the limit was stored")
+			}
+			assertNoTempFiles(t)
+		})
+	}
+}
+
+func TestImportZipEntryCount(t *testing.T) {
+	setupTest(t)
+	var entries []zipEntry
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		entries = append(entries, zipEntry{name: name, content: []byte(name)})
+	}
+	var collection = Collection{Title: "many"}
+	_, err := ImportZip(buildZip(t, entries...), &collection, UploadPolicy{}, "", false, ZipLimits{MaxEntries: 2})
+	if !errors.Is(err, ErrZipTooManyEntries) {
+		t.Fatalf("expected ErrZipTooManyEntries, got %v", err)
+	}
+	if collection.CollectionID != 0 {
+		t.Fatalf("a collection was created for a rejected archive")
+	}
+}
+
+// randomText returns n bytes of text that deflate cannot shrink much.
+func randomText(n int) []byte {
+	var text = make([]byte, n)
+	var seed uint32 = 2166136261
+	for i := range text {
+		seed = seed*16777619 ^ uint32(i)
+		text[i] = "abcdefghijklmnopqrstuvwxyz0123456789"[seed%36]
+	}
+	return text
+}